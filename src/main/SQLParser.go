@@ -1,6 +1,6 @@
 package main
 
-//import ("fmt")
+import ("fmt")
 
 var SqlCmd string 
 
@@ -21,24 +21,34 @@ func (c *Compiler) CreateTable() {
 
 func (c *Compiler) SelectStatement() {
 	SqlCmd = "SELECT "
+	varCount := c.SqlParameters()
+	idx := c.MakeConstant(ObjString(SqlCmd))
+	//fmt.Println(SqlCmd)
+	c.EmitInstr(OP_PUSH, varCount)
+	c.EmitInstr(OP_SQL_SELECT,idx)
+	//c.EmitOp(OP_DISPLAY_TABLE)
+}
+
+// Reads the rest of the statement into SqlCmd. Every $var becomes a ?
+// placeholder and the variable's value gets pushed so that the VM can bind
+// it, which leaves quoting to the driver
+func (c *Compiler) SqlParameters() int16 {
 	varCount := int16(0)
-	for !c.Match(TOKEN_SEMICOLON) {
+	for !c.Check(TOKEN_SEMICOLON) && !c.Check(TOKEN_EOF) {
 		if c.Match(TOKEN_DOLLAR) {
 			varCount++
 			// Get the variable on to the stack
 			c.Advance()
-			//tok := c.Parser.Previous
-			c.NamedVariable(true)
-			SqlCmd += "%v"
+			c.NamedVariable(false)
+			PopExpressionValue()
+			SqlCmd += "? "
+			continue
 		}
 		c.Advance()
 		SqlCmd += c.Parser.Previous.ToString() + " "
 	}
-	idx := c.MakeConstant(ObjString(SqlCmd))
-	//fmt.Println(SqlCmd)
-	c.EmitInstr(OP_PUSH, varCount)
-	c.EmitInstr(OP_SQL_SELECT,idx)
-	//c.EmitOp(OP_DISPLAY_TABLE)
+	c.Consume(TOKEN_SEMICOLON, "Expect ';' after SQL statement.")
+	return varCount
 }
 
 func (c *Compiler) CreateStatement() {
@@ -50,23 +60,53 @@ func (c *Compiler) CreateStatement() {
 
 func (c *Compiler) InsertStatement() {
 	SqlCmd = "INSERT "
-	varCount := int16(0)
-	for !c.Match(TOKEN_SEMICOLON) {
-		if c.Match(TOKEN_DOLLAR) {
-			varCount++
-			// Get the variable on to the stack
-			c.Advance()
-			//tok := c.Parser.Previous
-			c.NamedVariable(true)
-			SqlCmd += "%v"
-		}
-		c.Advance()
-
-		SqlCmd += c.Parser.Previous.ToString() + " "
-	}
+	varCount := c.SqlParameters()
 	SqlCmd+="\n"
 	idx := c.MakeConstant(ObjString(SqlCmd))
 	c.EmitInstr(OP_PUSH, varCount)
 	c.EmitInstr(OP_INSERT, idx)
 }
 
+// UPDATE and DELETE leave the number of rows they changed on the stack so
+// that they can be used as expressions
+func (c *Compiler) UpdateStatement() {
+	SqlCmd = "UPDATE "
+	varCount := c.SqlParameters()
+	idx := c.MakeConstant(ObjString(SqlCmd))
+	c.EmitInstr(OP_PUSH, varCount)
+	c.EmitInstr(OP_UPDATE, idx)
+}
+
+func (c *Compiler) DeleteStatement() {
+	SqlCmd = "DELETE "
+	varCount := c.SqlParameters()
+	idx := c.MakeConstant(ObjString(SqlCmd))
+	c.EmitInstr(OP_PUSH, varCount)
+	c.EmitInstr(OP_DELETE, idx)
+}
+
+// load csv <file> into table <name>; streams a delimited file into a table.
+// The file is a quoted name or any string expression
+func (c *Compiler) LoadStatement() {
+	c.Consume(TOKEN_IDENTIFIER, "Expect 'csv' after 'load'")
+	if c.Parser.Previous.ToString() != "csv" {
+		c.Error("Only csv files can be loaded")
+	}
+
+	if c.Match(TOKEN_STRING2) {
+		path := c.Parser.Previous.ToString()
+		c.EmitInstr(OP_SCONST, c.MakeConstant(ObjString(path[1:len(path)-1])))
+	} else {
+		c.Expression()
+		if path := PopExpressionValue(); !IsUnknownType(path) && path.Value != VAL_STRING {
+			c.TypeError(c.Parser.Previous, fmt.Sprintf("The file to load must be a string, not %s", TypeName(path)))
+		}
+	}
+
+	c.Consume(TOKEN_INTO, "Expect 'into' after the file to load")
+	c.Consume(TOKEN_TABLE, "Expect 'table' after 'into'")
+	c.Consume(TOKEN_IDENTIFIER, "Expect table name")
+	idx := c.MakeConstant(ObjString(c.Parser.Previous.ToString()))
+	c.Consume(TOKEN_SEMICOLON, "Expect ';' after SQL statement.")
+	c.EmitInstr(OP_LOAD_CSV, idx)
+}
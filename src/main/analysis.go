@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+)
+
+/* ---------------------------------------------------------------------------
+Source analysis for the language server. While Analyzing is set, the compiler
+records every name it declares, every name it resolves and every error it
+reports, along with the token it happened at. Nothing gets recorded during a
+normal compile so the hooks below all bail out early when Analyzing is nil.
+
+Tokens carry their byte offset into the source, which is what the language
+server turns into line and column positions.
+------------------------------------------------------------------------------*/
+
+type SymbolKind int
+
+const (
+	SYMBOL_VARIABLE SymbolKind = iota
+	SYMBOL_PARAMETER
+	SYMBOL_FUNCTION
+	SYMBOL_CLASS
+	SYMBOL_ENUM
+	SYMBOL_PROPERTY
+	SYMBOL_METHOD
+)
+
+var SymbolKindLabel = map[SymbolKind]string{
+	SYMBOL_VARIABLE:  "var",
+	SYMBOL_PARAMETER: "param",
+	SYMBOL_FUNCTION:  "func",
+	SYMBOL_CLASS:     "class",
+	SYMBOL_ENUM:      "enum",
+	SYMBOL_PROPERTY:  "property",
+	SYMBOL_METHOD:    "method",
+}
+
+// A declared name
+type Symbol struct {
+	Name      string
+	Kind      SymbolKind
+	File      string // The file it was declared in
+	Token     Token  // Where it was declared
+	Data      ExpressionData
+	Container *Symbol // The class of a property or method
+	IsLocal   bool
+}
+
+// A name that got used somewhere. Properties can be used before the class
+// declares them, so those are matched up with their symbol by name later on
+type Reference struct {
+	Token      Token
+	Symbol     *Symbol
+	Data       ExpressionData
+	Native     *ObjNative
+	Class      *Symbol // The class 'this' refers to for properties
+	IsProperty bool
+}
+
+type Diagnostic struct {
+	File      string
+	Token     Token
+	Message   string
+	IsWarning bool
+}
+
+type Analysis struct {
+	File        string // The file the analysis was asked for
+	Symbols     []*Symbol
+	References  []Reference
+	Diagnostics []Diagnostic
+}
+
+// Set while the language server compiles a document
+var Analyzing *Analysis
+
+// Declares a symbol for the name in the token
+func (c *Compiler) DefineSymbol(tok Token, kind SymbolKind) *Symbol {
+	if Analyzing == nil {
+		return nil
+	}
+	symbol := &Symbol{
+		Name:    tok.ToString(),
+		Kind:    kind,
+		File:    c.SourceFile,
+		Token:   tok,
+		IsLocal: c.ScopeDepth > 0,
+	}
+	if kind == SYMBOL_PROPERTY || kind == SYMBOL_METHOD {
+		symbol.Container = c.ClassSymbol
+	}
+	Analyzing.Symbols = append(Analyzing.Symbols, symbol)
+	return symbol
+}
+
+// Functions, classes and enums find out what they are once the expression
+// assigned to the name gets compiled
+func (s *Symbol) SetKind(kind SymbolKind) {
+	if s != nil && s.Kind == SYMBOL_VARIABLE {
+		s.Kind = kind
+	}
+}
+
+func (s *Symbol) SetData(data ExpressionData) {
+	if s != nil {
+		s.Data = data
+	}
+}
+
+// Records the use of a name. Only references in the file being analyzed
+// are of any interest
+func (c *Compiler) ReferenceSymbol(tok Token, symbol *Symbol, data ExpressionData) {
+	if Analyzing == nil || c.SourceFile != Analyzing.File {
+		return
+	}
+	Analyzing.References = append(Analyzing.References, Reference{
+		Token:  tok,
+		Symbol: symbol,
+		Data:   data,
+	})
+}
+
+func (c *Compiler) ReferenceNative(tok Token, native *ObjNative) {
+	if Analyzing == nil || c.SourceFile != Analyzing.File {
+		return
+	}
+	Analyzing.References = append(Analyzing.References, Reference{
+		Token:  tok,
+		Data:   native.ReturnType,
+		Native: native,
+	})
+}
+
+func (c *Compiler) ReferenceProperty(tok Token, isThis bool) {
+	if Analyzing == nil || c.SourceFile != Analyzing.File {
+		return
+	}
+	ref := Reference{
+		Token:      tok,
+		Data:       ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN},
+		IsProperty: true,
+	}
+	if isThis {
+		ref.Class = c.ClassSymbol
+	}
+	Analyzing.References = append(Analyzing.References, ref)
+}
+
+func (c *Compiler) Diagnose(token *Token, message string, isWarning bool) {
+	if Analyzing == nil {
+		return
+	}
+	Analyzing.Diagnostics = append(Analyzing.Diagnostics, Diagnostic{
+		File:      c.SourceFile,
+		Token:     *token,
+		Message:   message,
+		IsWarning: isWarning,
+	})
+}
+
+// Finds the property a reference points at. A property used through 'this'
+// belongs to the class it's used in; anything else goes by the name alone
+func (a *Analysis) ResolveProperty(ref *Reference) *Symbol {
+	var found *Symbol
+	for _, symbol := range a.Symbols {
+		if symbol.Container == nil || symbol.Name != ref.Token.ToString() {
+			continue
+		}
+		if ref.Class != nil && symbol.Container == ref.Class {
+			return symbol
+		}
+		if found == nil {
+			found = symbol
+		}
+	}
+	return found
+}
+
+// The symbol declared at, or referenced at, the given offset in the file
+func (a *Analysis) SymbolAt(offset int) (*Symbol, *Reference) {
+	for i := range a.References {
+		ref := &a.References[i]
+		if covers(ref.Token, offset) {
+			if ref.IsProperty && ref.Symbol == nil {
+				ref.Symbol = a.ResolveProperty(ref)
+			}
+			return ref.Symbol, ref
+		}
+	}
+	for _, symbol := range a.Symbols {
+		if symbol.File == a.File && covers(symbol.Token, offset) {
+			return symbol, nil
+		}
+	}
+	return nil, nil
+}
+
+func covers(tok Token, offset int) bool {
+	return offset >= tok.Start && offset < tok.Start+tok.Length
+}
+
+// Describes a symbol the way it would be declared
+func (s *Symbol) Describe() string {
+	switch s.Kind {
+	case SYMBOL_FUNCTION, SYMBOL_METHOD:
+		if s.Data.Returns != VAL_NIL {
+			return fmt.Sprintf("%s %s(): %s", SymbolKindLabel[s.Kind], s.Name, ValueTypeLabel[s.Data.Returns])
+		}
+		return fmt.Sprintf("%s %s()", SymbolKindLabel[s.Kind], s.Name)
+	case SYMBOL_CLASS, SYMBOL_ENUM:
+		return fmt.Sprintf("%s %s", SymbolKindLabel[s.Kind], s.Name)
+	}
+	name := s.Name
+	if s.Container != nil {
+		name = s.Container.Name + "." + name
+	}
+	return fmt.Sprintf("%s %s: %s", SymbolKindLabel[s.Kind], name, TypeName(s.Data))
+}
+
+// Describes whatever is at the reference, preferring what's known about the
+// value where it gets used
+func (r *Reference) Describe() string {
+	if r.Native != nil {
+		if r.Native.hasReturn {
+			return fmt.Sprintf("native %s(): %s", r.Native.Name, TypeName(r.Native.ReturnType))
+		}
+		return fmt.Sprintf("native %s()", r.Native.Name)
+	}
+	if r.Symbol == nil {
+		return fmt.Sprintf("%s: %s", r.Token.ToString(), TypeName(r.Data))
+	}
+	if r.Symbol.Kind == SYMBOL_VARIABLE || r.Symbol.Kind == SYMBOL_PARAMETER || r.Symbol.Kind == SYMBOL_PROPERTY {
+		if !IsUnknownType(r.Data) {
+			symbol := *r.Symbol
+			symbol.Data = r.Data
+			return symbol.Describe()
+		}
+	}
+	return r.Symbol.Describe()
+}
+
+// Hands over the symbol being declared when the expression that was just
+// started is its whole initializer, as in 'var f = func() {}'. Anything
+// nested inside the initializer doesn't get to claim it
+func (c *Compiler) DeclaredSymbol(kind SymbolKind) *Symbol {
+	symbol := c.Declaring
+	c.Declaring = nil
+	if c.Parser.Prev2.Type != TOKEN_EQUAL {
+		return nil
+	}
+	symbol.SetKind(kind)
+	return symbol
+}
+
+// Compiles the source of a file and returns everything that was recorded
+// along the way. The compiler keeps its state in package variables, so those
+// get cleared first for each analysis
+func AnalyzeSource(source string, path string) (analysis *Analysis) {
+	ResetCompilerState()
+	analysis = &Analysis{File: path}
+	Analyzing = analysis
+
+	defer func() {
+		Analyzing = nil
+		if r := recover(); r != nil {
+			analysis.Diagnostics = append(analysis.Diagnostics, Diagnostic{
+				File:    path,
+				Message: fmt.Sprintf("Compiler error: %v", r),
+			})
+		}
+	}()
+
+	source += "\n"
+	Compile(&source, path, false)
+	return analysis
+}
+
+func ResetCompilerState() {
+	for i := int16(0); i < GlobalCount; i++ {
+		GlobalVars[i] = Global{}
+	}
+	GlobalCount = 0
+	ModuleTable = make([]*ObjModule, 0)
+	ExpressionValueId = 0
+	ScopeId = -1
+	CurrentClass = nil
+	AssignedProperties = make(map[PropertyKey]bool)
+	PropertyReads = nil
+	ClassVarId = 0
+	BreakPtr = 0
+	StartPtr = 0
+	LoopPtr = 0
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+)
+
+/* ---------------------------------------------------------------------------
+Precompiled bytecode (.cyc files). A compiled module is written out as:
+
+	magic     "CYC\x00"
+	version   uint16
+	checksum  uint32 (CRC-32 of the payload)
+	length    uint32 (length of the payload)
+	payload   the module name and main function, then the same for each
+	          of the modules it imports
+
+Functions are written with their chunk: the code, the line table, the source
+file and the constants. Functions nested inside it sit in the constants so
+they get written out recursively. Natives are written by the name they were
+registered under and looked up again when the file is loaded. Everything is
+big endian like the rest of the byte conversions.
+------------------------------------------------------------------------------*/
+
+const BytecodeExtension = ".cyc"
+
+// Bump this every time the layout of the file, the opcodes or their operands
+// change so that stale files get rejected instead of misbehaving
+const BytecodeVersion uint16 = 11
+
+var bytecodeMagic = []byte{'C', 'Y', 'C', 0}
+
+// Tags for the values in the constants pool
+const (
+	CONST_NIL byte = iota
+	CONST_INTEGER
+	CONST_FLOAT
+	CONST_STRING
+	CONST_BOOL
+	CONST_FUNCTION
+	CONST_NATIVE
+)
+
+// Compiles a source file and writes the result out as bytecode
+func CompileFile(path string, outPath string) error {
+	source := ReadFile(path) + "\n"
+	mod := Compile(&source, path, false)
+	if mod == nil {
+		return errors.New("compilation failed")
+	}
+	return ioutil.WriteFile(outPath, EncodeModule(mod), 0644)
+}
+
+// Reads a bytecode file back into a module that is ready to run
+func LoadBytecode(path string) (*ObjModule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeModule(data)
+}
+
+func EncodeModule(mod *ObjModule) []byte {
+	w := &bytecodeWriter{}
+	w.String(mod.Name)
+	w.Function(mod.MainFunction)
+	w.Uint32(uint32(len(mod.LoadedModules)))
+	for _, loaded := range mod.LoadedModules {
+		w.String(loaded.Name)
+		w.String(loaded.Path)
+		w.Function(loaded.MainFunction)
+	}
+	payload := w.buf.Bytes()
+
+	out := &bytecodeWriter{}
+	out.buf.Write(bytecodeMagic)
+	out.Uint16(BytecodeVersion)
+	out.Uint32(crc32.ChecksumIEEE(payload))
+	out.Uint32(uint32(len(payload)))
+	out.buf.Write(payload)
+	return out.buf.Bytes()
+}
+
+func DecodeModule(data []byte) (*ObjModule, error) {
+	if len(data) < 14 || !bytes.Equal(data[:4], bytecodeMagic) {
+		return nil, errors.New("not a Coyote bytecode file")
+	}
+
+	version := binary.BigEndian.Uint16(data[4:6])
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("bytecode version %d is not supported by this version of Coyote (expected %d); recompile the source", version, BytecodeVersion)
+	}
+
+	checksum := binary.BigEndian.Uint32(data[6:10])
+	length := binary.BigEndian.Uint32(data[10:14])
+	payload := data[14:]
+	if uint32(len(payload)) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("bytecode file is corrupt (checksum mismatch)")
+	}
+
+	r := &bytecodeReader{data: payload}
+	mod := NewModule(r.String(), "")
+	mod.MainFunction = r.Function()
+
+	mod.ModuleCount = int(r.Uint32())
+	for i := 0; i < mod.ModuleCount && r.err == nil; i++ {
+		loaded := NewModule(r.String(), "")
+		loaded.Path = r.String()
+		loaded.MainFunction = r.Function()
+		loaded.ParentModule = mod
+		mod.LoadedModules = append(mod.LoadedModules, loaded)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return mod, nil
+}
+
+/* ---------------------------------------------------------------------------
+Writer
+------------------------------------------------------------------------------*/
+type bytecodeWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *bytecodeWriter) Byte(b byte) {
+	w.buf.WriteByte(b)
+}
+
+func (w *bytecodeWriter) Uint16(val uint16) {
+	w.buf.Write(Int16ToBytes(int16(val)))
+}
+
+func (w *bytecodeWriter) Uint32(val uint32) {
+	w.buf.Write(Int32ToBytes(int32(val)))
+}
+
+func (w *bytecodeWriter) Int64(val int64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(val))
+	w.buf.Write(b)
+}
+
+func (w *bytecodeWriter) String(s string) {
+	w.Uint32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *bytecodeWriter) Function(fn *ObjFunction) {
+	w.String(fn.Name)
+	w.Uint16(uint16(fn.Arity))
+	w.Uint32(uint32(fn.UpvalueCount))
+	w.Byte(byte(fn.FuncType))
+	w.Uint32(uint32(fn.Id))
+	w.Uint32(uint32(fn.LocalSlots))
+	w.Chunk(fn.Code)
+}
+
+func (w *bytecodeWriter) Chunk(c *Chunk) {
+	w.String(c.File)
+
+	w.Uint32(uint32(len(c.Code)))
+	w.buf.Write(c.Code)
+
+	w.Uint32(uint32(len(c.Lines)))
+	for _, run := range c.Lines {
+		w.Uint32(uint32(run.Offset))
+		w.Uint32(uint32(run.Line))
+	}
+
+	w.Uint32(uint32(c.ConstantsCount))
+	for i := 0; i < c.ConstantsCount; i++ {
+		w.Constant(c.Constants[i])
+	}
+}
+
+func (w *bytecodeWriter) Constant(val Obj) {
+	switch v := val.(type) {
+	case nil, NULL, *NULL:
+		w.Byte(CONST_NIL)
+	case ObjInteger:
+		w.Byte(CONST_INTEGER)
+		w.Int64(int64(v))
+	case ObjFloat:
+		w.Byte(CONST_FLOAT)
+		w.Int64(int64(math.Float64bits(float64(v))))
+	case ObjString:
+		w.Byte(CONST_STRING)
+		w.String(string(v))
+	case ObjBool:
+		w.Byte(CONST_BOOL)
+		w.buf.Write(BoolToBytes(v.Value))
+	case *ObjFunction:
+		w.Byte(CONST_FUNCTION)
+		w.Function(v)
+	case *ObjNative:
+		w.Byte(CONST_NATIVE)
+		w.String(v.Name)
+	default:
+		panic(fmt.Sprintf("Can't write a constant of type %T to bytecode", val))
+	}
+}
+
+/* ---------------------------------------------------------------------------
+Reader. The first problem it runs into is kept in err and everything after
+that reads as zero values
+------------------------------------------------------------------------------*/
+type bytecodeReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bytecodeReader) next(n int) []byte {
+	if r.err == nil && (n < 0 || r.pos+n > len(r.data)) {
+		r.err = errors.New("bytecode file is truncated")
+	}
+	if r.err != nil {
+		// Fixed size reads still need something to decode
+		if n < 0 || n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *bytecodeReader) Byte() byte {
+	return r.next(1)[0]
+}
+
+func (r *bytecodeReader) Uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *bytecodeReader) Uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *bytecodeReader) Int64() int64 {
+	return int64(binary.BigEndian.Uint64(r.next(8)))
+}
+
+func (r *bytecodeReader) String() string {
+	return string(r.next(int(r.Uint32())))
+}
+
+func (r *bytecodeReader) Function() *ObjFunction {
+	fn := &ObjFunction{}
+	fn.Name = r.String()
+	fn.Arity = int16(r.Uint16())
+	fn.UpvalueCount = int(r.Uint32())
+	fn.FuncType = FunctionType(r.Byte())
+	fn.Id = int(r.Uint32())
+	fn.LocalSlots = int(r.Uint32())
+	fn.Code = r.Chunk()
+	return fn
+}
+
+func (r *bytecodeReader) Chunk() *Chunk {
+	c := &Chunk{}
+	c.File = r.String()
+
+	code := r.next(int(r.Uint32()))
+	c.Code = append([]byte(nil), code...)
+	c.Count = len(c.Code)
+
+	lineCount := int(r.Uint32())
+	c.Lines = make([]LineRun, 0, lineCount)
+	for i := 0; i < lineCount && r.err == nil; i++ {
+		offset := int(r.Uint32())
+		line := int(r.Uint32())
+		c.Lines = append(c.Lines, LineRun{Offset: offset, Line: line})
+	}
+
+	c.ConstantsCount = int(r.Uint32())
+	c.Constants = make([]Obj, 0, c.ConstantsCount)
+	for i := 0; i < c.ConstantsCount && r.err == nil; i++ {
+		c.Constants = append(c.Constants, r.Constant())
+	}
+	return c
+}
+
+func (r *bytecodeReader) Constant() Obj {
+	switch tag := r.Byte(); tag {
+	case CONST_NIL:
+		return &NULL{}
+	case CONST_INTEGER:
+		return ObjInteger(r.Int64())
+	case CONST_FLOAT:
+		return ObjFloat(math.Float64frombits(uint64(r.Int64())))
+	case CONST_STRING:
+		return ObjString(r.String())
+	case CONST_BOOL:
+		return ObjBool{Value: BytesToBool(r.next(1))}
+	case CONST_FUNCTION:
+		return r.Function()
+	case CONST_NATIVE:
+		name := r.String()
+		native := ResolveNativeFunction(name)
+		if native == nil && r.err == nil {
+			r.err = fmt.Errorf("bytecode refers to unknown native function '%s'", name)
+		}
+		return native
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("bytecode file has an unknown constant tag %d", tag)
+		}
+		return &NULL{}
+	}
+}
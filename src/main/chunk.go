@@ -3,19 +3,55 @@ package main
 type Chunk struct {
 	Count          int
 	Capacity       int
-	Lines          []int
+	Lines          []LineRun
+	File           string // Source file the code was compiled from
 	Code           []byte
 	ConstantsCount int
 	Constants      []Obj
 }
 
+// The line table is run-length encoded: each run starts at a byte offset in
+// the code and covers every byte up to the start of the next run
+type LineRun struct {
+	Offset int
+	Line   int // 1 based source line
+}
+
 func NewChunk() Chunk {
 	return Chunk{
 		Count:          0,
 		Capacity:       65000,
-		Lines:          make([]int, 65000),
+		Lines:          make([]LineRun, 0),
 		Code:           make([]byte, 65000),
 		ConstantsCount: 0,
 		Constants:      make([]Obj, 65000),
 	}
 }
+
+// Adds the line for the code starting at the given offset. Consecutive
+// instructions from the same line share a single run
+func (c *Chunk) AddLine(offset int, line int) {
+	if len(c.Lines) > 0 && c.Lines[len(c.Lines)-1].Line == line {
+		return
+	}
+	c.Lines = append(c.Lines, LineRun{Offset: offset, Line: line})
+}
+
+// Finds the source line of the byte at the given offset
+func (c *Chunk) GetLine(offset int) int {
+	if len(c.Lines) == 0 || offset < 0 {
+		return 0
+	}
+
+	// Binary search for the last run starting at or before the offset
+	low, high := 0, len(c.Lines)-1
+	for low < high {
+		mid := (low + high + 1) / 2
+		if c.Lines[mid].Offset <= offset {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return c.Lines[low].Line
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -35,6 +36,25 @@ const (
 // referring to when we come to a . modifier
 var CurrentClass *ClassVar
 
+// The properties that get assigned somewhere or that their class gives a
+// default to. Reads of properties can come before the assignments, so they're
+// checked against these once the whole program has been compiled
+var AssignedProperties = make(map[PropertyKey]bool)
+var PropertyReads []PropertyRead
+
+// A property of the class that declares it. Properties assigned on objects
+// whose class isn't known are kept with a nil class
+type PropertyKey struct {
+	Class *ClassVar
+	Name  string
+}
+
+type PropertyRead struct {
+	Compiler *Compiler
+	Token    Token
+	Property *PropertyVar // Nil if the class doesn't declare it
+}
+
 // Keeps track of break and continue instruction locations
 type Break struct {
 	StartLoc int  // Continue will bump up to here
@@ -62,6 +82,7 @@ const (
 	LOOP_WHILE byte = iota
 	LOOP_FOR
 	LOOP_SCAN
+	LOOP_PFOR
 )
 
 var LoopType = make([]byte, 255)
@@ -99,6 +120,29 @@ type ClassVar struct {
 	Enclosing     *ClassVar
 	Properties    []PropertyVar
 	PropertyCount int16
+	HasParent     bool
+	Parent        *ClassVar // Nil when the class it inherits from isn't known
+}
+
+// The property or method of the class with the given name, inherited or not
+func (cv *ClassVar) FindProperty(name string) *PropertyVar {
+	for i := int16(0); i < cv.PropertyCount; i++ {
+		if cv.Properties[i].Name == name {
+			return &cv.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Whether the class is the other class or inherits from it. A parent that
+// isn't known could be anything, so it gets the benefit of the doubt
+func (cv *ClassVar) InheritsFrom(other *ClassVar) bool {
+	for class := cv; class != nil; class = class.Parent {
+		if class == other || (class.HasParent && class.Parent == nil) {
+			return true
+		}
+	}
+	return false
 }
 
 func NewClassVar() ClassVar {
@@ -111,11 +155,25 @@ func NewClassVar() ClassVar {
 	}
 }
 
+// A try statement being compiled. Leaving it with break, continue or return
+// has to close the handler it has open, and a return goes through its finally
+// block with what it returns held in a local
+type TryBlock struct {
+	Handler   bool  // Whether the try or catch block's handler is open
+	LoopPtr   int   // How many loops deep the statement is
+	Returning int16 // Local that says a return is on its way through
+	Value     int16 // Local that holds what the return gives back
+	Returns   []int // Jumps from returns to the finally block
+}
+
 // Function structure
 type FunctionVar struct {
 	Enclosing  *FunctionVar
+	name       string
+	file       string
 	paramCount int16
 	returnType ValueType
+	returnData ExpressionData // The full type of what the function returns
 	instr      Instructions
 
 	Locals   []Local
@@ -123,18 +181,45 @@ type FunctionVar struct {
 
 	Classes []Local
 
+	// The types of the parameters, in order
+	params []ExpressionData
+
+	// The try statements the code being compiled is inside of, innermost last
+	tries []*TryBlock
+
 	LocalCount   int16
 	UpvalueCount int16
+
+	// The most locals we've had in play at once. The VM reserves this many
+	// slots at the bottom of the function's frame
+	LocalSlots int16
+
+	// Every local the function ever had, for the debugger
+	LocalInfo []LocalInfo
+}
+
+func (f *FunctionVar) UpvalueNames() []string {
+	names := make([]string, f.UpvalueCount)
+	for i := range names {
+		names[i] = f.Upvalues[i].name
+	}
+	return names
 }
 
 func (f *FunctionVar) ConvertToObj() *ObjFunction {
 	FunctionId++
+	code := f.instr.ToChunk()
+	code.File = f.file
 	return &ObjFunction{
 		Arity:        f.paramCount,
-		Code:         f.instr.ToChunk(),
+		Code:         code,
 		UpvalueCount: int(f.UpvalueCount),
 		FuncType:     TYPE_FUNCTION,
 		Id:           FunctionId,
+		Name:         f.name,
+		LocalSlots:   int(f.LocalSlots),
+		Locals:       f.LocalInfo,
+		UpvalueNames: f.UpvalueNames(),
 	}
 }
 
@@ -149,68 +234,106 @@ type Compiler struct {
 
 	MainModuleDefined bool
 
-	Modules []ObjModule
-	ModuleCount int
+	// Name of the variable or method the next function gets assigned to
+	FunctionName string
+
 	CurrentModule *ObjModule
 
+	SourceFile string // Path of the file being compiled
+
+	// The class whose body is being compiled, if any
+	InClass *ClassVar
+
+	// Symbols for the language server: the name being declared and the
+	// class being compiled. Both are nil unless the source is being analyzed
+	Declaring   *Symbol
+	ClassSymbol *Symbol
 }
 
-func (c *Compiler) CompileModule(path string, dbgMode bool) *ObjModule{
+// Compiles an imported file into a module of its own. Its top level code ends
+// with a return so that the VM can run it like a function when it gets imported
+func (c *Compiler) CompileModule(path string, dbgMode bool) *ObjModule {
 	source := ReadFile(path) + "\n"
-	return Compile(&source, dbgMode)
 
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	module := NewModule(name, path)
+	module.ParentModule = c.CurrentModule
+
+	if !CompileInto(module, &source, dbgMode) {
+		return nil
+	}
+	return module
 }
 
-func Compile(source *string, dbgMode bool) *ObjModule {
+func Compile(source *string, path string, dbgMode bool) *ObjModule {
 
-	module := ObjModule{
-		ParentModule:  nil,
-		Name:          "",
-		IsUsed:        false,
-		LoadedModules: make([]ObjModule,1024),
-		ModuleCount:   0,
-		ModuleId:      nil,
-		MainFunction:  nil,
+	module := NewModule("main", path)
+	if !CompileInto(module, source, dbgMode) {
+		return nil
+	}
+	if !CheckPropertyReads() {
+		return nil
 	}
 
+	// The VM needs every module that got imported along the way, including
+	// the ones imported by other modules
+	module.LoadedModules = append([]*ObjModule(nil), ModuleTable...)
+	module.ModuleCount = len(module.LoadedModules)
+
+	return module
+}
+
+// Compiles the source into the module's main function
+func CompileInto(module *ObjModule, source *string, dbgMode bool) bool {
+
 	// First parse the source
 	parser := NewParser(source)
 
 	compiler := NewCompiler(&parser)
 	compiler.DebugMode = dbgMode
+	compiler.SourceFile = module.Path
+	compiler.Current.file = module.Path
+	compiler.CurrentModule = module
 	// Global function store
 	RegisterFunctions()
 
-	module.Name = "main"
-
 	compiler.Advance()
 	for !compiler.Match(TOKEN_EOF) {
 		compiler.Evaluate()
 	}
 
+	if module.ParentModule != nil {
+		compiler.EmitOp(OP_NIL)
+		compiler.EmitOp(OP_RETURN)
+	}
+
+	code := compiler.CurrentInstructions().ToChunk()
+	code.File = module.Path
+
 	fn := &ObjFunction{
 		Arity:        0,
-		Code:         compiler.CurrentInstructions().ToChunk(),
+		Code:         code,
 		UpvalueCount: 0,
 		FuncType:     TYPE_SCRIPT,
 		Id:           0,
+		LocalSlots:   int(compiler.Current.LocalSlots),
+		Locals:       compiler.Current.LocalInfo,
+	}
+	if module.ParentModule != nil {
+		fn.Name = module.Name
 	}
 	if compiler.Parser.HadError {
-		return nil
+		return false
 	}
-	compiler.CurrentModule = &module
 	module.MainFunction = fn
-	compiler.Modules[compiler.ModuleCount] = module
-	compiler.CurrentModule.LoadedModules[compiler.CurrentModule.ModuleCount] = module
-	compiler.ModuleCount++
 
 	//compiler.EmitOp(OP_HALT)
 	if dbgMode {
-		fmt.Println("=== Instructions ===")
+		fmt.Printf("=== Instructions (%s) ===\n", module.Name)
 		compiler.CurrentInstructions().Display()
 	}
 
-	return &module
+	return true
 }
 
 /* -------------------------------------------------------
@@ -229,13 +352,7 @@ func NewCompiler(parser *Parser) *Compiler {
 
 func (c *Compiler) Init() {
 
-	c.Modules = make([]ObjModule, 16556)
-
-	curMod := c.Modules[0]
-	curMod.LoadedModules = make([]ObjModule,1024)
-	c.ModuleCount++
-
-	c.CurrentModule = &curMod
+	c.CurrentModule = NewModule("main", "")
 
 	c.Current = &FunctionVar{
 		paramCount: 0,
@@ -311,17 +428,25 @@ func (c *Compiler) Advance() {
 }
 
 func (c *Compiler) ResolveGlobal(tok *Token) (int16, *ExpressionData) {
-	var i int16
 	// Check in the current module
-	for i = 0; i < GlobalCount; i++ {
-		if tok.ToString() == GlobalVars[i].name {
-			return i, &GlobalVars[i].ExprData
-		}
+	if i := FindGlobal(c.CurrentModule, tok.ToString()); i != -1 {
+		return i, &GlobalVars[i].ExprData
 	}
-	c.ErrorAtCurrent(fmt.Sprintf("Global variable '%s' not found", tok.ToString()))
+	c.Error(fmt.Sprintf("Variable '%s' not found", tok.ToString()))
 	return -1, nil
 }
 
+// Every module shares the VM's globals, but a name only resolves against the
+// globals declared by the module it is used in
+func FindGlobal(module *ObjModule, name string) int16 {
+	for i := int16(0); i < GlobalCount; i++ {
+		if GlobalVars[i].Module == module && GlobalVars[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
 func (c *Compiler) ResolveLocal(fn *FunctionVar, name string) (int16, *ExpressionData) {
 	// Work our way backwards from the bottom of the locals store so we can
 	// identify the variable at lowest scope relative to this one
@@ -358,6 +483,13 @@ func (c *Compiler) AddUpvalue(fn *FunctionVar, index int16, isLocal bool) int16
 	fn.Upvalues[upvCount].IsLocal = isLocal
 	fn.Upvalues[upvCount].Index = index
 	fn.Upvalues[upvCount].ExprData = fn.Enclosing.Locals[index].ExprData
+	if isLocal {
+		fn.Upvalues[upvCount].name = fn.Enclosing.Locals[index].name
+		fn.Upvalues[upvCount].Symbol = fn.Enclosing.Locals[index].Symbol
+	} else {
+		fn.Upvalues[upvCount].name = fn.Enclosing.Upvalues[index].name
+		fn.Upvalues[upvCount].Symbol = fn.Enclosing.Upvalues[index].Symbol
+	}
 	fn.UpvalueCount++
 
 	return fn.UpvalueCount - 1
@@ -376,8 +508,14 @@ func (c *Compiler) AddLocal(name string) int16 {
 	c.Current.Locals[c.Current.LocalCount].isCaptured = false
 	c.Current.Locals[c.Current.LocalCount].scopeId = ScopeId
 	c.Current.Locals[c.Current.LocalCount].Module = c.CurrentModule
+	c.Current.Locals[c.Current.LocalCount].Symbol = nil
+	c.Current.Locals[c.Current.LocalCount].Class = nil
+	c.Current.Locals[c.Current.LocalCount].infoIndex = c.AddLocalInfo(name, c.Current.LocalCount)
 
 	c.Current.LocalCount++
+	if c.Current.LocalCount > c.Current.LocalSlots {
+		c.Current.LocalSlots = c.Current.LocalCount
+	}
 	return c.Current.LocalCount - 1
 
 }
@@ -451,7 +589,7 @@ func (c *Compiler) NamedList(tok Token) {
 	idx, _, varscope := c.ResolveVariable(tok)
 
 	// Get the key
-	c.Consume(TOKEN_IDENTIFIER, "Expect key after '$'")
+	c.ConsumeName("Expect key after '$'")
 	key := c.Parser.Previous.ToString()
 
 	kIdx := c.MakeConstant(ObjString(key))
@@ -473,7 +611,8 @@ func (c *Compiler) NamedList(tok Token) {
 		}
 		c.WriteComment(fmt.Sprintf("List name '%s' Index '%s'", tok.ToString(), key))
 	}
-
+	// What a list holds is only known when the program runs
+	PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 }
 
 func (c *Compiler) NamedArray(tok Token) {
@@ -491,6 +630,7 @@ func (c *Compiler) NamedArray(tok Token) {
 	c.Consume(TOKEN_LEFT_BRACKET,"Expect '[' after array name")
 	for {
 		c.Expression()
+		PopExpressionValue()
 		dims++
 		if !c.Match(TOKEN_COMMA) {
 			break
@@ -498,6 +638,17 @@ func (c *Compiler) NamedArray(tok Token) {
 	}
 	c.Consume(TOKEN_RIGHT_BRACKET,"']' must follow array index reference")
 
+	// Indexing a table gets a row
+	if expData.ObjType == VAR_TABLE {
+		if dims != 1 {
+			c.Error("A table row takes a single index")
+		}
+		c.EmitInstr(OP_AINDEX,int16(dims))
+		c.WriteComment(fmt.Sprintf("Getting row of table %s",tok.ToString()))
+		PushExpressionValue(ExpressionData{Value: VAL_LIST, ObjType: VAR_HASH})
+		return
+	}
+
 	if c.Match(TOKEN_EQUAL) {
 		c.Expression()
 		PopExpressionValue()
@@ -510,7 +661,8 @@ func (c *Compiler) NamedArray(tok Token) {
 	} else {
 		c.EmitInstr(OP_AINDEX,int16(dims))
 		c.WriteComment(fmt.Sprintf("Getting array index with %d dimensions",dims))
-		PushExpressionValue(expData)
+		// An index gives one element, of the type the array was declared with
+		PushExpressionValue(ExpressionData{Value: expData.Value, ObjType: VAR_SCALAR})
 	}
 
 }
@@ -538,6 +690,17 @@ func (c *Compiler) ResolveVariable(tok Token) (int16, ExpressionData, VariableSc
 	} else {
 		c.Error("Variable not found")
 	}
+	if expData == nil {
+		return idx, ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}, vScope
+	}
+	switch vScope {
+	case LOCAL:
+		c.ReferenceSymbol(tok, c.Current.Locals[idx].Symbol, *expData)
+	case GLOBAL:
+		c.ReferenceSymbol(tok, GlobalVars[idx].Symbol, *expData)
+	case UPVALUE:
+		c.ReferenceSymbol(tok, c.Current.Upvalues[idx].Symbol, *expData)
+	}
 	return idx, *expData, vScope
 }
 
@@ -547,6 +710,7 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 	// Above all, check to see if this name is a built-in function
 	nativeFunction := ResolveNativeFunction(tok.ToString())
 	if nativeFunction != nil {
+		c.ReferenceNative(tok, nativeFunction)
 		c.CallNative(nativeFunction)
 		return
 	}
@@ -556,6 +720,8 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 	var getOp byte
 	var setOp byte
 	var valType ValueType
+	var returns ValueType
+	var signature *FunctionSignature
 
 	isLocal := false
 	isGlobal := false
@@ -563,6 +729,8 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 
 	isHasOperand := false
 
+	var symbol *Symbol
+
 	//If this is a list
 	if c.Match(TOKEN_DOLLAR) {
 		c.NamedList(tok)
@@ -580,6 +748,7 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 	// -1 means it wasn't found
 	if idx != -1 {
 		isLocal = true
+		symbol = c.Current.Locals[idx].Symbol
 		// If this is an expression of an array element
 		switch idx {
 		case 0:
@@ -602,6 +771,7 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 
 	} else if idx, _ = c.ResolveUpvalue(c.Current, tok.ToString()); idx != -1 {
 		isUpvalue = true
+		symbol = c.Current.Upvalues[idx].Symbol
 		getOp = OP_GET_UPVALUE
 		setOp = OP_SET_UPVALUE
 		isHasOperand = true
@@ -619,6 +789,12 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 			isGlobal = true
 			idx, _ = c.ResolveGlobal(&tok)
 			setOp = OP_SET_GLOBAL
+			if idx == -1 {
+				// Already reported, so carry on with a type we know nothing about
+				PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+				return
+			}
+			symbol = GlobalVars[idx].Symbol
 			if idx != -1 {
 				switch idx {
 				case 0:
@@ -643,6 +819,7 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 
 	if canAssign && c.Match(TOKEN_EQUAL) {
 
+		assignTok := c.Parser.Previous
 		c.Expression()
 		data := PopExpressionValue()
 
@@ -655,35 +832,49 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 			//GlobalVars[idx].datatype = valType
 			//GlobalVars[idx].objtype = objType
 
-			if objType == VAR_CLASS {
-
+			GlobalVars[idx].Class = nil
+			if IsClassType(data) {
 				GlobalVars[idx].Class = CurrentClass
 			}
 
-			if GlobalVars[idx].ExprData.Value != valType || GlobalVars[idx].ExprData.ObjType != objType {
-				gVar := ValueTypeLabel[GlobalVars[idx].ExprData.Value]
-				gObj := VarTypeLabel[ GlobalVars[idx].ExprData.ObjType]
-				errStr := fmt.Sprintf("Variable %s is a %s of type %s: cannot assign a %s of type %s",
-					tok.ToString(),gObj,gVar,VarTypeLabel[objType],ValueTypeLabel[valType])
-				c.Error(errStr)
+			if widen, ok := CheckAssignment(GlobalVars[idx].ExprData, data); !ok {
+				c.TypeError(assignTok, fmt.Sprintf("Variable %s has type %s: cannot assign a value of type %s",
+					tok.ToString(), TypeName(GlobalVars[idx].ExprData), TypeName(data)))
+			} else if widen {
+				c.EmitOp(OP_INT_TO_FLOAT)
+				valType = VAL_FLOAT
+			} else if IsUnknownType(GlobalVars[idx].ExprData) {
+				GlobalVars[idx].ExprData = data
 			}
+			KeepSignature(&GlobalVars[idx].ExprData, data)
 
 		} else if isLocal {
-			if c.Current.Locals[idx].IsInitialized && valType != c.Current.Locals[idx].ExprData.Value {
-				c.Error("Cannot assign incompatible variable")
+			local := &c.Current.Locals[idx]
+			widen, ok := CheckAssignment(local.ExprData, data)
+			if !ok && local.IsInitialized {
+				c.TypeError(assignTok, fmt.Sprintf("Variable %s has type %s: cannot assign a value of type %s",
+					tok.ToString(), TypeName(local.ExprData), TypeName(data)))
+			} else if widen {
+				c.EmitOp(OP_INT_TO_FLOAT)
+				valType = VAL_FLOAT
+			} else {
+				local.ExprData.Value = valType
+				local.ExprData.ObjType = objType
+				local.ExprData.Returns = data.Returns
 			}
-
+			KeepSignature(&local.ExprData, data)
 			c.Current.Locals[idx].IsInitialized = true
-			c.Current.Locals[idx].ExprData.Value = valType
-			c.Current.Locals[idx].ExprData.ObjType = objType
 
-			if objType == VAR_CLASS {
+			c.Current.Locals[idx].Class = nil
+			if IsClassType(data) {
 				c.Current.Locals[idx].Class = CurrentClass
 			}
 
 		} else if isUpvalue {
 			c.Current.Upvalues[idx].ExprData.Value = valType
-			if objType == VAR_CLASS {
+			KeepSignature(&c.Current.Upvalues[idx].ExprData, data)
+			c.Current.Upvalues[idx].Class = nil
+			if IsClassType(data) {
 				c.Current.Upvalues[idx].Class = CurrentClass
 			}
 		}
@@ -698,25 +889,44 @@ func (c *Compiler) NamedVariable(canAssign bool) {
 		if isGlobal {
 			valType = GlobalVars[idx].ExprData.Value
 			objType = GlobalVars[idx].ExprData.ObjType
-			if objType == VAR_CLASS {
+			returns = GlobalVars[idx].ExprData.Returns
+			signature = GlobalVars[idx].ExprData.Signature
+			if IsClassType(GlobalVars[idx].ExprData) {
 				CurrentClass = GlobalVars[idx].Class
 			}
 
 		} else if isLocal {
 			valType = c.Current.Locals[idx].ExprData.Value
 			objType = c.Current.Locals[idx].ExprData.ObjType
-			if objType == VAR_CLASS {
+			returns = c.Current.Locals[idx].ExprData.Returns
+			signature = c.Current.Locals[idx].ExprData.Signature
+			if IsClassType(c.Current.Locals[idx].ExprData) {
 				CurrentClass = c.Current.Locals[idx].Class
 			}
 		} else if isUpvalue {
 			valType = c.Current.Upvalues[idx].ExprData.Value
-			if objType == VAR_CLASS {
+			returns = c.Current.Upvalues[idx].ExprData.Returns
+			signature = c.Current.Upvalues[idx].ExprData.Signature
+			if c.Current.Upvalues[idx].ExprData.ObjType != VAR_UNKNOWN {
+				objType = c.Current.Upvalues[idx].ExprData.ObjType
+			}
+			if objType == VAR_CLASS || objType == VAR_OBJECT {
 				CurrentClass = c.Current.Upvalues[idx].Class
 			}
 		}
 		c.WriteComment(fmt.Sprintf("%s name %s at index %d type %d", OpLabel[getOp], tok.ToString(), idx, valType))
 	}
-	PushExpressionValue(ExpressionData{Value: valType, ObjType: objType})
+	data := ExpressionData{Value: valType, ObjType: objType, Returns: returns, Signature: signature}
+	c.ReferenceSymbol(tok, symbol, data)
+	PushExpressionValue(data)
+}
+
+// A variable only keeps the signature of the function it holds while every
+// function assigned to it is that one. Otherwise calls to it aren't checked
+func KeepSignature(data *ExpressionData, assigned ExpressionData) {
+	if data.Signature != assigned.Signature {
+		data.Signature = nil
+	}
 }
 
 func (c *Compiler) IdentifierConstant() int16 {
@@ -744,11 +954,10 @@ func (c *Compiler) DefineParameter() {
 	c.Consume(TOKEN_IDENTIFIER, "Expect parameter name")
 	// Store the token here
 	tok := c.Parser.Previous
-	var valType ValueType
 
 	c.Consume(TOKEN_COLON, "Expect ':' with type after parameter")
-	valType = c.GetDataType().Value
-	if valType == VAL_NIL {
+	data := c.GetDataType()
+	if data.Value == VAL_NIL {
 		c.ErrorAtCurrent("Invalid data type")
 	}
 	var index int16
@@ -766,7 +975,10 @@ func (c *Compiler) DefineParameter() {
 	}
 
 	index = c.AddLocal(tok.ToString())
-	c.Current.Locals[index].ExprData.Value = valType
+	c.Current.Locals[index].ExprData = data
+	c.Current.params = append(c.Current.params, data)
+	c.Current.Locals[index].Symbol = c.DefineSymbol(tok, SYMBOL_PARAMETER)
+	c.Current.Locals[index].Symbol.SetData(data)
 
 }
 
@@ -826,6 +1038,33 @@ func (c *Compiler) GetDataType() ExpressionData {
 		c.Advance()
 		expd.Value = VAL_ENUM
 		expd.ObjType = VAR_ENUM
+	case c.Check(TOKEN_TABLE):
+		c.Advance()
+		expd.Value = VAL_TABLE
+		expd.ObjType = VAR_TABLE
+	case c.Check(TOKEN_FILE):
+		c.Advance()
+		expd.Value = VAL_FILE
+		expd.ObjType = VAR_FILE
+	case c.Check(TOKEN_CHAN):
+		// A channel is declared with the type of what goes through it
+		c.Advance()
+		elem := c.GetDataType()
+		expd.Value = VAL_CHANNEL
+		expd.ObjType = VAR_CHANNEL
+		expd.Returns = ElementValue(elem)
+	case c.Check(TOKEN_THREAD):
+		c.Advance()
+		expd.Value = VAL_THREAD
+		expd.ObjType = VAR_THREAD
+	case c.Check(TOKEN_CONNECTION):
+		c.Advance()
+		expd.Value = VAL_CONNECTION
+		expd.ObjType = VAR_CONNECTION
+	case c.Check(TOKEN_LISTENER):
+		c.Advance()
+		expd.Value = VAL_LISTENER
+		expd.ObjType = VAR_LISTENER
 	//case c.Check(TOKEN_IDENTIFIER):
 		// This could be a user defined type such as a class
 		//tok := c.Parser.Current
@@ -849,12 +1088,12 @@ func (c *Compiler) _array(canAssign bool) {
 }
 
 func (c *Compiler) AddGlobal(varName string) int16 {
-	for i := int16(0); i < GlobalCount; i++ {
-		if GlobalVars[i].name == varName {
-			c.Error(fmt.Sprintf("%s has already been defined"))
-		}
+	if FindGlobal(c.CurrentModule, varName) != -1 {
+		c.Error(fmt.Sprintf("%s has already been defined", varName))
 	}
 	GlobalVars[GlobalCount].name = varName
+	GlobalVars[GlobalCount].Module = c.CurrentModule
+	GlobalVars[GlobalCount].Symbol = c.Declaring
 	GlobalCount++
 	return GlobalCount - 1
 }
@@ -864,23 +1103,34 @@ func (c *Compiler) MatchTypes( data1 ExpressionData, data2 ExpressionData) bool
 	data2.Value != VAL_NIL
 }
 
-func (c *Compiler) DeclareGlobalVariable(varName string) {
+// Declares a global, giving it the value of the expression after '=' if
+// there is one. A declaration that compiles its own value passes it instead
+func (c *Compiler) DeclareGlobalVariable(varName string, value func()) {
 	index := c.AddGlobal(varName)
-	if c.Match(TOKEN_EQUAL) {
+	if value == nil && c.Match(TOKEN_EQUAL) {
+		value = c.Expression
+	}
+	if value != nil {
 		// This is the value we're going to assign
-		c.Expression()
+		c.FunctionName = varName
+		value()
+		c.FunctionName = ""
 		GlobalVars[index].ExprData = PopExpressionValue()
+		if IsClassType(GlobalVars[index].ExprData) {
+			GlobalVars[index].Class = CurrentClass
+		}
 
 		c.EmitInstr(OP_SET_GLOBAL, index)
 		c.WriteComment(fmt.Sprintf("Setting global variable %s at location %d",varName,index))
 	} else {
 		GlobalVars[index].ExprData = c.GetDataType()
-		GlobalVars[index].Module = c.CurrentModule
 	}
+	GlobalVars[index].Symbol.SetData(GlobalVars[index].ExprData)
 
 }
 
-func (c *Compiler) DeclareLocalVariable(varName string) {
+// The same as DeclareGlobalVariable for a local
+func (c *Compiler) DeclareLocalVariable(varName string, value func()) {
 
 	// Check if this variable was already declared in the current scope
 	for i := c.Current.LocalCount - 1; i >= 0; i-- {
@@ -897,16 +1147,26 @@ func (c *Compiler) DeclareLocalVariable(varName string) {
 	//opcode = OP_SET_LOCAL
 	index := c.AddLocal(varName)
 	c.Current.Locals[index].name = varName
+	c.Current.Locals[index].Symbol = c.Declaring
+	symbol := c.Declaring
 
-	if c.Match(TOKEN_EQUAL) {
+	if value == nil && c.Match(TOKEN_EQUAL) {
+		value = c.Expression
+	}
+	if value != nil {
 		// This is the value we're going to assign
-		c.Expression()
+		c.FunctionName = varName
+		value()
+		c.FunctionName = ""
 		c.Current.Locals[index].ExprData = PopExpressionValue()
-		GlobalVars[index].Module = c.CurrentModule
+		if IsClassType(c.Current.Locals[index].ExprData) {
+			c.Current.Locals[index].Class = CurrentClass
+		}
 		c.EmitInstr(OP_SET_LOCAL, index)
 	} else {
 		c.Current.Locals[index].ExprData = c.GetDataType()
 	}
+	symbol.SetData(c.Current.Locals[index].ExprData)
 }
 
 func (c *Compiler) DeclareVariable() {
@@ -919,14 +1179,17 @@ func (c *Compiler) DeclareVariable() {
 		c.Error(fmt.Sprintf("'%s' is a reserved name", tok.ToString()))
 	}
 
+	c.Declaring = c.DefineSymbol(tok, SYMBOL_VARIABLE)
+
 	//var scope VariableScope
 	if c.ScopeDepth == 0 {
 		//scope = GLOBAL
-		c.DeclareGlobalVariable(tok.ToString())
+		c.DeclareGlobalVariable(tok.ToString(), nil)
 	} else {
 		//scope = LOCAL
-		c.DeclareLocalVariable(tok.ToString())
+		c.DeclareLocalVariable(tok.ToString(), nil)
 	}
+	c.Declaring = nil
 
 }
 
@@ -971,7 +1234,7 @@ If the scanner hands us an error token, we need to actually tell the user.
 That happens here:
 */
 func (c *Compiler) ErrorAtCurrent(message string) {
-	fmt.Printf("Line %d: %s\n", c.Parser.Current.Line, message)
+	c.ErrorAt(&c.Parser.Current, message)
 }
 
 /*
@@ -986,6 +1249,7 @@ func (c *Compiler) ErrorAt(token *Token, message string) {
 	// This tells the app that we're in error mode now,
 	// but we keep evaluating code without actually generating byte code
 	c.Parser.PanicMode = true
+	c.Diagnose(token, message, false)
 
 	fmt.Printf("[line %d] Error", token.Line+1)
 	switch token.Type {
@@ -1050,11 +1314,50 @@ func (c *Compiler) EmitReturn() {
 }
 
 func (c *Compiler) ReturnStatement() {
+	returnTok := c.Parser.Previous
 	if c.Match(TOKEN_CR) {
-		c.EmitReturn()
+		c.EmitOp(OP_NIL)
 	} else {
 		c.Expression()
+		// A function that says what it returns has to return that
+		value := PopExpressionValue()
+		returns := c.Current.returnData
+		if widen, ok := CheckAssignment(returns, value); !ok {
+			c.TypeError(returnTok, fmt.Sprintf("The function returns %s, not %s", TypeName(returns), TypeName(value)))
+		} else if widen {
+			c.EmitOp(OP_INT_TO_FLOAT)
+		}
+	}
+	c.ReturnValue()
+}
+
+// Returns the value on the stack. Inside a try statement the value is held
+// while the finally block runs, and returned from there
+func (c *Compiler) ReturnValue() {
+	if len(c.Current.tries) == 0 {
 		c.EmitOp(OP_RETURN)
+		return
+	}
+	try := c.Current.tries[len(c.Current.tries)-1]
+	c.EmitInstr(OP_SET_LOCAL, try.Value)
+	if try.Handler {
+		c.EmitOp(OP_END_TRY)
+	}
+	c.EmitOp(OP_TRUE)
+	c.EmitInstr(OP_SET_LOCAL, try.Returning)
+	// No error is pending
+	c.EmitOp(OP_NIL)
+	try.Returns = append(try.Returns, c.EmitJump(OP_JUMP))
+	c.WriteComment("Return through the finally block")
+}
+
+// Closes the handlers of the try statements inside the loop that a break or
+// continue jumps out of
+func (c *Compiler) CloseLoopHandlers() {
+	for _, try := range c.Current.tries {
+		if try.Handler && try.LoopPtr >= LoopPtr {
+			c.EmitOp(OP_END_TRY)
+		}
 	}
 }
 
@@ -1067,8 +1370,8 @@ func (c *Compiler) ParsePrecedence(precedence Precedence) {
 	// This is an error in that an expression needs to at least begin
 	// with a prefix rule
 	if prefixRule == nil {
-		fmt.Printf("RULE: %d has no prefix \n", c.Parser.Previous.Type)
-		panic("Expect expression")
+		c.Error("Expect expression")
+		PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 		return
 	}
 
@@ -1100,7 +1403,13 @@ func (c *Compiler) Grouping(canAssign bool) {
 	c.Consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression")
 }
 func (c *Compiler) Call(canAssign bool) {
-	argumentCount := c.GetArguments()
+	callee := PopExpressionValue()
+	var params []ExpressionData
+	if callee.Signature != nil {
+		params = callee.Signature.Params
+	}
+	args := c.GetWidenedArguments(params)
+	argumentCount := int16(len(args))
 
 	switch argumentCount {
 	case 0:
@@ -1110,12 +1419,37 @@ func (c *Compiler) Call(canAssign bool) {
 	case 2:
 		c.EmitOp(OP_CALL_2)
 	case 3:
-		c.EmitOp(OP_CALL_0)
+		c.EmitOp(OP_CALL_3)
 	default:
 		c.EmitInstr(OP_CALL, argumentCount)
 	}
 
 	c.WriteComment(fmt.Sprintf("Function call with %d arguments", argumentCount))
+
+	if !IsUnknownType(callee) && callee.Value != VAL_FUNCTION && (callee.ObjType == VAR_SCALAR || callee.ObjType == VAR_ARRAY || callee.ObjType == VAR_HASH) {
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("Can't call a value of type %s", TypeName(callee)))
+	}
+	if callee.Signature == nil {
+		PushExpressionValue(ExpressionData{Value: callee.Returns, ObjType: VAR_SCALAR})
+		return
+	}
+	c.CheckFunctionArguments(params, args)
+	PushExpressionValue(callee.Signature.Returns)
+}
+
+// Checks the arguments of a call to a function whose declaration the
+// compiler has seen
+func (c *Compiler) CheckFunctionArguments(params []ExpressionData, args []ExpressionData) {
+	if len(args) != len(params) {
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("The function takes %d arguments but got %d", len(params), len(args)))
+		return
+	}
+	for i, arg := range args {
+		if _, ok := CheckAssignment(params[i], arg); !ok {
+			c.TypeError(c.Parser.Previous, fmt.Sprintf("Argument %d of the function must be %s, not %s", i+1,
+				TypeName(params[i]), TypeName(arg)))
+		}
+	}
 }
 
 func (c *Compiler) CallMethod(constantIndex int16) {
@@ -1127,14 +1461,31 @@ func (c *Compiler) CallMethod(constantIndex int16) {
 }
 
 func (c *Compiler) GetArguments() int16 {
-	argCount := int16(0)
+	return int16(len(c.GetArgumentTypes()))
+}
+
+// Compiles the arguments of a call and returns their types
+func (c *Compiler) GetArgumentTypes() []ExpressionData {
+	return c.GetWidenedArguments(nil)
+}
+
+// Compiles the arguments of a call and returns their types. An int passed to
+// one of the parameters that takes a float is made into a float
+func (c *Compiler) GetWidenedArguments(params []ExpressionData) []ExpressionData {
+	var args []ExpressionData
 	if !c.Check(TOKEN_RIGHT_PAREN) {
 		for {
 			c.Expression()
-			if argCount == 255 {
+			arg := PopExpressionValue()
+			if len(args) < len(params) {
+				if widen, _ := CheckAssignment(params[len(args)], arg); widen {
+					c.EmitOp(OP_INT_TO_FLOAT)
+				}
+			}
+			args = append(args, arg)
+			if len(args) == 256 {
 				c.Error("Cannot have more than 255 arguments.")
 			}
-			argCount++
 
 			if !c.Match(TOKEN_COMMA) {
 				break
@@ -1143,15 +1494,18 @@ func (c *Compiler) GetArguments() int16 {
 	}
 
 	c.Consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
-	return argCount
+	return args
 }
 
 func (c *Compiler) Dollar(canAssign bool) {
-	c.Consume(TOKEN_IDENTIFIER,"Expect key name after '$'")
+	c.ConsumeName("Expect key name after '$'")
 	keyVal := c.Parser.Previous.ToString()
 	idx := c.MakeConstant(ObjString(keyVal))
 	c.EmitInstr(OP_HKEY,idx)
 	c.WriteComment(fmt.Sprintf("Getting list value key %s",keyVal))
+	// The list's type goes and what it holds under the key could be anything
+	PopExpressionValue()
+	PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 }
 
 func (c *Compiler) New(canAssign bool) {
@@ -1168,13 +1522,11 @@ func (c *Compiler) New(canAssign bool) {
 		// Defer to the new list expression
 		c.NewList(canAssign)
 		valType = VAL_LIST
+	case c.Match(TOKEN_CHAN):
+		c.NewChannel()
+		return
 	default:
-		c.Expression()
-		c.EmitOp(OP_OBJ_INSTANCE)
-		PushExpressionValue(ExpressionData{
-			Value: VAL_OBJECT,
-			ObjType: VAR_OBJECT,
-		})
+		c.NewObject()
 		return
 	}
 	// Loop in order to handle multi-dimensional arrays
@@ -1198,6 +1550,44 @@ func (c *Compiler) New(canAssign bool) {
 
 }
 
+// new chan int makes a channel that hands over one value at a time and
+// new chan int(10) one that holds up to 10 values before a send has to wait
+func (c *Compiler) NewChannel() {
+	elem := c.GetDataType()
+	if elem.ObjType == VAR_UNKNOWN {
+		c.ErrorAtCurrent("Expect the type of the values that go through the channel after 'chan'")
+	}
+	if c.Match(TOKEN_LEFT_PAREN) {
+		c.Expression()
+		if size := PopExpressionValue(); !IsUnknownType(size) && (size.Value != VAL_INTEGER || !IsScalarType(size)) {
+			c.TypeError(c.Parser.Previous, fmt.Sprintf("The buffer of a channel must be an int, not %s", TypeName(size)))
+		}
+		c.Consume(TOKEN_RIGHT_PAREN, "Expect ')' after the buffer size of the channel")
+	} else {
+		c.EmitOp(OP_PUSH_0)
+	}
+	c.EmitInstr(OP_MAKE_CHANNEL, int16(ElementValue(elem)))
+	PushExpressionValue(ExpressionData{Value: VAL_CHANNEL, ObjType: VAR_CHANNEL, Returns: ElementValue(elem)})
+}
+
+// spawn f(args) calls a function on a thread of its own. What's left on the
+// stack is the thread, whose wait() gives back what the function returned
+func (c *Compiler) Spawn(canAssign bool) {
+	spawnTok := c.Parser.Previous
+	c.ParsePrecedence(PREC_PRIMARY)
+	callee := PopExpressionValue()
+	if !IsUnknownType(callee) && callee.ObjType != VAR_FUNCTION {
+		c.TypeError(spawnTok, fmt.Sprintf("Can't spawn a value of type %s", TypeName(callee)))
+	}
+
+	c.Consume(TOKEN_LEFT_PAREN, "Expect '(' after the function to spawn")
+	argumentCount := c.GetArguments()
+	c.EmitInstr(OP_SPAWN, argumentCount)
+	c.WriteComment(fmt.Sprintf("Spawn a thread with %d arguments", argumentCount))
+
+	PushExpressionValue(ExpressionData{Value: VAL_THREAD, ObjType: VAR_THREAD, Returns: callee.Returns})
+}
+
 func (c *Compiler) Postary(canAssign bool) {
 	operatorType := c.Parser.Previous.Type
 	// Emit the operator instruction.
@@ -1210,123 +1600,72 @@ func (c *Compiler) Postary(canAssign bool) {
 }
 
 func (c *Compiler) Unary(canAssign bool) {
-	operatorType := c.Parser.Previous.Type
+	operator := c.Parser.Previous
+	operatorType := operator.Type
 
 	// Compile the operand.
 	c.ParsePrecedence(PREC_UNARY)
 
-	valtype := c.GetDataType().Value
+	data := PopExpressionValue()
 	// Emit the operator instruction.
 	switch operatorType {
 	case TOKEN_BANG:
+		if !IsUnknownType(data) && (data.Value != VAL_BOOL || !IsScalarType(data)) {
+			c.TypeError(operator, fmt.Sprintf("Operator '!' can't be applied to %s", TypeName(data)))
+		}
 		c.EmitOp(OP_NOT)
+		data = scalarBool
 	case TOKEN_MINUS:
-		switch valtype {
-		case VAL_INTEGER:
-			c.EmitOp(OP_INEGATE)
-		case VAL_FLOAT:
+		switch {
+		case IsNumericType(data) && data.Value == VAL_FLOAT:
 			c.EmitOp(OP_FNEGATE)
+		case IsNumericType(data), IsUnknownType(data):
+			c.EmitOp(OP_INEGATE)
+		default:
+			c.TypeError(operator, fmt.Sprintf("Operator '-' can't be applied to %s", TypeName(data)))
 		}
 
 	case TOKEN_PLUS_PLUS:
+		if !IsUnknownType(data) && (data.Value != VAL_INTEGER || !IsScalarType(data)) {
+			c.TypeError(operator, fmt.Sprintf("Operator '++' can't be applied to %s", TypeName(data)))
+		}
 		c.EmitOp(OP_PREINCREMENT)
 	case TOKEN_MINUS_MINUS:
 		c.EmitOp(OP_PREDECREMENT)
 	}
+	PushExpressionValue(data)
 }
 
 func (c *Compiler) Binary(canAssign bool) {
 	// This the operator that made us call this
 	// function in the first place
-	operatorType := c.Parser.Previous.Type
+	operator := c.Parser.Previous
 
 	// Compile the right operand
-	rule := c.GetRule(operatorType)
+	rule := c.GetRule(operator.Type)
 	rprec := rule.Prec + 1
 	c.ParsePrecedence(rprec)
 
-	data := PopExpressionValue()
+	right := PopExpressionValue()
+	left := PopExpressionValue()
 
-	switch operatorType {
-	case TOKEN_BANG_EQUAL:
-		c.EmitOp(OP_NOT_EQUAL)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_EQUAL_EQUAL:
-		c.EmitOp(OP_EQUAL)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_GREATER:
-		c.EmitOp(OP_GREATER)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_GREATER_EQUAL:
-		c.EmitOp(OP_GREATER_EQUAL)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_LESS:
-		c.EmitOp(OP_LESS)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_LESS_EQUAL:
-		c.EmitOp(OP_LESS_EQUAL)
-		PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: data.ObjType})
-	case TOKEN_PLUS:
-		switch data.Value {
-		case VAL_INTEGER:
-			c.EmitOp(OP_IADD)
-			PushExpressionValue(data)
-		case VAL_FLOAT:
-			c.EmitOp(OP_FADD)
-			PushExpressionValue(data)
-		case VAL_STRING:
-			c.EmitOp(OP_SADD)
-			PushExpressionValue(data)
-		}
-	case TOKEN_MINUS:
-		if data.Value == VAL_INTEGER {
-			c.EmitOp(OP_ISUBTRACT)
-			PushExpressionValue(data)
-		} else if data.Value == VAL_FLOAT {
-			c.EmitOp(OP_FSUBTRACT)
-			PushExpressionValue(data)
-		}
-	case TOKEN_STAR:
-		if data.Value == VAL_INTEGER {
-			c.EmitOp(OP_IMULTIPLY)
-			PushExpressionValue(data)
-		} else if data.Value == VAL_FLOAT {
-			c.EmitOp(OP_FMULTIPLY)
-			PushExpressionValue(data)
-		} else {
-			//c.EmitOp(OP_IMULTIPLY)
-			//PushExpressionValue(data)
-			//fmt.Println("Error finding property type")
-			c.Error(fmt.Sprintf("Can't multiply! Type: %v", data.Value))
-		}
-	case TOKEN_SLASH:
-		if data.Value == VAL_INTEGER {
-			c.EmitOp(OP_IDIVIDE)
-			PushExpressionValue(data)
-		} else if data.Value == VAL_FLOAT {
-			c.EmitOp(OP_FDIVIDE)
-			PushExpressionValue(data)
-		}
-	case TOKEN_PLUS_PLUS:
-		c.EmitOp(OP_INCREMENT)
-		PushExpressionValue(data)
-	case TOKEN_HAT:
-		if data.Value == VAL_INTEGER {
-			c.EmitOp(OP_IEXP)
-			PushExpressionValue(data)
-		} else {
-			c.Error("Exponents can only be defined on integers")
-		}
-	case TOKEN_TO:
-		if data.Value == VAL_INTEGER {
-			c.EmitOp(OP_IRANGE)
-			PushExpressionValue(data)
-		} else {
-			c.Error("Exponents can only be defined on integers")
-		}
-	default:
+	check, err := CheckBinary(operator, left, right)
+	if err != nil {
+		c.TypeError(operator, err.Error())
+		// Carry on with something sensible so that errors in the rest of
+		// the expression still get reported
+		PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 		return
 	}
+
+	if check.WidenLeft {
+		c.EmitOp(OP_INT_TO_FLOAT_LEFT)
+	}
+	if check.WidenRight {
+		c.EmitOp(OP_INT_TO_FLOAT)
+	}
+	c.EmitOp(check.OpCode)
+	PushExpressionValue(check.Result)
 }
 
 func (c *Compiler) FindPropertyType(class *ClassVar, propertyName string) ExpressionData {
@@ -1335,7 +1674,7 @@ func (c *Compiler) FindPropertyType(class *ClassVar, propertyName string) Expres
 			return class.Properties[i].ExprData
 		}
 	}
-	return ExpressionData{VAL_NIL, VAR_UNKNOWN, 0}
+	return ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
 }
 
 func (c *Compiler) NewList(canAssign bool) {
@@ -1351,7 +1690,7 @@ func (c *Compiler) NewList(canAssign bool) {
 		c.EmitPushInteger(int16(ValueType(keyType.Value)))
 
 		c.EmitOp(OP_MAKE_LIST)
-		PushExpressionValue(ExpressionData{keyType.Value, valType.ObjType ,1})
+		PushExpressionValue(ExpressionData{Value: keyType.Value, ObjType: valType.ObjType, Dimensions: 1})
 	}
 	// Left side, do nothing
 
@@ -1404,6 +1743,7 @@ func (c *Compiler) List(canAssign bool) {
 
 func (c *Compiler) Enum(canAssign bool) {
 	elements := uint8(0)
+	c.DeclaredSymbol(SYMBOL_ENUM)
 	c.Consume(TOKEN_LEFT_BRACE, "Expect '{' after 'enum'")
 
 	for {
@@ -1516,6 +1856,7 @@ func (c *Compiler) CompoundVariable(tok *Token) *ExpressionData {
 
 	if name == "this" {
 		c.EmitOp(OP_GET_LOCAL_0)
+		CurrentClass = c.InClass
 		return &ExpressionData{
 			Value:   VAL_OBJECT,
 			ObjType: VAR_OBJECT,
@@ -1526,11 +1867,13 @@ func (c *Compiler) CompoundVariable(tok *Token) *ExpressionData {
 
 	// It's a local
 	if idx != -1 {
+		c.ReferenceSymbol(*tok, c.Current.Locals[idx].Symbol, *expData)
 		switch expData.ObjType {
 		// Is it a class?
 		case VAR_OBJECT:
 			// Then treat this as a Class
 			c.EmitInstr(OP_GET_LOCAL, idx)
+			CurrentClass = c.Current.Locals[idx].Class
 			return &ExpressionData{
 				Value:   VAL_OBJECT,
 				ObjType: VAR_OBJECT,
@@ -1541,17 +1884,41 @@ func (c *Compiler) CompoundVariable(tok *Token) *ExpressionData {
 				Value:   VAL_ENUM,
 				ObjType: VAR_ENUM,
 			}
+		case VAR_TABLE, VAR_FILE, VAR_CHANNEL, VAR_THREAD, VAR_CONNECTION, VAR_LISTENER:
+			c.EmitInstr(OP_GET_LOCAL, idx)
+			return &ExpressionData{
+				Value:   expData.Value,
+				ObjType: expData.ObjType,
+				Returns: expData.Returns,
+			}
 		}
 
 	}
 
+	// It's a variable of an enclosing function, such as a channel a closure
+	// sends on
+	idx, expData = c.ResolveUpvalue(c.Current, name)
+	if idx != -1 {
+		switch expData.ObjType {
+		case VAR_TABLE, VAR_FILE, VAR_CHANNEL, VAR_THREAD, VAR_CONNECTION, VAR_LISTENER:
+			c.EmitInstr(OP_GET_UPVALUE, idx)
+			return &ExpressionData{
+				Value:   expData.Value,
+				ObjType: expData.ObjType,
+				Returns: expData.Returns,
+			}
+		}
+	}
+
 	// It's a global
 	idx, expData = c.ResolveGlobal(tok)
 	if idx != -1 {
+		c.ReferenceSymbol(*tok, GlobalVars[idx].Symbol, *expData)
 		switch expData.ObjType {
 		case VAR_OBJECT:
 			// Treat this as a Class
 			c.EmitInstr(OP_GET_GLOBAL, idx)
+			CurrentClass = GlobalVars[idx].Class
 			return &ExpressionData{
 				Value:   VAL_OBJECT,
 				ObjType: VAR_OBJECT,
@@ -1562,10 +1929,17 @@ func (c *Compiler) CompoundVariable(tok *Token) *ExpressionData {
 				Value:   VAL_ENUM,
 				ObjType: VAR_ENUM,
 			}
+		case VAR_TABLE, VAR_FILE, VAR_CHANNEL, VAR_THREAD, VAR_CONNECTION, VAR_LISTENER:
+			c.EmitInstr(OP_GET_GLOBAL, idx)
+			return &ExpressionData{
+				Value:   expData.Value,
+				ObjType: expData.ObjType,
+				Returns: expData.Returns,
+			}
 		}
 		fmt.Printf("%s Class type: %s\n", name, VarTypeLabel[expData.ObjType])
 	}
-	fmt.Printf("Compound variable '%s' not found\n", name)
+	c.Error(fmt.Sprintf("Compound variable '%s' not found", name))
 	return nil
 }
 
@@ -1577,11 +1951,28 @@ func (c *Compiler) Variable(canAssign bool) {
 
 	var foundCompoundObject bool
 
+	// A name qualified by the alias of an import is one of that module's globals
+	if module := c.ResolveImport(*tok); module != nil {
+		c.ModuleVariable(module, canAssign)
+		return
+	}
+	if c.ResolveNativeModule(*tok) {
+		c.NativeModuleCall(*tok)
+		return
+	}
+
 	// In the first pass, we check to see if it's a compound variable
 	for c.Check(TOKEN_DOT) {
 		foundCompoundObject = true
+		// tok points at the parser's previous token, so this has to be
+		// looked at before the parser moves on to the name after the dot
+		isThis := tok.ToString() == "this"
 		// It is and so now we check to see what kind it is
 		expData = c.CompoundVariable(tok)
+		if expData == nil {
+			PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+			return
+		}
 		// Now we get the property
 		c.Consume(TOKEN_DOT, "Expect '.' after object name")
 		c.Consume(TOKEN_IDENTIFIER, "Expect name after '.'")
@@ -1591,28 +1982,55 @@ func (c *Compiler) Variable(canAssign bool) {
 
 		switch expData.ObjType {
 		case VAR_OBJECT:
+			class := CurrentClass
+			propTok := *tok
+			c.ReferenceProperty(*tok, isThis)
+			// The type of a property is only known when the class is
+			propData := ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+			if class != nil {
+				if prop := class.FindProperty(propTok.ToString()); prop != nil {
+					c.CheckAccess(propTok, prop, isThis)
+					if !prop.IsMethod {
+						propData = prop.ExprData
+					}
+				}
+			}
 
 			if c.Match(TOKEN_LEFT_PAREN) {
 				// This is a method
 				args := c.GetArguments()
 				c.EmitInstr(OP_CALL_METHOD, idx)
 				c.EmitOperand(args)
+				PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 			} else {
 
-				// It's a class, so let's manage that
 				if c.Match(TOKEN_EQUAL) {
+					equalTok := c.Parser.Previous
+					AssignedProperties[AssignedKey(class, propTok.ToString())] = true
 					c.Expression()
+					value := PopExpressionValue()
+					if widen, ok := CheckAssignment(propData, value); !ok {
+						c.TypeError(equalTok, fmt.Sprintf("Property %s has type %s: cannot assign a value of type %s",
+							propTok.ToString(), TypeName(propData), TypeName(value)))
+					} else if widen {
+						c.EmitOp(OP_INT_TO_FLOAT)
+					}
 					c.EmitInstr(OP_SET_PROPERTY, idx)
 				} else {
 					c.EmitInstr(OP_GET_PROPERTY, idx)
+					c.PropertyRead(propTok, class)
+					PushExpressionValue(propData)
 				}
 			}
 		case VAR_ENUM:
 			c.EmitInstr(OP_ENUM_TAG, idx)
-			PushExpressionValue(ExpressionData{VAL_ENUM,VAR_ENUM,1})
+			PushExpressionValue(ExpressionData{Value: VAL_ENUM, ObjType: VAR_ENUM, Dimensions: 1})
+		case VAR_TABLE, VAR_FILE, VAR_CHANNEL, VAR_THREAD, VAR_CONNECTION, VAR_LISTENER:
+			c.BuiltinMember(*expData, *tok, idx)
 		default:
 			// Uh oh ..
 			c.Error(fmt.Sprintf("Compound variable %s of type %s should not have a dot after it", tok.ToString(), VarTypeLabel[expData.ObjType]))
+			PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 		}
 	}
 
@@ -1628,6 +2046,64 @@ func (c *Compiler) Variable(canAssign bool) {
 
 }
 
+type BuiltinMethod struct {
+	Arity   int16 // -1 for any number of arguments
+	Returns ExpressionData
+}
+
+// A property or method of one of the types built into the VM, such as a
+// table or a file. Both are fixed, so their types are known
+func (c *Compiler) BuiltinMember(receiver ExpressionData, tok Token, idx int16) {
+	var methods map[string]BuiltinMethod
+	var properties map[string]ExpressionData
+	switch receiver.ObjType {
+	case VAR_TABLE:
+		methods, properties = TableMethods, TableProperties
+	case VAR_FILE:
+		methods, properties = FileMethods, FileProperties
+	case VAR_CHANNEL:
+		methods, properties = ChannelMethods(receiver.Returns), ChannelProperties
+	case VAR_THREAD:
+		methods, properties = ThreadMethods(receiver.Returns), ThreadProperties
+	case VAR_CONNECTION:
+		methods, properties = ConnectionMethods, ConnectionProperties
+	case VAR_LISTENER:
+		methods, properties = ListenerMethods, ListenerProperties
+	}
+	kind := VarTypeLabel[receiver.ObjType]
+
+	name := tok.ToString()
+	if c.Match(TOKEN_LEFT_PAREN) {
+		method, ok := methods[name]
+		args := c.GetArgumentTypes()
+		if !ok {
+			c.Error(fmt.Sprintf("%ss have no method named '%s'", kind, name))
+		} else if method.Arity >= 0 && len(args) != int(method.Arity) {
+			c.Error(fmt.Sprintf("%s method '%s' takes %d arguments but got %d", kind, name, method.Arity, len(args)))
+		} else if receiver.ObjType == VAR_CHANNEL && name == "send" {
+			// Only values of the channel's type go through it
+			elem := ElementData(receiver.Returns)
+			if _, ok := CheckAssignment(elem, args[0]); !ok {
+				c.TypeError(tok, fmt.Sprintf("Can't send %s on a channel of %s", TypeName(args[0]), TypeName(elem)))
+			}
+		}
+		c.EmitInstr(OP_CALL_METHOD, idx)
+		c.EmitOperand(int16(len(args)))
+		PushExpressionValue(method.Returns)
+		return
+	}
+
+	prop, ok := properties[name]
+	if !ok {
+		c.Error(fmt.Sprintf("%ss have no property named '%s'", kind, name))
+	}
+	if c.Check(TOKEN_EQUAL) {
+		c.Error(fmt.Sprintf("%s property '%s' can't be assigned to", kind, name))
+	}
+	c.EmitInstr(OP_GET_PROPERTY, idx)
+	PushExpressionValue(prop)
+}
+
 func (c *Compiler) String(canAssign bool) {
 	value := c.Parser.Previous.ToString()
 	// Remove the quotes
@@ -1657,15 +2133,18 @@ func (c *Compiler) Float(canAssign bool) {
 }
 func (c *Compiler) Browse(canAssign bool) {}
 func (c *Compiler) and_(canAssign bool) {
+	operator := c.Parser.Previous
 	endJump := c.EmitJump(OP_JUMP_IF_FALSE)
 
 	c.EmitOp(OP_POP)
 	c.ParsePrecedence(PREC_AND)
 
 	c.PatchJump(endJump)
+	c.CheckLogical(operator)
 }
 
 func (c *Compiler) or_(canAssign bool) {
+	operator := c.Parser.Previous
 	elseJump := c.EmitJump(OP_JUMP_IF_FALSE)
 	endJump := c.EmitJump(OP_JUMP)
 
@@ -1674,10 +2153,26 @@ func (c *Compiler) or_(canAssign bool) {
 
 	c.ParsePrecedence(PREC_OR)
 	c.PatchJump(endJump)
+	c.CheckLogical(operator)
+}
+
+// Both sides of 'and' and 'or' have to be booleans
+func (c *Compiler) CheckLogical(operator Token) {
+	right := PopExpressionValue()
+	left := PopExpressionValue()
+	for _, data := range []ExpressionData{left, right} {
+		if !IsUnknownType(data) && (data.Value != VAL_BOOL || !IsScalarType(data)) {
+			c.TypeError(operator, fmt.Sprintf("Operator '%s' can't be applied to %s", operator.ToString(), TypeName(data)))
+			break
+		}
+	}
+	PushExpressionValue(scalarBool)
 }
 
 func (c *Compiler) Literal(canAssign bool) {
-	fmt.Println("LITERAL")
+	// nil can stand in for a value of any type
+	c.EmitOp(OP_NIL)
+	PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
 }
 func (c *Compiler) Boolean(canAssign bool) {
 	value := strings.ToUpper(c.Parser.Previous.ToString())
@@ -1690,6 +2185,17 @@ func (c *Compiler) Boolean(canAssign bool) {
 }
 func (c *Compiler) SqlSelect(canAssign bool) {
 	c.SelectStatement()
+	PushExpressionValue(ExpressionData{Value: VAL_TABLE, ObjType: VAR_TABLE})
+}
+
+func (c *Compiler) SqlUpdate(canAssign bool) {
+	c.UpdateStatement()
+	PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR})
+}
+
+func (c *Compiler) SqlDelete(canAssign bool) {
+	c.DeleteStatement()
+	PushExpressionValue(ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR})
 }
 
 func (c *Compiler) Expression() {
@@ -1703,11 +2209,36 @@ func (c *Compiler) ExpressionStatement() {
 	//c.Consume(TOKEN_CR, "Expect 'CR' after expression.")
 	//c.EmitOp(OP_POP)
 	//c.WriteComment("Pop After expression statement")
+
+	// Inside a block nothing displays what a call gives back, and leaving it
+	// on the stack would fill the stack up in a loop
+	if c.ScopeDepth > 0 && c.LeavesResult() {
+		c.EmitOp(OP_POP)
+		c.WriteComment("Pop the unused result of a call")
+	}
 	if c.Match(TOKEN_CR) {
 
 	}
 }
 
+// Whether the last instruction is a call that leaves what it gives back on
+// the stack
+func (c *Compiler) LeavesResult() bool {
+	instr := c.CurrentInstructions()
+	if instr.Count == 0 {
+		return false
+	}
+	last := instr.OpCode[instr.Count-1]
+	switch last.OpCode {
+	case OP_CALL, OP_CALL_0, OP_CALL_1, OP_CALL_2, OP_CALL_3, OP_CALL_METHOD:
+		return true
+	case OP_CALL_NATIVE:
+		native, ok := instr.Constants[BytesToInt16(last.Operand[:2])].(*ObjNative)
+		return ok && native.hasReturn
+	}
+	return false
+}
+
 func (c *Compiler) Block() {
 	for !c.Check(TOKEN_RIGHT_BRACE) && !c.Check(TOKEN_EOF) {
 		c.Statement()
@@ -1715,6 +2246,18 @@ func (c *Compiler) Block() {
 	c.Consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
 }
 
+// Records a local for the debugger. It comes into scope with the next
+// instruction
+func (c *Compiler) AddLocalInfo(name string, slot int16) int {
+	c.Current.LocalInfo = append(c.Current.LocalInfo, LocalInfo{
+		Name:  name,
+		Slot:  int(slot),
+		Start: c.CurrentInstructions().BytePosition,
+		End:   -1,
+	})
+	return len(c.Current.LocalInfo) - 1
+}
+
 func (c *Compiler) BeginScope() {
 	ScopeId++
 	c.ScopeDepth++
@@ -1723,14 +2266,15 @@ func (c *Compiler) BeginScope() {
 func (c *Compiler) EndScope() {
 	c.ScopeDepth--
 
+	// Locals live in the slots reserved at the bottom of the frame rather than
+	// on the value stack, so there is nothing to pop when they go out of scope
 	for c.Current.LocalCount > 0 &&
 		c.Current.Locals[c.Current.LocalCount-1].depth > c.ScopeDepth {
 		if c.Current.Locals[c.Current.LocalCount-1].isCaptured {
 			c.EmitOp(OP_CLOSE_UPVALUE)
-		} else {
-			c.EmitOp(OP_POP)
-			c.WriteComment("POP after end of scope")
 		}
+		info := c.Current.Locals[c.Current.LocalCount-1].infoIndex
+		c.Current.LocalInfo[info].End = c.CurrentInstructions().BytePosition
 		c.Current.LocalCount--
 	}
 }
@@ -1766,6 +2310,11 @@ func (c *Compiler) PatchBreaks() {
 }
 
 func (c *Compiler) BreakStatement() {
+	if LoopPtr > 0 && PeekLoop() == LOOP_PFOR {
+		c.Error("A pfor loop can't be stopped with break")
+		return
+	}
+	c.CloseLoopHandlers()
 	if PeekLoop() == LOOP_WHILE {
 		Breaks[BreakPtr].StartLoc = c.EmitJump(OP_JUMP)
 		Breaks[BreakPtr].CanPatch = true
@@ -1776,6 +2325,14 @@ func (c *Compiler) BreakStatement() {
 }
 
 func (c *Compiler) ContinueStatement() {
+	// The body of a pfor is a function, so going on to the next value is
+	// returning from it
+	if LoopPtr > 0 && PeekLoop() == LOOP_PFOR {
+		c.EmitOp(OP_NIL)
+		c.ReturnValue()
+		return
+	}
+	c.CloseLoopHandlers()
 	if PeekLoop() == LOOP_WHILE {
 		curLoc := c.CurrentInstructions().NextBytePosition() //+ 3
 		start := StartLoop[StartPtr]
@@ -1811,13 +2368,28 @@ func (c *Compiler) EmitLoop(offset int) {
 
 func (c *Compiler) ScanStatement() {
 	c.BeginScope()
-	c.Expression() // Array
+	c.Expression() // Array or table
+	collection := PopExpressionValue()
 
 	// Manages the target variable
 	c.Consume(TOKEN_TO, "Expect 'to' after the object declaration")
 	c.Consume(TOKEN_IDENTIFIER, "Expect variable name after 'to'")
 
 	idx := c.AddLocal(c.Parser.Previous.ToString())
+	// Each row of a table comes as a list, each line of a file as a string,
+	// each value sent on a channel as the channel's type and each element of
+	// an array as a scalar
+	switch collection.ObjType {
+	case VAR_TABLE:
+		c.Current.Locals[idx].ExprData = ExpressionData{Value: VAL_LIST, ObjType: VAR_HASH}
+	case VAR_FILE, VAR_CONNECTION:
+		c.Current.Locals[idx].ExprData = scalarString
+	case VAR_CHANNEL:
+		c.Current.Locals[idx].ExprData = ElementData(collection.Returns)
+	default:
+		c.Current.Locals[idx].ExprData = ExpressionData{Value: collection.Value, ObjType: VAR_SCALAR}
+	}
+	c.Current.Locals[idx].IsInitialized = true
 	c.EmitInstr(OP_PUSH, idx)
 	c.WriteComment(fmt.Sprintf("Push variable index %d", idx))
 
@@ -1875,6 +2447,8 @@ func (c *Compiler) ForStatement() {
 	// Here is where we assign a variable name to the register
 	ridInit := c.GetFreeRegister()
 	namedRegisters[varName] = ridInit
+	info := c.AddLocalInfo(varName, ridInit)
+	c.Current.LocalInfo[info].Register = true
 
 	c.EmitInstr(OP_PUSH, ridInit)
 	c.WriteComment(fmt.Sprintf("Index for register %d", ridInit))
@@ -1892,6 +2466,7 @@ func (c *Compiler) ForStatement() {
 	c.CurrentInstructions().OpCode[currInstr].Operand = Int16ToBytes(int16(end - start))
 
 	// Free the register for future use
+	c.Current.LocalInfo[info].End = end
 	c.FreeRegister(ridInit)
 	delete(namedRegisters, varName)
 
@@ -1899,6 +2474,45 @@ func (c *Compiler) ForStatement() {
 	PopLoop()
 }
 
+// pfor i = a to b { } runs the body once for each value of i from a to b,
+// spread over a worker for each processor, in no particular order. The body
+// is compiled as a function of i so each worker can call it on a VM of its
+// own, which gives it copies of the variables around it
+func (c *Compiler) PforStatement() {
+	c.Consume(TOKEN_IDENTIFIER, "Expect variable name after 'pfor'")
+	varTok := c.Parser.Previous
+	c.Consume(TOKEN_EQUAL, "Expect '=' after the variable of pfor")
+	c.Expression()
+	c.CheckPforBound(PopExpressionValue())
+	c.Consume(TOKEN_TO, "'to' is required after variable assignment")
+	c.Expression()
+	c.CheckPforBound(PopExpressionValue())
+
+	symbol := c.BeginFunction(TYPE_FUNCTION)
+	idx := c.AddLocal(varTok.ToString())
+	c.Current.Locals[idx].IsInitialized = true
+	c.Current.Locals[idx].ExprData = scalarInteger
+	c.Current.Locals[idx].Symbol = c.DefineSymbol(varTok, SYMBOL_PARAMETER)
+	c.Current.Locals[idx].Symbol.SetData(scalarInteger)
+	c.Current.paramCount++
+
+	PushLoop(LOOP_PFOR)
+	c.Consume(TOKEN_LEFT_BRACE, "Expect '{' before the body of pfor")
+	c.Block()
+	PopLoop()
+	c.EndFunction(TYPE_FUNCTION, symbol)
+	PopExpressionValue()
+
+	c.EmitOp(OP_PFOR)
+	c.WriteComment(fmt.Sprintf("Parallel loop over %s", varTok.ToString()))
+}
+
+func (c *Compiler) CheckPforBound(bound ExpressionData) {
+	if !IsUnknownType(bound) && (bound.Value != VAL_INTEGER || !IsScalarType(bound)) {
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("The bounds of pfor must be ints, not %s", TypeName(bound)))
+	}
+}
+
 func (c *Compiler) WhileStatement() {
 
 	PushLoop(LOOP_WHILE)
@@ -2050,15 +2664,245 @@ func (c *Compiler) CaseStatement() {
 	c.EmitOp(OP_POP)
 }
 
-func (c *Compiler) AddProperty(class *ClassVar, name string) {
+/*
+try { } catch e { } finally { }
 
-	prop := &class.Properties[class.PropertyCount]
+Errors raised inside the try block land in the catch block with the error
+object on the stack. Both paths end up in the finally block with either nil
+or the error that is still pending. If an error is pending once the finally
+block has run, it gets thrown again to whichever handler sits above this one
+*/
+// select waits on several channels at once and runs the block of the first
+// case that can go ahead, or the default block if none can straight away:
+//
+//	select {
+//	    receive jobs to job { ... }
+//	    send total to results { ... }
+//	    default { ... }
+//	}
+//
+// Each case leaves its channel, and the value it sends, on the stack and its
+// block gets jumped over. OP_SELECT comes after all of them and jumps back to
+// the block of the case that went ahead
+func (c *Compiler) ChannelSelect() {
+	c.Consume(TOKEN_LEFT_BRACE, "Expect '{' after 'select'")
+	c.ClearCR()
+
+	var kinds []int16
+	var blocks []int
+	var endJumps []int
+	hasDefault := false
 
-	prop.Name = name
-	//prop.ObjType = expData.ObjType
-	//prop.DataType = expData.Value
+	for !c.Check(TOKEN_RIGHT_BRACE) && !c.Check(TOKEN_EOF) {
+		c.BeginScope()
+		var received *ExpressionData
+		var name string
+
+		switch {
+		case c.Match(TOKEN_DEFAULT):
+			if hasDefault {
+				c.Error("A select can only have one default case")
+			}
+			hasDefault = true
+			kinds = append(kinds, SELECT_DEFAULT)
+		case c.MatchWord("receive"):
+			ch := c.SelectChannel()
+			elem := ElementData(ch.Returns)
+			received = &elem
+			if c.Match(TOKEN_TO) {
+				c.Consume(TOKEN_IDENTIFIER, "Expect variable name after 'to'")
+				name = c.Parser.Previous.ToString()
+			}
+			kinds = append(kinds, SELECT_RECEIVE)
+		case c.MatchWord("send"):
+			c.Expression()
+			val := PopExpressionValue()
+			c.Consume(TOKEN_TO, "Expect 'to' after the value to send")
+			ch := c.SelectChannel()
+			if _, ok := CheckAssignment(ElementData(ch.Returns), val); !ok && ch.ObjType == VAR_CHANNEL {
+				c.TypeError(c.Parser.Previous, fmt.Sprintf("Can't send %s on a channel of %s", TypeName(val), TypeName(ElementData(ch.Returns))))
+			}
+			kinds = append(kinds, SELECT_SEND)
+		default:
+			c.ErrorAtCurrent("Expect 'receive', 'send' or 'default' for a case of select")
+			c.EndScope()
+			return
+		}
+
+		skip := c.EmitJump(OP_JUMP)
+		c.WriteComment("Skip the block of the case")
+		blocks = append(blocks, c.CurrentInstructions().BytePosition)
+
+		// A receive case starts with the value it got on the stack
+		if received != nil {
+			if name != "" {
+				idx := c.AddLocal(name)
+				c.Current.Locals[idx].IsInitialized = true
+				c.Current.Locals[idx].ExprData = *received
+				c.EmitInstr(OP_SET_LOCAL, idx)
+				c.WriteComment(fmt.Sprintf("Received into %s", name))
+			} else {
+				c.EmitOp(OP_POP)
+			}
+		}
+		c.Consume(TOKEN_LEFT_BRACE, "Expect '{' before the block of the case")
+		c.Block()
+		c.EndScope()
+		endJumps = append(endJumps, c.EmitJump(OP_JUMP))
+
+		c.PatchJump(skip)
+		c.ClearCR()
+	}
+	c.Consume(TOKEN_RIGHT_BRACE, "Expect '}' after the cases of select")
+	if len(kinds) == 0 {
+		c.Error("A select needs at least one case")
+	}
+
+	// The offsets are from the end of OP_SELECT, after the kind and offset of
+	// every case
+	selectEnd := c.CurrentInstructions().BytePosition + 3 + 4*len(kinds)
+	c.EmitInstr(OP_SELECT, int16(len(kinds)))
+	for i, kind := range kinds {
+		c.EmitOperand(kind)
+		c.EmitOperand(int16(blocks[i] - selectEnd))
+	}
+	c.WriteComment(fmt.Sprintf("Select from %d cases", len(kinds)))
+
+	for _, jump := range endJumps {
+		c.PatchJump(jump)
+	}
+}
+
+// Compiles the channel of a case of select
+func (c *Compiler) SelectChannel() ExpressionData {
+	c.Expression()
+	ch := PopExpressionValue()
+	if !IsUnknownType(ch) && ch.ObjType != VAR_CHANNEL {
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("A case of select needs a channel, not %s", TypeName(ch)))
+	}
+	return ch
+}
+
+// Matches a word that's only special in one place, such as 'receive' in a
+// select, so it can still be used as a name everywhere else
+func (c *Compiler) MatchWord(word string) bool {
+	if !c.Check(TOKEN_IDENTIFIER) || c.Parser.Current.ToString() != word {
+		return false
+	}
+	c.Advance()
+	return true
+}
+
+func (c *Compiler) TryStatement() {
+	c.BeginScope()
+	try := &TryBlock{LoopPtr: LoopPtr}
+	try.Returning = c.AddLocal(" returning")
+	try.Value = c.AddLocal(" return value")
+	c.EmitOp(OP_FALSE)
+	c.EmitInstr(OP_SET_LOCAL, try.Returning)
+	c.Current.tries = append(c.Current.tries, try)
+
+	catchJump := c.EmitJump(OP_TRY)
+	c.WriteComment("Handler for the try block")
+	try.Handler = true
+
+	c.Consume(TOKEN_LEFT_BRACE, "Expect '{' after 'try'")
+	c.BeginScope()
+	c.Block()
+	c.EndScope()
+	c.EmitOp(OP_END_TRY)
+	try.Handler = false
+
+	// We made it through without an error
+	c.EmitOp(OP_NIL)
+	finallyJumps := []int{c.EmitJump(OP_JUMP)}
+
+	c.PatchJump(catchJump)
+	c.ClearCR()
+
+	hasCatch := c.Match(TOKEN_CATCH)
+	if hasCatch {
+		// An error inside the catch block still has to go through the finally block
+		pendingJump := c.EmitJump(OP_TRY)
+		c.WriteComment("Handler for the catch block")
+		try.Handler = true
+
+		c.BeginScope()
+		if c.Match(TOKEN_IDENTIFIER) {
+			name := c.Parser.Previous.ToString()
+			idx := c.AddLocal(name)
+			c.Current.Locals[idx].IsInitialized = true
+			c.Current.Locals[idx].ExprData = ExpressionData{Value: VAL_OBJECT, ObjType: VAR_OBJECT}
+			c.EmitInstr(OP_SET_LOCAL, idx)
+			c.WriteComment(fmt.Sprintf("Caught error in %s", name))
+		} else {
+			c.EmitOp(OP_POP)
+		}
+		c.Consume(TOKEN_LEFT_BRACE, "Expect '{' after 'catch'")
+		c.Block()
+		c.EndScope()
+		c.EmitOp(OP_END_TRY)
+		try.Handler = false
+
+		c.EmitOp(OP_NIL)
+		finallyJumps = append(finallyJumps, c.EmitJump(OP_JUMP))
+
+		c.PatchJump(pendingJump)
+		c.ClearCR()
+	}
+
+	for _, jump := range append(finallyJumps, try.Returns...) {
+		c.PatchJump(jump)
+	}
+	// A return in the finally block goes through the enclosing statements
+	c.Current.tries = c.Current.tries[:len(c.Current.tries)-1]
+
+	// Hold on to the pending error while the finally block runs
+	c.BeginScope()
+	pending := c.AddLocal(" pending")
+	c.EmitInstr(OP_SET_LOCAL, pending)
+	c.WriteComment("Pending error")
+
+	if c.Match(TOKEN_FINALLY) {
+		c.Consume(TOKEN_LEFT_BRACE, "Expect '{' after 'finally'")
+		c.BeginScope()
+		c.Block()
+		c.EndScope()
+	} else if !hasCatch {
+		c.ErrorAtCurrent("Expect 'catch' or 'finally' after try block")
+	}
+
+	c.EmitInstr(OP_GET_LOCAL, pending)
+	c.EmitOp(OP_END_FINALLY)
+	c.EndScope()
+
+	// A return that came through the finally block carries on from here
+	c.EmitInstr(OP_GET_LOCAL, try.Returning)
+	done := c.EmitJump(OP_JUMP_IF_FALSE)
+	c.EmitInstr(OP_GET_LOCAL, try.Value)
+	c.ReturnValue()
+	c.PatchJump(done)
+	c.EndScope()
+}
+
+func (c *Compiler) ThrowStatement() {
+	c.Expression()
+	PopExpressionValue()
+	c.EmitOp(OP_THROW)
+}
 
-	prop.Index = class.PropertyCount
+// Binds the value on the stack to the class under it. A property or method
+// that's inherited gets replaced rather than added again
+func (c *Compiler) AddProperty(class *ClassVar, name string) *PropertyVar {
+
+	prop := class.FindProperty(name)
+	if prop == nil {
+		prop = &class.Properties[class.PropertyCount]
+		prop.Index = class.PropertyCount
+		class.PropertyCount++
+	}
+
+	prop.Name = name
 	prop.EnclosingClass = class
 
 	idx := c.MakeConstant(ObjString(name))
@@ -2066,10 +2910,8 @@ func (c *Compiler) AddProperty(class *ClassVar, name string) {
 	c.EmitInstr(OP_BIND_PROPERTY,idx)
 	c.WriteComment(fmt.Sprintf("Property name %s index %d",prop.Name,prop.Index))
 
-	class.PropertyCount++
-
 	class.Class.FieldCount = class.PropertyCount - 1
-
+	return prop
 }
 
 func (c *Compiler) this_(canAssign bool) {
@@ -2080,11 +2922,42 @@ func (c *Compiler) GetAccessor() AccessorType {
 	switch {
 		case c.Match(TOKEN_PRIVATE): return PRIVATE
 		case c.Match(TOKEN_PROTECTED): return PROTECTED
+		case c.Match(TOKEN_PUBLIC): return PUBLIC
 		default : return PUBLIC
 	}
 }
 
 func (c *Compiler) Class(canAssign bool) {
+	c.ClassBody(c.DeclaredSymbol(SYMBOL_CLASS))
+}
+
+// class Name : Parent { } declares Name the way var Name = class : Parent { }
+// does
+func (c *Compiler) ClassDeclaration() {
+	c.Consume(TOKEN_IDENTIFIER, "Expect class name")
+	tok := c.Parser.Previous
+
+	if ResolveNativeFunction(tok.ToString()) != nil {
+		c.Error(fmt.Sprintf("'%s' is a reserved name", tok.ToString()))
+	}
+
+	c.Declaring = c.DefineSymbol(tok, SYMBOL_CLASS)
+	symbol := c.Declaring
+	body := func() {
+		c.Declaring = nil
+		c.ClassBody(symbol)
+	}
+	if c.ScopeDepth == 0 {
+		c.DeclareGlobalVariable(tok.ToString(), body)
+	} else {
+		c.DeclareLocalVariable(tok.ToString(), body)
+	}
+	c.Declaring = nil
+}
+
+// Compiles a class from the parent it inherits from, if it has one, to the
+// end of its body and leaves the class on the stack
+func (c *Compiler) ClassBody(symbol *Symbol) {
 
 	class := &ObjClass{
 		Id:          ClassId,
@@ -2103,34 +2976,310 @@ func (c *Compiler) Class(canAssign bool) {
 
 	c.EmitOp(OP_CLASS)
 
+	// The class starts with everything its parent has, and its methods find
+	// the parent through a local named super
+	if c.Match(TOKEN_COLON) {
+		c.Consume(TOKEN_IDENTIFIER, "Expect name of the class to inherit from after ':'")
+		parentTok := c.Parser.Previous
+		CurrentClass = nil
+		c.NamedVariable(false)
+		data := PopExpressionValue()
+		if !IsUnknownType(data) && data.ObjType != VAR_CLASS {
+			c.TypeError(parentTok, fmt.Sprintf("%s is %s, not a class, so it can't be inherited from",
+				parentTok.ToString(), TypeName(data)))
+		} else if CurrentClass != nil {
+			vclass.Parent = CurrentClass
+			copy(vclass.Properties, CurrentClass.Properties[:CurrentClass.PropertyCount])
+			vclass.PropertyCount = CurrentClass.PropertyCount
+		}
+		vclass.HasParent = true
+		c.EmitOp(OP_SUBCLASS)
+
+		c.BeginScope()
+		slot := c.AddLocal("super")
+		c.Current.Locals[slot].ExprData = ExpressionData{Value: VAL_CLASS, ObjType: VAR_CLASS}
+		c.Current.Locals[slot].IsInitialized = true
+		c.Current.Locals[slot].Class = vclass.Parent
+		c.EmitInstr(OP_SET_LOCAL, slot)
+		c.WriteComment("Parent class")
+	}
+
+	enclosingSymbol := c.ClassSymbol
+	c.ClassSymbol = symbol
+	enclosingClass := c.InClass
+	c.InClass = &vclass
+
 	c.Consume(TOKEN_LEFT_BRACE,"Expect '{' after class name")
-	for {
+	for !c.Check(TOKEN_RIGHT_BRACE) && !c.Check(TOKEN_EOF) {
 
 		// Find out if it's public, protected, or private
-		_ = c.GetAccessor()
+		access := c.GetAccessor()
 		// Is it a property? if it is, it'll have a data type indicator. If not,
 		// it means it's a method
 		expData := c.GetDataType()
 		// Either way, the next token needs to be the name
 		c.Consume(TOKEN_IDENTIFIER,"Expect name of class component")
-		compName := c.Parser.Previous.ToString()
-		//idx := c.MakeConstant(ObjString(compName))
+		tok := c.Parser.Previous
+		compName := tok.ToString()
+		inherited := vclass.FindProperty(compName)
+		if inherited != nil && inherited.EnclosingClass != &vclass && inherited.Access != access {
+			c.TypeError(tok, fmt.Sprintf("'%s' is %s in the parent class and can't be made %s here", compName,
+				AccessorLabel[inherited.Access], AccessorLabel[access]))
+		}
 		if expData.ObjType == VAR_UNKNOWN {
 			// It's a method .. so let's make one
-			c.Procedure(TYPE_METHOD)
-			c.AddProperty(&vclass, compName)
+			c.FunctionName = compName
+			c.Declaring = c.DefineSymbol(tok, SYMBOL_METHOD)
+			params := c.Procedure(TYPE_METHOD)
+			method := PopExpressionValue()
+			c.CheckOverride(tok, &vclass, inherited, true, method, params)
+			prop := c.AddProperty(&vclass, compName)
+			prop.IsMethod = true
+			prop.ExprData = method
+			prop.Params = params
+			prop.Access = access
 		} else {
-			c.EmitOp(OP_NIL)
-			c.AddProperty(&vclass, compName)
+			c.DefineSymbol(tok, SYMBOL_PROPERTY).SetData(expData)
+			c.CheckOverride(tok, &vclass, inherited, false, expData, nil)
+			// Each object gets its own copy of the default
+			hasDefault := c.Match(TOKEN_EQUAL)
+			if hasDefault {
+				equalTok := c.Parser.Previous
+				c.Expression()
+				value := PopExpressionValue()
+				if widen, ok := CheckAssignment(expData, value); !ok {
+					c.TypeError(equalTok, fmt.Sprintf("Property %s has type %s: cannot assign a value of type %s",
+						compName, TypeName(expData), TypeName(value)))
+				} else if widen {
+					c.EmitOp(OP_INT_TO_FLOAT)
+				}
+				AssignedProperties[PropertyKey{Class: &vclass, Name: compName}] = true
+			} else {
+				c.EmitOp(OP_NIL)
+			}
+			prop := c.AddProperty(&vclass, compName)
+			prop.IsMethod = false
+			prop.ExprData = expData
+			prop.Params = nil
+			prop.HasValue = hasDefault
+			prop.Access = access
 		}
+	}
+	c.Consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body")
 
-		// Ok, we're done
-		if c.Match(TOKEN_RIGHT_BRACE) {
-			break
+	if vclass.HasParent {
+		c.EndScope()
+	}
+	c.ClassSymbol = enclosingSymbol
+	c.InClass = enclosingClass
+	ClassId--
+
+	CurrentClass = &vclass
+	PushExpressionValue(ExpressionData{Value: VAL_CLASS, ObjType: VAR_CLASS})
+}
+
+// A member a class redefines has to be the same kind of member as the one it
+// inherited, and a method has to take and give back the same types
+func (c *Compiler) CheckOverride(tok Token, class *ClassVar, inherited *PropertyVar, isMethod bool,
+	data ExpressionData, params []ExpressionData) {
+	if inherited == nil {
+		return
+	}
+	name := tok.ToString()
+	switch {
+	case inherited.EnclosingClass == class:
+		c.Error(fmt.Sprintf("'%s' is already defined in this class", name))
+	case inherited.IsMethod && !isMethod:
+		c.TypeError(tok, fmt.Sprintf("'%s' is a method of the parent class and can't be redefined as a property", name))
+	case !inherited.IsMethod && isMethod:
+		c.TypeError(tok, fmt.Sprintf("'%s' is a property of the parent class and can't be redefined as a method", name))
+	case isMethod && name == "init":
+		// Each class is made its own way, so init can take different arguments
+	case isMethod && !SameSignature(inherited.Params, inherited.ExprData.Returns, params, data.Returns):
+		c.TypeError(tok, fmt.Sprintf("Method '%s' is %s in the parent class but %s here", name,
+			Signature(inherited.Params, inherited.ExprData.Returns), Signature(params, data.Returns)))
+	case !isMethod && !SameType(inherited.ExprData, data):
+		c.TypeError(tok, fmt.Sprintf("Property '%s' is %s in the parent class but %s here", name,
+			TypeName(inherited.ExprData), TypeName(data)))
+	}
+}
+
+// super.method(args) calls the method the parent class has, on this
+func (c *Compiler) Super(canAssign bool) {
+	tok := c.Parser.Previous
+	class := c.InClass
+	if class == nil || !class.HasParent || c.Current.Enclosing == nil {
+		c.TypeError(tok, "'super' can only be used in the methods of a class that inherits from another")
+		class = nil
+	}
+	c.Consume(TOKEN_DOT, "Expect '.' after 'super'")
+	c.Consume(TOKEN_IDENTIFIER, "Expect name of a method of the parent class after 'super.'")
+	tok = c.Parser.Previous
+	name := tok.ToString()
+	c.Consume(TOKEN_LEFT_PAREN, "Only methods can be called through 'super', so expect '(' after the name")
+
+	// The method is called on this, with the parent class the method
+	// captured from the class body on top of the arguments
+	c.EmitOp(OP_GET_LOCAL_0)
+	args := c.GetArgumentTypes()
+	if class == nil {
+		PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+		return
+	}
+	idx, _ := c.ResolveUpvalue(c.Current, "super")
+	c.EmitInstr(OP_GET_UPVALUE, idx)
+	c.EmitInstr(OP_SUPER_INVOKE, c.MakeConstant(ObjString(name)))
+	c.EmitOperand(int16(len(args)))
+	c.WriteComment(fmt.Sprintf("Parent method %s", name))
+
+	if parent := class.Parent; parent != nil {
+		method := parent.FindProperty(name)
+		switch {
+		case method == nil:
+			c.TypeError(tok, fmt.Sprintf("The parent class has no method named '%s'", name))
+		case !method.IsMethod:
+			c.TypeError(tok, fmt.Sprintf("'%s' is a property of the parent class, not a method", name))
+		default:
+			c.CheckAccess(tok, method, true)
+			c.CheckMethodArguments(tok, method, args)
 		}
 	}
+	PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+}
 
-	ClassId--
+// new Class(args) makes an object of the class and runs its init method with
+// the arguments, if it has one. The brackets can be left out when there are
+// no arguments
+func (c *Compiler) NewObject() {
+	newTok := c.Parser.Previous
+	CurrentClass = nil
+	c.ParsePrecedence(PREC_PRIMARY)
+	data := PopExpressionValue()
+	class := CurrentClass
+	if data.ObjType != VAR_CLASS {
+		class = nil
+		if !IsUnknownType(data) {
+			c.TypeError(newTok, fmt.Sprintf("Objects can only be made from a class, not %s", TypeName(data)))
+		}
+	}
+	c.EmitOp(OP_OBJ_INSTANCE)
+
+	var args []ExpressionData
+	if c.Match(TOKEN_LEFT_PAREN) {
+		args = c.GetArgumentTypes()
+	}
+	if class != nil {
+		method := class.FindProperty("init")
+		if method == nil || !method.IsMethod {
+			if len(args) > 0 {
+				c.TypeError(newTok, "The class has no init method to take the arguments")
+			}
+		} else {
+			// Making an object inside its class counts as using init
+			// through this
+			c.CheckAccess(newTok, method, true)
+			c.CheckMethodArguments(c.Parser.Previous, method, args)
+		}
+	}
+	// init leaves what it returns on top of the object, and that goes
+	c.EmitInstr(OP_INIT, int16(len(args)))
+	c.EmitOp(OP_POP)
+
+	CurrentClass = class
+	PushExpressionValue(ExpressionData{Value: VAL_OBJECT, ObjType: VAR_OBJECT})
+}
+
+// Records a read of a property of an object of the class. Reads of properties
+// of objects whose class isn't known aren't checked
+func (c *Compiler) PropertyRead(tok Token, class *ClassVar) {
+	if class == nil {
+		return
+	}
+	PropertyReads = append(PropertyReads, PropertyRead{
+		Compiler: c,
+		Token:    tok,
+		Property: class.FindProperty(tok.ToString()),
+	})
+}
+
+// The key an assignment to the property of an object of the class is kept
+// under: the class that declares the property
+func AssignedKey(class *ClassVar, name string) PropertyKey {
+	if class == nil {
+		return PropertyKey{Name: name}
+	}
+	if prop := class.FindProperty(name); prop != nil && prop.EnclosingClass != nil {
+		return PropertyKey{Class: prop.EnclosingClass, Name: name}
+	}
+	return PropertyKey{Class: class, Name: name}
+}
+
+// Whether the property is assigned in the class that declares it or in one
+// of the classes it inherits from, where a property it redeclares started.
+// A parent that isn't known could assign anything
+func IsAssigned(prop *PropertyVar) bool {
+	for class := prop.EnclosingClass; class != nil; class = class.Parent {
+		if AssignedProperties[PropertyKey{Class: class, Name: prop.Name}] {
+			return true
+		}
+		if class.HasParent && class.Parent == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports the properties that get read but that nothing gives a value to:
+// they have no default and are never assigned
+func CheckPropertyReads() bool {
+	ok := true
+	for _, read := range PropertyReads {
+		name := read.Token.ToString()
+		prop := read.Property
+		switch {
+		case prop != nil && (prop.IsMethod || prop.HasValue || IsAssigned(prop)),
+			AssignedProperties[PropertyKey{Name: name}]:
+		case prop == nil:
+			read.Compiler.TypeError(read.Token, fmt.Sprintf("The class has no property named '%s'", name))
+			ok = false
+		default:
+			read.Compiler.TypeError(read.Token, fmt.Sprintf("Property '%s' is read but has no default value and is never assigned", name))
+			ok = false
+		}
+	}
+	PropertyReads = nil
+	return ok
+}
+
+// Private members can only be used through this inside the class that
+// declares them, and protected ones inside that class and the classes that
+// inherit from it
+func (c *Compiler) CheckAccess(tok Token, prop *PropertyVar, isThis bool) {
+	name := prop.Name
+	switch prop.Access {
+	case PRIVATE:
+		if !isThis || c.InClass != prop.EnclosingClass {
+			c.TypeError(tok, fmt.Sprintf("'%s' is private and can only be used through this inside the class that declares it", name))
+		}
+	case PROTECTED:
+		if !c.InClass.InheritsFrom(prop.EnclosingClass) {
+			c.TypeError(tok, fmt.Sprintf("'%s' is protected and can only be used inside its class and the classes that inherit from it", name))
+		}
+	}
+}
+
+// Checks the arguments of a call to a method of a class the compiler knows
+func (c *Compiler) CheckMethodArguments(tok Token, method *PropertyVar, args []ExpressionData) {
+	if len(args) != len(method.Params) {
+		c.TypeError(tok, fmt.Sprintf("Method '%s' takes %d arguments but got %d", method.Name, len(method.Params), len(args)))
+		return
+	}
+	for i, arg := range args {
+		if _, ok := CheckAssignment(method.Params[i], arg); !ok {
+			c.TypeError(tok, fmt.Sprintf("Argument %d of method '%s' must be %s, not %s", i+1, method.Name,
+				TypeName(method.Params[i]), TypeName(arg)))
+		}
+	}
 }
 
 func (c *Compiler) Method(canAssign bool) {
@@ -2138,52 +3287,112 @@ func (c *Compiler) Method(canAssign bool) {
 }
 
 func (c *Compiler) Function(canAssign bool) {
+	c.Declaring = c.DeclaredSymbol(SYMBOL_FUNCTION)
 	c.Procedure(TYPE_FUNCTION)
 }
 
 func (c *Compiler) CallNative(nativeFunction *ObjNative) {
 	c.Consume(TOKEN_LEFT_PAREN, "Expect '(' before native call")
-	argumentCount := c.GetArguments()
+	args := c.GetArgumentTypes()
+	c.CheckNativeArguments(nativeFunction, args)
 	idx := c.MakeConstant(nativeFunction)
 	c.EmitInstr(OP_CALL_NATIVE, idx)
-	c.EmitOperand(argumentCount)
-	PushExpressionValue(nativeFunction.ReturnType)
-}
+	c.EmitOperand(int16(len(args)))
 
-func (c *Compiler) Procedure(functionType FunctionType) {
+	// Natives that give back a table, a file or a connection can go straight
+	// on to its methods
+	result := nativeFunction.ReturnType
+	for (result.ObjType == VAR_TABLE || result.ObjType == VAR_FILE || result.ObjType == VAR_CONNECTION ||
+		result.ObjType == VAR_LISTENER) && c.Match(TOKEN_DOT) {
+		c.Consume(TOKEN_IDENTIFIER, "Expect name after '.'")
+		tok := c.Parser.Previous
+		c.BuiltinMember(result, tok, c.MakeConstant(ObjString(tok.ToString())))
+		result = PopExpressionValue()
+	}
+	PushExpressionValue(result)
+}
 
-	// Create the function object we're going to fill
-	fn := &FunctionVar{
-		paramCount: 0,
-		instr:      NewInstructions(),
-		returnType: VAL_NIL,
-		Locals:     make([]Local, 65000),
-		Upvalues:   make([]Upvalue, 65000),
+// Checks if the name is a group of natives, such as fs, followed by
+// '.<name>'. Variables with the same name as the group hide it
+func (c *Compiler) ResolveNativeModule(tok Token) bool {
+	name := tok.ToString()
+	if !c.Check(TOKEN_DOT) || !NativeModules[name] {
+		return false
+	}
+	if idx, _ := c.ResolveLocal(c.Current, name); idx != -1 {
+		return false
+	}
+	if idx, _ := c.ResolveUpvalue(c.Current, name); idx != -1 {
+		return false
 	}
+	return FindGlobal(c.CurrentModule, name) == -1
+}
 
-	// Set the current function as the enclosing function of this new function
-	fn.Enclosing = c.Current
-	// Make the current function into the new function
-	c.Current = fn
+// Consumes a name that can be a word that's reserved elsewhere, such as join
+// in path.join or method in req$method
+func (c *Compiler) ConsumeName(message string) {
+	if _, reserved := TokenLabels[c.Parser.Current.ToString()]; reserved {
+		c.Advance()
+	} else {
+		c.Consume(TOKEN_IDENTIFIER, message)
+	}
+}
 
-	c.BeginScope()
+// Compiles a call to one of a group's natives: <group>.<name>(<args>)
+func (c *Compiler) NativeModuleCall(module Token) {
+	c.Consume(TOKEN_DOT, "Expect '.' after module name")
+	c.ConsumeName("Expect name after module name")
+	tok := c.Parser.Previous
 
-	paramCount := int16(0)
+	nativeFunction := ResolveNativeFunction(module.ToString() + "." + tok.ToString())
+	if nativeFunction == nil {
+		c.Error(fmt.Sprintf("Module %s has no function named '%s'", module.ToString(), tok.ToString()))
+		PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+		return
+	}
+	c.ReferenceNative(tok, nativeFunction)
+	c.CallNative(nativeFunction)
+}
 
-	c.Current.Locals[c.Current.LocalCount].depth = 0
-	c.Current.Locals[c.Current.LocalCount].isCaptured = false
+func ArgumentRange(least int, most int) string {
+	if least == most {
+		return strconv.Itoa(most)
+	}
+	return fmt.Sprintf("%d to %d", least, most)
+}
 
-	// if it's a method, we add the current class as a parameter
-	if functionType == TYPE_METHOD {
-		c.Current.Locals[c.Current.LocalCount].name = "this"
-		c.Current.Locals[c.Current.LocalCount].ExprData.Value = VAL_CLASS
-		c.Current.Locals[c.Current.LocalCount].ExprData.ObjType = VAR_CLASS
-		c.Current.Locals[c.Current.LocalCount].Class = CurrentClass
-		paramCount++
+// Checks the arguments of a native that has its parameter types registered
+func (c *Compiler) CheckNativeArguments(native *ObjNative, args []ExpressionData) {
+	params := native.Params
+	if params == nil {
+		return
+	}
+	least := len(params) - native.Optional
+	switch {
+	case native.Variadic && len(args) < least:
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("'%s' takes at least %d arguments but got %d", native.Name, least, len(args)))
+		return
+	case !native.Variadic && (len(args) < least || len(args) > len(params)):
+		c.TypeError(c.Parser.Previous, fmt.Sprintf("'%s' takes %s arguments but got %d", native.Name, ArgumentRange(least, len(params)), len(args)))
+		return
 	}
+	for i, arg := range args {
+		param := params[len(params)-1]
+		if i < len(params) {
+			param = params[i]
+		}
+		if _, ok := CheckAssignment(param, arg); !ok {
+			c.TypeError(c.Parser.Previous, fmt.Sprintf("Argument %d of '%s' must be %s, not %s", i+1, native.Name, TypeName(param), TypeName(arg)))
+		}
+	}
+}
 
-	// Set up the locals for this function
-	c.Current.LocalCount++
+// Compiles a function or method from its parameters on and returns the types
+// of the parameters
+func (c *Compiler) Procedure(functionType FunctionType) []ExpressionData {
+	symbol := c.BeginFunction(functionType)
+	fn := c.Current
+	paramCount := c.Current.paramCount
 
 	// Parenthesis and parameter definition
 
@@ -2207,17 +3416,72 @@ func (c *Compiler) Procedure(functionType FunctionType) {
 	c.Consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
 
 	// If there is a return value, then declare it here
-	isReturnValue := false
-	c.Current.returnType = c.GetDataType().Value
-	if c.Current.returnType != VAL_NIL {
-		isReturnValue = true
-	}
+	c.Current.returnData = c.GetDataType()
+	c.Current.returnType = c.Current.returnData.Value
 
 	// Body of the function
 	c.Consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
 	c.Block()
+	c.EndFunction(functionType, symbol)
+	return fn.params
+}
+
+// Starts compiling a new function inside the current one. Methods get the
+// object they were called on as their first parameter
+func (c *Compiler) BeginFunction(functionType FunctionType) *Symbol {
+
+	// Create the function object we're going to fill
+	fn := &FunctionVar{
+		name:       c.FunctionName,
+		file:       c.SourceFile,
+		paramCount: 0,
+		instr:      NewInstructions(),
+		returnType: VAL_NIL,
+		Locals:     make([]Local, 65000),
+		Upvalues:   make([]Upvalue, 65000),
+	}
+
+	// Nested functions don't inherit the name
+	c.FunctionName = ""
+	symbol := c.Declaring
+	c.Declaring = nil
+
+	// Set the current function as the enclosing function of this new function
+	fn.Enclosing = c.Current
+	// Make the current function into the new function
+	c.Current = fn
+
+	c.BeginScope()
+
+	paramCount := int16(0)
+
+	c.Current.Locals[c.Current.LocalCount].depth = 0
+	c.Current.Locals[c.Current.LocalCount].isCaptured = false
+
+	// if it's a method, we add the current class as a parameter
+	if functionType == TYPE_METHOD {
+		c.Current.Locals[c.Current.LocalCount].name = "this"
+		c.Current.Locals[c.Current.LocalCount].ExprData.Value = VAL_CLASS
+		c.Current.Locals[c.Current.LocalCount].ExprData.ObjType = VAR_CLASS
+		c.Current.Locals[c.Current.LocalCount].Class = c.InClass
+		c.Current.Locals[c.Current.LocalCount].infoIndex = c.AddLocalInfo("this", c.Current.LocalCount)
+		paramCount++
+	} else {
+		c.Current.Locals[c.Current.LocalCount].infoIndex = c.AddLocalInfo("", c.Current.LocalCount)
+	}
+
+	// Set up the locals for this function
+	c.Current.LocalCount++
+	c.Current.LocalSlots = c.Current.LocalCount
+	c.Current.paramCount = paramCount
+	return symbol
+}
+
+// Finishes the function BeginFunction started once its body has been
+// compiled, and leaves a closure for it on the stack
+func (c *Compiler) EndFunction(functionType FunctionType, symbol *Symbol) {
 	// If this function returns nothing, then return nil
-	if !isReturnValue {
+	if c.Current.returnType == VAL_NIL {
 		c.EmitOp(OP_NIL)
 		c.WriteComment("In lieu of explicit return value")
 	}
@@ -2255,10 +3519,14 @@ func (c *Compiler) Procedure(functionType FunctionType) {
 		c.EmitOperand(prev.Upvalues[i].Index)
 	}
 
-	PushExpressionValue(ExpressionData{
-		Value:   VAL_FUNCTION,
-		ObjType: VAR_FUNCTION,
-	})
+	data := ExpressionData{
+		Value:     VAL_FUNCTION,
+		ObjType:   VAR_FUNCTION,
+		Returns:   prev.returnType,
+		Signature: &FunctionSignature{Params: prev.params, Returns: prev.returnData},
+	}
+	PushExpressionValue(data)
+	symbol.SetData(data)
 
 }
 
@@ -2268,15 +3536,25 @@ func (c *Compiler) Allocate() {
 
 func (c *Compiler) Statement() {
 
+	// Whatever types the statement's expressions left behind are of
+	// no use once it's done
+	mark := ExpressionValueId
+	defer func() {
+		ExpressionValueId = mark
+	}()
+
 	switch {
 		case c.Match(TOKEN_MODULE):		c.DeclareModule()
 		case c.Match(TOKEN_IMPORT):		c.ImportStatement()
 		case c.Match(TOKEN_VAR): 		c.DeclareVariable()
+		case c.Match(TOKEN_CLASS):		c.ClassDeclaration()
+		case c.Match(TOKEN_PRIVATE):	c.PrivateDeclaration()
 		case c.Match(TOKEN_NEW):        c.Allocate()
 		case c.Match(TOKEN_IF):			c.IfStatement()
 		case c.Match(TOKEN_RETURN):		c.ReturnStatement()
 		case c.Match(TOKEN_SCAN): 		c.ScanStatement()
 		case c.Match(TOKEN_FOR): 		c.ForStatement()
+		case c.Match(TOKEN_PFOR): 		c.PforStatement()
 		case c.Match(TOKEN_WHILE): 		c.WhileStatement()
 		case c.Match(TOKEN_SWITCH):		c.SwitchStatement()
 		case c.Match(TOKEN_CASE): 		c.CaseStatement()
@@ -2284,16 +3562,51 @@ func (c *Compiler) Statement() {
 			c.BeginScope()
 			c.Block()
 			c.EndScope()
+		case c.Match(TOKEN_TRY):		c.TryStatement()
+		case c.Match(TOKEN_THROW):		c.ThrowStatement()
 		case c.Match(TOKEN_BREAK): 		c.BreakStatement()
 		case c.Match(TOKEN_CONTINUE): 	c.ContinueStatement()
 		case c.Match(TOKEN_CR):
 		case c.Match(TOKEN_CREATE): 	c.CreateStatement()
 		case c.Match(TOKEN_INSERT): 	c.InsertStatement()
+		case c.Match(TOKEN_UPDATE):
+			c.UpdateStatement()
+			c.EmitOp(OP_POP)
+		case c.Match(TOKEN_DELETE):
+			c.DeleteStatement()
+			c.EmitOp(OP_POP)
 		case c.Match(TOKEN_SELECT):
+			if c.Check(TOKEN_LEFT_BRACE) {
+				c.ChannelSelect()
+				break
+			}
 			c.SelectStatement()
 			c.EmitOp(OP_DISPLAY_TABLE)
+		case c.Match(TOKEN_LOAD): 		c.LoadStatement()
 		default: c.ExpressionStatement()
 	}
+
+	if c.Parser.PanicMode {
+		c.Synchronize()
+	}
+}
+
+// Skips ahead to the start of the next statement after a syntax error so that
+// the errors after it get reported as well
+func (c *Compiler) Synchronize() {
+	c.Parser.PanicMode = false
+
+	for !c.Check(TOKEN_EOF) {
+		if c.Parser.Previous.Type == TOKEN_CR {
+			return
+		}
+		switch c.Parser.Current.Type {
+		case TOKEN_VAR, TOKEN_IF, TOKEN_FOR, TOKEN_PFOR, TOKEN_WHILE, TOKEN_SCAN, TOKEN_SWITCH,
+			TOKEN_RETURN, TOKEN_TRY, TOKEN_THROW, TOKEN_IMPORT, TOKEN_RIGHT_BRACE:
+			return
+		}
+		c.Advance()
+	}
 }
 
 func (c *Compiler) Evaluate() {
@@ -2333,7 +3646,7 @@ func (c *Compiler) PushType(valType ValueType) {
 			c.Consume(TOKEN_RIGHT_BRACE, "Right brace expected after array expression")
 		}
 	} else {
-		PushExpressionValue(ExpressionData{valType, VAR_SCALAR,1})
+		PushExpressionValue(ExpressionData{Value: valType, ObjType: VAR_SCALAR, Dimensions: 1})
 	}
 }
 
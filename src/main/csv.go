@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* ---------------------------------------------------------------------------
+Delimited files. A file can be read into a data frame, a frame can be written
+out to a file and a file can be loaded straight into a table without ever
+being held in memory in full.
+
+The type of each column is the narrowest of bool, int, float and string that
+every value in the column fits. Empty fields are nulls.
+------------------------------------------------------------------------------*/
+
+type CsvHeader byte
+
+const (
+	CSV_HEADER_AUTO CsvHeader = iota // The first row is the header if it looks like one
+	CSV_HEADER_YES
+	CSV_HEADER_NO
+)
+
+type CsvOptions struct {
+	Delimiter rune
+	Quote     rune
+	Header    CsvHeader
+}
+
+var DefaultCsvOptions = CsvOptions{Delimiter: ',', Quote: '"', Header: CSV_HEADER_AUTO}
+
+// Loading a file into a table works out the types of the columns from this
+// many rows and commits after every batch of rows
+const csvSampleRows = 1000
+const csvBatchRows = 10000
+
+/* ---------------------------------------------------------------------------
+Reading
+------------------------------------------------------------------------------*/
+
+type CsvReader struct {
+	in      *bufio.Reader
+	Options CsvOptions
+}
+
+func NewCsvReader(in io.Reader, options CsvOptions) *CsvReader {
+	return &CsvReader{in: bufio.NewReader(in), Options: options}
+}
+
+// Reads the fields of the next record, or returns io.EOF once there are no
+// more. A quoted field can hold delimiters and line breaks, and a quote
+// inside one is written twice. Blank lines are skipped
+func (r *CsvReader) Read() ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	started, inQuotes := false, false
+
+	for {
+		ch, _, err := r.in.ReadRune()
+		if err == io.EOF {
+			if inQuotes {
+				return nil, fmt.Errorf("a quoted field isn't closed")
+			}
+			if !started {
+				return nil, io.EOF
+			}
+			return append(fields, field.String()), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case inQuotes && ch == r.Options.Quote:
+			next, _, err := r.in.ReadRune()
+			if err == nil && next == r.Options.Quote {
+				field.WriteRune(ch)
+				continue
+			}
+			if err == nil {
+				r.in.UnreadRune()
+			}
+			inQuotes = false
+		case inQuotes:
+			field.WriteRune(ch)
+		case ch == '\r':
+			continue
+		case ch == '\n':
+			if started {
+				return append(fields, field.String()), nil
+			}
+			continue
+		case ch == r.Options.Quote && field.Len() == 0:
+			inQuotes = true
+		case ch == r.Options.Delimiter:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(ch)
+		}
+		started = true
+	}
+}
+
+// Reads records until there are no more or there are as many as asked for
+func (r *CsvReader) ReadRecords(max int) ([][]string, error) {
+	var records [][]string
+	for max < 0 || len(records) < max {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/* ---------------------------------------------------------------------------
+Types
+------------------------------------------------------------------------------*/
+
+// The narrowest type a single value fits
+func CsvValueType(field string) ValueType {
+	field = strings.TrimSpace(field)
+	switch {
+	case field == "":
+		return VAL_NIL
+	case strings.EqualFold(field, "true") || strings.EqualFold(field, "false"):
+		return VAL_BOOL
+	}
+	if _, err := strconv.ParseInt(field, 10, 64); err == nil {
+		return VAL_INTEGER
+	}
+	// ParseFloat takes words such as "inf" and "nan" that are better off as strings
+	if _, err := strconv.ParseFloat(field, 64); err == nil && strings.ContainsAny(field, "0123456789") {
+		return VAL_FLOAT
+	}
+	return VAL_STRING
+}
+
+// The type of a column that has held values of both types
+func WidenCsvType(current ValueType, next ValueType) ValueType {
+	switch {
+	case next == VAL_NIL || current == next:
+		return current
+	case current == VAL_NIL:
+		return next
+	case (current == VAL_INTEGER && next == VAL_FLOAT) || (current == VAL_FLOAT && next == VAL_INTEGER):
+		return VAL_FLOAT
+	}
+	return VAL_STRING
+}
+
+// Works out the type of each column from the records. A column with nothing
+// but nulls is a string column
+func CsvColumnTypes(records [][]string, columns int) []ValueType {
+	types := make([]ValueType, columns)
+	for _, record := range records {
+		for i := 0; i < columns && i < len(record); i++ {
+			types[i] = WidenCsvType(types[i], CsvValueType(record[i]))
+		}
+	}
+	for i := range types {
+		if types[i] == VAL_NIL {
+			types[i] = VAL_STRING
+		}
+	}
+	return types
+}
+
+// Turns a field into a value of the column's type. Loading a table only
+// looks at the first rows to decide the types, so a field that doesn't fit
+// is kept as it is and left to SQLite
+func CsvValue(field string, valType ValueType) Obj {
+	trimmed := strings.TrimSpace(field)
+	if trimmed == "" {
+		return NULL{}
+	}
+	switch valType {
+	case VAL_INTEGER:
+		if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return ObjInteger(i)
+		}
+	case VAL_FLOAT:
+		if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return ObjFloat(f)
+		}
+	case VAL_BOOL:
+		if CsvValueType(trimmed) == VAL_BOOL {
+			return &ObjBool{Value: strings.EqualFold(trimmed, "true")}
+		}
+	}
+	return ObjString(field)
+}
+
+// Takes the first record as the names of the columns if the options say so
+// or, left to decide, if none of its fields is empty or anything but a string.
+// Columns without a name get called column1, column2 and so on
+func CsvColumnNames(records [][]string, header CsvHeader) ([]string, [][]string) {
+	if len(records) == 0 {
+		return nil, records
+	}
+	hasHeader := header == CSV_HEADER_YES
+	if header == CSV_HEADER_AUTO {
+		hasHeader = true
+		for _, field := range records[0] {
+			if CsvValueType(field) != VAL_STRING {
+				hasHeader = false
+			}
+		}
+	}
+
+	names := make([]string, len(records[0]))
+	for i := range names {
+		if hasHeader {
+			names[i] = strings.TrimSpace(records[0][i])
+		}
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("column%d", i+1)
+		}
+	}
+	if hasHeader {
+		records = records[1:]
+	}
+	return names, records
+}
+
+func checkCsvRecord(record []string, columns int, row int) error {
+	if len(record) != columns {
+		return fmt.Errorf("row %d has %d fields instead of %d", row, len(record), columns)
+	}
+	return nil
+}
+
+/* ---------------------------------------------------------------------------
+Data frames
+------------------------------------------------------------------------------*/
+
+// Reads a whole file into a data frame named after the file
+func ReadCsv(path string, options CsvOptions) (*ObjDataFrame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := NewCsvReader(file, options)
+	records, err := reader.ReadRecords(-1)
+	if err != nil {
+		return nil, err
+	}
+	names, records := CsvColumnNames(records, options.Header)
+	for i, record := range records {
+		if err := checkCsvRecord(record, len(names), i+1); err != nil {
+			return nil, err
+		}
+	}
+
+	df := &ObjDataFrame{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), RowCount: len(records)}
+	for i, valType := range CsvColumnTypes(records, len(names)) {
+		col := NewDataColumn(names[i], valType)
+		for _, record := range records {
+			col.Append(CsvValue(record[i], valType))
+		}
+		df.Columns = append(df.Columns, col)
+	}
+	return df, nil
+}
+
+// Writes the frame out with a header of the column names. Nulls are left
+// empty and floats always get a decimal point so the column reads back as
+// floats
+func (o *ObjDataFrame) WriteCsv(path string, options CsvOptions) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	out := bufio.NewWriter(file)
+
+	fields := make([]string, len(o.Columns))
+	if options.Header != CSV_HEADER_NO {
+		for i, col := range o.Columns {
+			fields[i] = col.Name
+		}
+		writeCsvRecord(out, fields, options)
+	}
+	for row := 0; row < o.RowCount; row++ {
+		for i, col := range o.Columns {
+			fields[i] = CsvField(col.Get(row))
+		}
+		writeCsvRecord(out, fields, options)
+	}
+
+	if err := out.Flush(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	return o.RowCount, file.Close()
+}
+
+func CsvField(val Obj) string {
+	switch v := val.(type) {
+	case NULL:
+		return ""
+	case ObjFloat:
+		s := strconv.FormatFloat(float64(v), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s
+	}
+	return fmt.Sprintf("%v", val.ToValue())
+}
+
+// Quotes the fields that need it: those holding a delimiter, a quote or a
+// line break, and those with spaces at either end that would otherwise be
+// trimmed when they're read back
+func writeCsvRecord(out *bufio.Writer, fields []string, options CsvOptions) {
+	quote := string(options.Quote)
+	for i, field := range fields {
+		if i > 0 {
+			out.WriteRune(options.Delimiter)
+		}
+		if strings.ContainsAny(field, string(options.Delimiter)+quote+"\r\n") || strings.TrimSpace(field) != field {
+			field = quote + strings.Replace(field, quote, quote+quote, -1) + quote
+		}
+		out.WriteString(field)
+	}
+	out.WriteString("\n")
+}
+
+/* ---------------------------------------------------------------------------
+Tables
+------------------------------------------------------------------------------*/
+
+// Streams a file into a table and returns the number of rows loaded. The
+// table gets created if it isn't there, with the types worked out from the
+// first rows. The rows go in a batch at a time, each batch in a transaction
+// of its own, so a large file doesn't need to fit in memory
+func LoadCsv(db *sql.DB, path string, table string, options CsvOptions) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := NewCsvReader(file, options)
+	sample, err := reader.ReadRecords(csvSampleRows)
+	if err != nil {
+		return 0, err
+	}
+	if len(sample) == 0 {
+		return 0, nil
+	}
+	names, sample := CsvColumnNames(sample, options.Header)
+	types := CsvColumnTypes(sample, len(names))
+
+	defs := make([]string, len(names))
+	cols := make([]string, len(names))
+	marks := make([]string, len(names))
+	for i := range names {
+		cols[i] = SqlIdentifier(names[i])
+		defs[i] = cols[i] + " " + SqlTypeNames[types[i]]
+		marks[i] = "?"
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", SqlIdentifier(table), strings.Join(defs, ", "))); err != nil {
+		return 0, err
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", SqlIdentifier(table), strings.Join(cols, ", "), strings.Join(marks, ", "))
+
+	rows := 0
+	vals := make([]interface{}, len(names))
+	for len(sample) > 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return rows, err
+		}
+		stmt, err := tx.Prepare(insert)
+		if err != nil {
+			tx.Rollback()
+			return rows, err
+		}
+
+		for batch := 0; batch < csvBatchRows && len(sample) > 0; batch++ {
+			record := sample[0]
+			sample = sample[1:]
+			if err := checkCsvRecord(record, len(names), rows+1); err == nil {
+				for i := range record {
+					vals[i] = SqlValue(CsvValue(record[i], types[i]))
+				}
+				_, err = stmt.Exec(vals...)
+			}
+			if err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return rows, err
+			}
+			rows++
+
+			// Top up from the file once the rows read so far run out
+			if len(sample) == 0 {
+				if sample, err = reader.ReadRecords(csvBatchRows); err != nil {
+					stmt.Close()
+					tx.Rollback()
+					return rows, err
+				}
+			}
+		}
+
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			return rows, err
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/* ---------------------------------------------------------------------------
+Debug Adapter Protocol front end (coyote debug -dap). Editors launch it and
+talk to it over stdin and stdout the same way they talk to the language
+server, except that DAP messages are requests, responses and events rather
+than JSON-RPC. The program to debug comes with the launch request.
+
+The program runs on a goroutine of its own once the editor is done setting
+breakpoints. Whenever the debugger stops it, it sends a stopped event and
+waits for continue, next, stepIn or stepOut. Everything the editor asks for
+in the meantime gets answered from the stopped VM. What the program prints
+goes back to the editor as output events.
+------------------------------------------------------------------------------*/
+
+type dapServer struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	writeLock sync.Mutex
+	seq       int
+
+	program     string
+	stopOnEntry bool
+	module      *ObjModule
+	vm          *VM
+	debugger    *Debugger
+	running     bool
+	stopped     int32 // Set while the program waits on resume
+	resume      chan DebugMode
+
+	// Pending breakpoints for files set before launch
+	breakpoints map[string][]int
+
+	// Variable references handed out since the program last stopped
+	refs []dapReference
+}
+
+// What a variablesReference points at: a scope of a frame or the inside of
+// an object
+type dapReference struct {
+	frame int
+	scope string
+	value Obj
+}
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+const DAP_THREAD_ID = 1
+
+// Serves one editor session. Stdout has to be pointed somewhere else before
+// this gets called since stdout is the protocol's
+func ServeDebugAdapter(in io.Reader, out io.Writer) int {
+	server := &dapServer{
+		in:          bufio.NewReader(in),
+		out:         out,
+		resume:      make(chan DebugMode),
+		breakpoints: make(map[string][]int),
+	}
+
+	for {
+		body, err := server.ReadMessage()
+		if err != nil {
+			return 0
+		}
+		var req dapMessage
+		if err := json.Unmarshal(body, &req); err != nil || req.Type != "request" {
+			continue
+		}
+		if !server.Handle(&req) {
+			return 0
+		}
+	}
+}
+
+// Same framing as the language server: a JSON body behind a Content-Length
+// header
+func (s *dapServer) ReadMessage() ([]byte, error) {
+	lsp := lspServer{in: s.in}
+	return lsp.ReadMessage()
+}
+
+func (s *dapServer) WriteMessage(message interface{}) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.seq++
+	switch m := message.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *dapServer) Respond(req *dapMessage, body interface{}, err error) {
+	resp := &dapResponse{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	s.WriteMessage(resp)
+}
+
+func (s *dapServer) Event(event string, body interface{}) {
+	s.WriteMessage(&dapEvent{Type: "event", Event: event, Body: body})
+}
+
+// Answers a request and reports whether the session carries on
+func (s *dapServer) Handle(req *dapMessage) bool {
+	var body interface{}
+	var err error
+
+	switch req.Command {
+	case "initialize":
+		body = map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}
+		s.Respond(req, body, nil)
+		s.Event("initialized", nil)
+		return true
+	case "launch":
+		err = s.Launch(req.Arguments)
+	case "setBreakpoints":
+		body, err = s.SetBreakpoints(req.Arguments)
+	case "setExceptionBreakpoints":
+		body = map[string]interface{}{"breakpoints": []interface{}{}}
+	case "configurationDone":
+		s.Respond(req, nil, nil)
+		s.Start()
+		return true
+	case "threads":
+		body = map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": DAP_THREAD_ID, "name": "main"}},
+		}
+	case "stackTrace":
+		body, err = s.StackTrace()
+	case "scopes":
+		body, err = s.Scopes(req.Arguments)
+	case "variables":
+		body, err = s.Variables(req.Arguments)
+	case "evaluate":
+		body, err = s.Evaluate(req.Arguments)
+	case "continue":
+		body = map[string]interface{}{"allThreadsContinued": true}
+		err = s.Resume(DEBUG_RUN)
+	case "next":
+		err = s.Resume(DEBUG_STEP_OVER)
+	case "stepIn":
+		err = s.Resume(DEBUG_STEP_IN)
+	case "stepOut":
+		err = s.Resume(DEBUG_STEP_OUT)
+	case "pause":
+		if s.debugger != nil {
+			s.debugger.Pause()
+		}
+	case "disconnect", "terminate":
+		s.Respond(req, nil, nil)
+		return false
+	default:
+		err = fmt.Errorf("unsupported request: %s", req.Command)
+	}
+	s.Respond(req, body, err)
+	return true
+}
+
+func (s *dapServer) Launch(args json.RawMessage) error {
+	var p struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return err
+	}
+	if p.Program == "" {
+		return fmt.Errorf("launch needs the program to debug")
+	}
+	data, err := ioutil.ReadFile(p.Program)
+	if err != nil {
+		return err
+	}
+
+	source := string(data) + "\n"
+	mod := Compile(&source, p.Program, false)
+	if mod == nil || mod.MainFunction == nil {
+		return fmt.Errorf("%s has syntax errors", p.Program)
+	}
+	s.program = p.Program
+	s.stopOnEntry = p.StopOnEntry
+	s.module = mod
+	s.vm = NewVM(mod.LoadedModules, false)
+	s.debugger = NewDebugger(s.vm, p.Program, s)
+	for file, lines := range s.breakpoints {
+		s.debugger.SetBreakpoints(file, lines)
+	}
+	return nil
+}
+
+func (s *dapServer) SetBreakpoints(args json.RawMessage) (interface{}, error) {
+	var p struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+		Lines []int `json:"lines"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return nil, err
+	}
+	lines := p.Lines
+	if len(p.Breakpoints) > 0 {
+		lines = make([]int, len(p.Breakpoints))
+		for i, bp := range p.Breakpoints {
+			lines[i] = bp.Line
+		}
+	}
+
+	var set []Breakpoint
+	if s.debugger != nil {
+		set = s.debugger.SetBreakpoints(p.Source.Path, lines)
+	} else {
+		s.breakpoints[p.Source.Path] = lines
+		for i, line := range lines {
+			set = append(set, Breakpoint{Id: i + 1, File: p.Source.Path, Line: line})
+		}
+	}
+
+	result := make([]map[string]interface{}, len(set))
+	for i, bp := range set {
+		result[i] = map[string]interface{}{"id": bp.Id, "verified": true, "line": bp.Line}
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+// Runs the program on its own goroutine. What it prints gets passed on as
+// output events
+func (s *dapServer) Start() {
+	if s.vm == nil || s.running {
+		return
+	}
+	s.running = true
+	if s.stopOnEntry {
+		s.debugger.Resume(DEBUG_STEP_IN)
+	}
+
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err == nil {
+		os.Stdout = writer
+	}
+	output := make(chan bool)
+	go func() {
+		if reader != nil {
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				s.Event("output", map[string]string{"category": "stdout", "output": scanner.Text() + "\n"})
+			}
+		}
+		close(output)
+	}()
+
+	go func() {
+		result := s.vm.Run(s.module.MainFunction)
+		if writer != nil {
+			os.Stdout = stdout
+			writer.Close()
+		}
+		<-output
+
+		exitCode := 0
+		if result != INTERPRET_OK {
+			exitCode = 70
+		}
+		s.Event("exited", map[string]int{"exitCode": exitCode})
+		s.Event("terminated", nil)
+	}()
+}
+
+// Called on the program's goroutine, which waits here until the editor
+// says how to carry on
+func (s *dapServer) Stopped(d *Debugger, reason string) {
+	s.refs = s.refs[:0]
+	body := map[string]interface{}{
+		"threadId":          DAP_THREAD_ID,
+		"allThreadsStopped": true,
+	}
+	switch reason {
+	case "step", "breakpoint", "pause":
+		body["reason"] = reason
+	default:
+		body["reason"] = "exception"
+		body["text"] = reason
+	}
+	if s.stopOnEntry {
+		s.stopOnEntry = false
+		body["reason"] = "entry"
+	}
+	atomic.StoreInt32(&s.stopped, 1)
+	s.Event("stopped", body)
+
+	d.Resume(<-s.resume)
+}
+
+func (s *dapServer) Resume(mode DebugMode) error {
+	if s.vm == nil {
+		return fmt.Errorf("the program isn't running")
+	}
+	if !atomic.CompareAndSwapInt32(&s.stopped, 1, 0) {
+		return fmt.Errorf("the program isn't stopped")
+	}
+	s.resume <- mode
+	return nil
+}
+
+func (s *dapServer) StackTrace() (interface{}, error) {
+	if s.debugger == nil {
+		return nil, fmt.Errorf("the program isn't running")
+	}
+	frames := make([]map[string]interface{}, 0)
+	for i := 0; i < s.debugger.FrameCount(); i++ {
+		file, line := s.debugger.FrameLocation(i)
+		frames = append(frames, map[string]interface{}{
+			"id":     i,
+			"name":   s.debugger.FrameName(i),
+			"source": dapSource{Name: filepath.Base(file), Path: file},
+			"line":   line,
+			"column": 1,
+		})
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+func (s *dapServer) Scopes(args json.RawMessage) (interface{}, error) {
+	var p struct {
+		FrameId int `json:"frameId"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return nil, err
+	}
+	scopes := make([]map[string]interface{}, 0, 3)
+	for _, scope := range []string{"Locals", "Upvalues", "Globals"} {
+		scopes = append(scopes, map[string]interface{}{
+			"name":               scope,
+			"variablesReference": s.Reference(dapReference{frame: p.FrameId, scope: scope}),
+			"expensive":          scope == "Globals",
+		})
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+// References start at 1 since 0 means there's nothing to expand
+func (s *dapServer) Reference(ref dapReference) int {
+	s.refs = append(s.refs, ref)
+	return len(s.refs)
+}
+
+func (s *dapServer) Variables(args json.RawMessage) (interface{}, error) {
+	var p struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return nil, err
+	}
+	if s.debugger == nil || p.VariablesReference < 1 || p.VariablesReference > len(s.refs) {
+		return nil, fmt.Errorf("unknown variables reference %d", p.VariablesReference)
+	}
+	ref := s.refs[p.VariablesReference-1]
+
+	var vars []DebugVariable
+	switch ref.scope {
+	case "Locals":
+		vars = s.debugger.Locals(ref.frame)
+	case "Upvalues":
+		vars = s.debugger.Upvalues(ref.frame)
+	case "Globals":
+		vars = s.debugger.Globals()
+	default:
+		vars = debugChildren(ref.value)
+	}
+
+	result := make([]dapVariable, len(vars))
+	for i, v := range vars {
+		result[i] = s.Variable(v.Name, v.Value)
+	}
+	return map[string]interface{}{"variables": result}, nil
+}
+
+func (s *dapServer) Variable(name string, val Obj) dapVariable {
+	v := dapVariable{Name: name, Value: DebugValue(val)}
+	if val != nil {
+		v.Type = ValueTypeLabel[val.Type()]
+	}
+	if len(debugChildren(val)) > 0 {
+		v.VariablesReference = s.Reference(dapReference{value: val})
+	}
+	return v
+}
+
+func (s *dapServer) Evaluate(args json.RawMessage) (interface{}, error) {
+	var p struct {
+		Expression string `json:"expression"`
+		FrameId    int    `json:"frameId"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return nil, err
+	}
+	if s.debugger == nil {
+		return nil, fmt.Errorf("the program isn't running")
+	}
+	val, err := s.debugger.Evaluate(p.FrameId, p.Expression)
+	if err != nil {
+		return nil, err
+	}
+	v := s.Variable(p.Expression, val)
+	return map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference}, nil
+}
+
+// The parts of an object that an editor can expand it into
+func debugChildren(val Obj) []DebugVariable {
+	switch obj := val.(type) {
+	case *ObjInstance:
+		vars := make([]DebugVariable, 0, len(obj.Fields))
+		for name, field := range obj.Fields {
+			vars = append(vars, DebugVariable{Name: name, Value: field})
+		}
+		sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+		return vars
+	case *ObjArray:
+		vars := make([]DebugVariable, len(obj.Elements))
+		for i, element := range obj.Elements {
+			vars[i] = DebugVariable{Name: "[" + strconv.Itoa(i) + "]", Value: element}
+		}
+		return vars
+	}
+	return nil
+}
@@ -1,23 +1,51 @@
 package main
 
 import (
-	"fmt"
 	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
 )
 
+/* ---------------------------------------------------------------------------
+Data frames hold the result of a query. The rows get read in full when the
+query runs so that a frame can be looked at as many times as needed, passed
+around and kept in variables after the cursor it came from is gone.
+
+Values are stored a column at a time. Each column keeps its values in a
+vector of the column's type along with a bitmap of the rows that are null,
+so a column of a million integers is a million int64s rather than a million
+boxed values.
+
+Frames are never changed once they're built. Filtering, sorting, joining and
+the rest make new frames, which share whatever columns they didn't change
+with the frame they came from.
+------------------------------------------------------------------------------*/
+
 type ObjDataFrame struct {
-	DbRef *sql.DB
+	Name     string
+	Columns  []*DataColumn
+	RowCount int
+	Groups   []string // Columns the rows get grouped by for agg
+}
+
+type DataColumn struct {
 	Name string
-	Columns []*sql.ColumnType
-	Rows *sql.Rows
-	ColNames []string
-	ColumnCount int16
-	CurrentRow *sql.Row
-	RowNumber int64
+	Type ValueType
+
+	// Only the vector for the column's type gets used
+	Ints    []int64
+	Floats  []float64
+	Strings []string
+	Bools   []bool
+	Bytes   []byte
+
+	Nulls []uint64 // One bit per row, set for the rows that are null
+	Len   int
 }
 
 // Interface functions
-func (o ObjDataFrame) ShowValue() string {return o.Name}
+func (o ObjDataFrame) ShowValue() string {return strings.TrimSuffix(o.Text(0), "\n")}
 func (o ObjDataFrame) Type() ValueType {return VAL_TABLE}
 func (o ObjDataFrame) ToBytes() []byte {panic("implement me")}
 func (o ObjDataFrame) ToValue() interface{} {return o}
@@ -25,50 +53,785 @@ func (o ObjDataFrame) Print() string {
 	return "<table:"+o.Name+">"
 }
 
-func (o *ObjDataFrame) PrintHeader() {
-	for c,_ := range o.ColNames {
-		fmt.Printf("%s\t",o.ColNames[c])
+// Types of the properties and methods of a table for the compiler. The type
+// of a column's elements is only known once the query has run
+var TableProperties = map[string]ExpressionData{
+	"rows": {Value: VAL_INTEGER, ObjType: VAR_SCALAR},
+	"cols": {Value: VAL_INTEGER, ObjType: VAR_SCALAR},
+}
+
+var TableMethods = map[string]BuiltinMethod{
+	"column":  {1, ExpressionData{Value: VAL_NIL, ObjType: VAR_ARRAY, Dimensions: 1}},
+	"totable": {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"agg":     {-1, ExpressionData{Value: VAL_TABLE, ObjType: VAR_TABLE}},
+}
+
+// The aggregates agg knows by name
+var Aggregates = map[string]bool{
+	"sum":   true,
+	"mean":  true,
+	"count": true,
+	"min":   true,
+	"max":   true,
+}
+
+/* ---------------------------------------------------------------------------
+Columns
+------------------------------------------------------------------------------*/
+
+func NewDataColumn(name string, valType ValueType) *DataColumn {
+	return &DataColumn{Name: name, Type: valType}
+}
+
+func (c *DataColumn) IsNull(row int) bool {
+	return c.Nulls[row/64]&(1<<uint(row%64)) != 0
+}
+
+func (c *DataColumn) setNull(row int) {
+	c.Nulls[row/64] |= 1 << uint(row%64)
+}
+
+// Adds a value to the end of the column. A column that hasn't seen anything
+// but nulls yet takes the type of the first value that isn't null. Values of
+// the wrong type change the type of the column: ints widen to floats, bytes
+// to ints and anything else turns the column into strings, the same as
+// SQLite would show them
+func (c *DataColumn) Append(val Obj) {
+	if c.Len%64 == 0 {
+		c.Nulls = append(c.Nulls, 0)
+	}
+	row := c.Len
+	c.Len++
+
+	if val == nil || val.Type() == VAL_NIL {
+		c.appendZero()
+		c.setNull(row)
+		return
 	}
-	fmt.Println()
+	if c.Type == VAL_NIL {
+		c.retype(val.Type())
+	}
+	for !c.appendValue(val) {
+	}
+}
+
+// Adds a value that isn't null. If it doesn't fit, the column gets a wider
+// type and the value has to be added again
+func (c *DataColumn) appendValue(val Obj) bool {
+	switch c.Type {
+	case VAL_INTEGER:
+		switch v := val.(type) {
+		case ObjInteger:
+			c.Ints = append(c.Ints, int64(v))
+			return true
+		case ObjByte:
+			c.Ints = append(c.Ints, int64(v.Value))
+			return true
+		case ObjFloat:
+			c.retype(VAL_FLOAT)
+			return false
+		}
+	case VAL_FLOAT:
+		switch v := val.(type) {
+		case ObjFloat:
+			c.Floats = append(c.Floats, float64(v))
+			return true
+		case ObjInteger:
+			c.Floats = append(c.Floats, float64(v))
+			return true
+		}
+	case VAL_BOOL:
+		switch v := val.(type) {
+		case *ObjBool:
+			c.Bools = append(c.Bools, v.Value)
+			return true
+		case ObjInteger:
+			// SQLite keeps booleans as 0 and 1
+			c.Bools = append(c.Bools, v != 0)
+			return true
+		}
+	case VAL_BYTE:
+		switch v := val.(type) {
+		case ObjByte:
+			c.Bytes = append(c.Bytes, v.Value)
+			return true
+		case ObjInteger:
+			if v >= 0 && v <= 255 {
+				c.Bytes = append(c.Bytes, byte(v))
+				return true
+			}
+			c.retype(VAL_INTEGER)
+			return false
+		}
+	case VAL_STRING:
+		if v, ok := val.(ObjString); ok {
+			c.Strings = append(c.Strings, string(v))
+		} else {
+			c.Strings = append(c.Strings, fmt.Sprintf("%v", val.ToValue()))
+		}
+		return true
+	}
+	c.retype(VAL_STRING)
+	return false
 }
 
-func (o *ObjDataFrame) NextRow() bool {
-	o.RowNumber++
-	return o.Rows.Next()
+func (c *DataColumn) appendZero() {
+	switch c.Type {
+	case VAL_INTEGER:
+		c.Ints = append(c.Ints, 0)
+	case VAL_FLOAT:
+		c.Floats = append(c.Floats, 0)
+	case VAL_BOOL:
+		c.Bools = append(c.Bools, false)
+	case VAL_BYTE:
+		c.Bytes = append(c.Bytes, 0)
+	case VAL_STRING:
+		c.Strings = append(c.Strings, "")
+	}
 }
 
-func (o *ObjDataFrame) PrintRow() {
-	res := make([]interface{},o.ColumnCount)
+// Moves the values appended so far (all but the row being appended) into
+// the vector for another type
+func (c *DataColumn) retype(valType ValueType) {
+	old := *c
+	c.Type = valType
+	c.Ints, c.Floats, c.Strings, c.Bools, c.Bytes = nil, nil, nil, nil, nil
+	for row := 0; row < c.Len-1; row++ {
+		val := old.Get(row)
+		switch {
+		case old.IsNull(row):
+			c.appendZero()
+		case valType == VAL_INTEGER && old.Type == VAL_BYTE:
+			c.Ints = append(c.Ints, int64(val.(ObjByte).Value))
+		case valType == VAL_INTEGER:
+			c.Ints = append(c.Ints, int64(val.(ObjInteger)))
+		case valType == VAL_FLOAT:
+			c.Floats = append(c.Floats, float64(val.(ObjInteger)))
+		case valType == VAL_STRING:
+			c.Strings = append(c.Strings, fmt.Sprintf("%v", val.ToValue()))
+		default:
+			c.appendZero()
+		}
+	}
+}
 
-	for o.Rows.Next() {
+// The value at a row, or nil if the row is null
+func (c *DataColumn) Get(row int) Obj {
+	if c.IsNull(row) {
+		return NULL{}
+	}
+	switch c.Type {
+	case VAL_INTEGER:
+		return ObjInteger(c.Ints[row])
+	case VAL_FLOAT:
+		return ObjFloat(c.Floats[row])
+	case VAL_BOOL:
+		return &ObjBool{Value: c.Bools[row]}
+	case VAL_BYTE:
+		return ObjByte{Value: c.Bytes[row]}
+	case VAL_STRING:
+		return ObjString(c.Strings[row])
+	}
+	return NULL{}
+}
 
-		for i:= range o.Columns {
-			res[i] = &res[i]
+// A new column made of the given rows of this one, in the order given. A row
+// of -1 is null
+func (c *DataColumn) Take(rows []int) *DataColumn {
+	col := NewDataColumn(c.Name, c.Type)
+	col.Nulls = make([]uint64, (len(rows)+63)/64)
+	col.Len = len(rows)
+	for i, row := range rows {
+		if row < 0 || c.IsNull(row) {
+			col.appendZero()
+			col.setNull(i)
+			continue
 		}
-		o.Rows.Scan(res...)
-		for i := range o.Columns {
-			fmt.Printf("%v\t",res[i])
+		switch c.Type {
+		case VAL_INTEGER:
+			col.Ints = append(col.Ints, c.Ints[row])
+		case VAL_FLOAT:
+			col.Floats = append(col.Floats, c.Floats[row])
+		case VAL_BOOL:
+			col.Bools = append(col.Bools, c.Bools[row])
+		case VAL_BYTE:
+			col.Bytes = append(col.Bytes, c.Bytes[row])
+		case VAL_STRING:
+			col.Strings = append(col.Strings, c.Strings[row])
 		}
-		fmt.Println()
 	}
+	return col
 }
 
-func (o *ObjDataFrame) PrintData(rows int64) {
+// Orders two rows of the column, giving -1, 0 or 1. Nulls come first
+func (c *DataColumn) Compare(a int, b int) int {
+	nullA, nullB := c.IsNull(a), c.IsNull(b)
+	switch {
+	case nullA && nullB:
+		return 0
+	case nullA:
+		return -1
+	case nullB:
+		return 1
+	}
+
+	var less, greater bool
+	switch c.Type {
+	case VAL_INTEGER:
+		less, greater = c.Ints[a] < c.Ints[b], c.Ints[a] > c.Ints[b]
+	case VAL_FLOAT:
+		less, greater = c.Floats[a] < c.Floats[b], c.Floats[a] > c.Floats[b]
+	case VAL_BOOL:
+		less, greater = !c.Bools[a] && c.Bools[b], c.Bools[a] && !c.Bools[b]
+	case VAL_BYTE:
+		less, greater = c.Bytes[a] < c.Bytes[b], c.Bytes[a] > c.Bytes[b]
+	case VAL_STRING:
+		less, greater = c.Strings[a] < c.Strings[b], c.Strings[a] > c.Strings[b]
+	}
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// Works out one of the aggregates agg knows by name over some of the rows of
+// the column. Nulls are left out, and a mean, min or max of nothing is null
+func (c *DataColumn) Summarise(how string, rows []int) Obj {
+	if !Aggregates[how] {
+		RaiseRuntimeError("Unknown aggregate '%s'", how)
+	}
+	numeric := c.Type == VAL_INTEGER || c.Type == VAL_FLOAT || c.Type == VAL_BYTE || c.Type == VAL_NIL
+	if (how == "sum" || how == "mean") && !numeric {
+		RaiseRuntimeError("Can't take the %s of column '%s' of type %s", how, c.Name, ValueTypeLabel[c.Type])
+	}
+
+	count, best := 0, -1
+	isum, fsum := int64(0), float64(0)
+	for _, row := range rows {
+		if c.IsNull(row) {
+			continue
+		}
+		count++
+		switch c.Type {
+		case VAL_INTEGER:
+			isum += c.Ints[row]
+			fsum += float64(c.Ints[row])
+		case VAL_FLOAT:
+			fsum += c.Floats[row]
+		case VAL_BYTE:
+			isum += int64(c.Bytes[row])
+			fsum += float64(c.Bytes[row])
+		}
+		if best < 0 || (how == "min" && c.Compare(row, best) < 0) || (how == "max" && c.Compare(row, best) > 0) {
+			best = row
+		}
+	}
+
+	switch how {
+	case "count":
+		return ObjInteger(count)
+	case "sum":
+		if c.Type == VAL_FLOAT {
+			return ObjFloat(fsum)
+		}
+		return ObjInteger(isum)
+	}
+	if count == 0 {
+		return NULL{}
+	}
+	if how == "mean" {
+		return ObjFloat(fsum / float64(count))
+	}
+	return c.Get(best)
+}
+
+// A copy of the column as an array
+func (c *DataColumn) Array() *ObjArray {
+	elements := make([]Obj, c.Len)
+	for i := range elements {
+		elements[i] = c.Get(i)
+	}
+	return &ObjArray{
+		ElementCount: c.Len,
+		ElementTypes: c.Type,
+		Elements:     elements,
+		DimCount:     1,
+		Dimensions:   []int{c.Len},
+	}
+}
+
+/* ---------------------------------------------------------------------------
+Frames
+------------------------------------------------------------------------------*/
+
+// Reads every row of a query into a new data frame. The types the columns
+// were declared with decide the types of the vectors
+func NewDataFrame(name string, rows *sql.Rows) (*ObjDataFrame, error) {
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	df := &ObjDataFrame{Name: name}
+	for i := range colTypes {
+		df.Columns = append(df.Columns, NewDataColumn(colTypes[i].Name(), SqlColumnType(colTypes[i].DatabaseTypeName())))
+	}
+
+	res := make([]interface{}, len(colTypes))
+	ptrs := make([]interface{}, len(colTypes))
+	for i := range res {
+		ptrs[i] = &res[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i := range res {
+			df.Columns[i].Append(SqlToObj(res[i]))
+		}
+		df.RowCount++
+	}
+	return df, rows.Err()
+}
+
+// Maps the type a column was declared with to a Coyote type. Tables created
+// from Coyote use Coyote's own type names
+func SqlColumnType(declared string) ValueType {
+	switch strings.ToUpper(declared) {
+	case "INT", "INTEGER", "BIGINT", "SMALLINT", "TINYINT":
+		return VAL_INTEGER
+	case "FLOAT", "REAL", "DOUBLE", "NUMERIC", "DECIMAL":
+		return VAL_FLOAT
+	case "STRING", "TEXT", "VARCHAR", "CHAR":
+		return VAL_STRING
+	case "BOOL", "BOOLEAN":
+		return VAL_BOOL
+	case "BYTE":
+		return VAL_BYTE
+	}
+	return VAL_NIL
+}
+
+// The type a column gets declared with when a frame is written to a table.
+// The driver only turns columns declared as boolean back into bools
+var SqlTypeNames = map[ValueType]string{
+	VAL_INTEGER: "int",
+	VAL_FLOAT:   "float",
+	VAL_STRING:  "string",
+	VAL_BOOL:    "boolean",
+	VAL_BYTE:    "byte",
+}
+
+func SqlToObj(val interface{}) Obj {
+	switch v := val.(type) {
+	case int64:
+		return ObjInteger(v)
+	case float64:
+		return ObjFloat(v)
+	case string:
+		return ObjString(v)
+	case []byte:
+		return ObjString(v)
+	case bool:
+		return &ObjBool{Value: v}
+	case nil:
+		return NULL{}
+	}
+	return ObjString(fmt.Sprintf("%v", val))
+}
+
+func (o *ObjDataFrame) ColumnCount() int {
+	return len(o.Columns)
+}
+
+func (o *ObjDataFrame) ColumnIndex(name string) int {
+	i := o.findColumn(name)
+	if i < 0 {
+		RaiseRuntimeError("Table has no column named '%s'", name)
+	}
+	return i
+}
+
+func (o *ObjDataFrame) findColumn(name string) int {
+	for i := range o.Columns {
+		if o.Columns[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *ObjDataFrame) ColumnsNamed(names []string) []*DataColumn {
+	cols := make([]*DataColumn, len(names))
+	for i, name := range names {
+		cols[i] = o.Columns[o.ColumnIndex(name)]
+	}
+	return cols
+}
 
-	o.PrintHeader()
+// A copy of one column as an array
+func (o *ObjDataFrame) Column(name string) *ObjArray {
+	return o.Columns[o.ColumnIndex(name)].Array()
+}
+
+// One row as a list keyed by the column names
+func (o *ObjDataFrame) Row(row int64) *ObjList {
+	if row < 0 || row >= int64(o.RowCount) {
+		RaiseRuntimeError("Row %d out of range for a table of %d rows", row, o.RowCount)
+	}
+	list := new(ObjList)
+	list.Init(VAL_STRING, o.ColumnCount())
+	for _, col := range o.Columns {
+		list.AddNew(ObjString(col.Name), col.Get(int(row)))
+	}
+	return list
+}
+
+func (o *ObjDataFrame) GetProperty(name string) Obj {
+	switch name {
+	case "rows":
+		return ObjInteger(o.RowCount)
+	case "cols":
+		return ObjInteger(o.ColumnCount())
+	}
+	RaiseRuntimeError("Table has no property named '%s'", name)
+	return nil
+}
+
+/* ---------------------------------------------------------------------------
+Transformations
+------------------------------------------------------------------------------*/
+
+// A new frame with the given rows, in the order given. A row of -1 is all nulls
+func (o *ObjDataFrame) Take(rows []int) *ObjDataFrame {
+	df := &ObjDataFrame{Name: o.Name, RowCount: len(rows)}
+	for _, col := range o.Columns {
+		df.Columns = append(df.Columns, col.Take(rows))
+	}
+	return df
+}
+
+// A new frame with only the given columns, in the order given
+func (o *ObjDataFrame) Select(names []string) *ObjDataFrame {
+	return &ObjDataFrame{Name: o.Name, Columns: o.ColumnsNamed(names), RowCount: o.RowCount}
+}
+
+// A new frame with some of the columns renamed. The names come in pairs of
+// the old name followed by the new one
+func (o *ObjDataFrame) Rename(names []string) *ObjDataFrame {
+	df := &ObjDataFrame{Name: o.Name, RowCount: o.RowCount}
+	for _, col := range o.Columns {
+		renamed := *col
+		df.Columns = append(df.Columns, &renamed)
+	}
+	for i := 0; i+1 < len(names); i += 2 {
+		df.Columns[o.ColumnIndex(names[i])].Name = names[i+1]
+	}
+	return df
+}
+
+// A new frame with the column added, or in the place of the column of the
+// same name if there is one
+func (o *ObjDataFrame) WithColumn(col *DataColumn) *ObjDataFrame {
+	df := &ObjDataFrame{Name: o.Name, RowCount: o.RowCount}
+	df.Columns = append(df.Columns, o.Columns...)
+	if i := o.findColumn(col.Name); i >= 0 {
+		df.Columns[i] = col
+	} else {
+		df.Columns = append(df.Columns, col)
+	}
+	return df
+}
+
+// A new frame with the rows ordered by the given columns, one after the
+// other. A name that starts with '-' orders that column from high to low.
+// Rows that are the same in every column keep the order they had
+func (o *ObjDataFrame) Sort(keys []string) *ObjDataFrame {
+	cols := make([]*DataColumn, len(keys))
+	desc := make([]bool, len(keys))
+	for i, key := range keys {
+		if strings.HasPrefix(key, "-") {
+			desc[i] = true
+			key = key[1:]
+		}
+		cols[i] = o.Columns[o.ColumnIndex(key)]
+	}
+
+	rows := make([]int, o.RowCount)
+	for i := range rows {
+		rows[i] = i
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, col := range cols {
+			cmp := col.Compare(rows[i], rows[j])
+			if desc[k] {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	return o.Take(rows)
+}
+
+// The same frame grouped by the given columns
+func (o *ObjDataFrame) GroupBy(keys []string) *ObjDataFrame {
+	// Raises an error for a column that isn't there
+	o.ColumnsNamed(keys)
+	df := *o
+	df.Groups = keys
+	return &df
+}
+
+// A string that's the same for rows with the same values in the given
+// columns, and whether any of those values is null
+func RowKey(cols []*DataColumn, row int) (string, bool) {
+	var key strings.Builder
+	hasNull := false
+	for _, col := range cols {
+		if col.IsNull(row) {
+			hasNull = true
+			key.WriteString("\x01")
+		} else {
+			fmt.Fprintf(&key, "%v", col.Get(row).ToValue())
+		}
+		key.WriteString("\x00")
+	}
+	return key.String(), hasNull
+}
+
+// Splits the rows into the groups agg works on, in the order each group
+// first turns up. A frame that isn't grouped is a single group
+func (o *ObjDataFrame) GroupRows() [][]int {
+	var groups [][]int
+	if len(o.Groups) == 0 {
+		rows := make([]int, o.RowCount)
+		for i := range rows {
+			rows[i] = i
+		}
+		return append(groups, rows)
+	}
+
+	cols := o.ColumnsNamed(o.Groups)
+	index := make(map[string]int)
+	for row := 0; row < o.RowCount; row++ {
+		key, _ := RowKey(cols, row)
+		group, ok := index[key]
+		if !ok {
+			group = len(groups)
+			index[key] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], row)
+	}
+	return groups
+}
+
+// Joins the rows of two frames that have the same value in the given column.
+// Rows of this frame that match nothing get dropped, or kept with nulls for
+// the other frame's columns if keepAll is set. Nulls don't match anything.
+// The other frame's columns that have the same name as one of this frame's
+// get "_right" added to their name
+func (o *ObjDataFrame) Join(right *ObjDataFrame, key string, keepAll bool) *ObjDataFrame {
+	leftKey := []*DataColumn{o.Columns[o.ColumnIndex(key)]}
+	rightKey := []*DataColumn{right.Columns[right.ColumnIndex(key)]}
+
+	index := make(map[string][]int)
+	for row := 0; row < right.RowCount; row++ {
+		if k, hasNull := RowKey(rightKey, row); !hasNull {
+			index[k] = append(index[k], row)
+		}
+	}
+
+	var leftRows, rightRows []int
+	for row := 0; row < o.RowCount; row++ {
+		k, hasNull := RowKey(leftKey, row)
+		matches := index[k]
+		if hasNull {
+			matches = nil
+		}
+		for _, match := range matches {
+			leftRows = append(leftRows, row)
+			rightRows = append(rightRows, match)
+		}
+		if len(matches) == 0 && keepAll {
+			leftRows = append(leftRows, row)
+			rightRows = append(rightRows, -1)
+		}
+	}
+
+	df := o.Take(leftRows)
+	for _, col := range right.Columns {
+		if col.Name == key {
+			continue
+		}
+		taken := col.Take(rightRows)
+		if df.findColumn(taken.Name) >= 0 {
+			taken.Name += "_right"
+		}
+		df.Columns = append(df.Columns, taken)
+	}
+	return df
+}
+
+// Writes the frame to a new table in the current database and returns the
+// number of rows written. The rows go in as a single transaction
+func (o *ObjDataFrame) ToTable(db *sql.DB, table string) (int, error) {
+	defs := make([]string, len(o.Columns))
+	marks := make([]string, len(o.Columns))
+	for i, col := range o.Columns {
+		defs[i] = strings.TrimSpace(SqlIdentifier(col.Name) + " " + SqlTypeNames[col.Type])
+		marks[i] = "?"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", SqlIdentifier(table), strings.Join(defs, ", "))); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", SqlIdentifier(table), strings.Join(marks, ", ")))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
 
-	res := make([]interface{},o.ColumnCount)
-	for o.NextRow() {
-		for i:= range o.Columns {
-			res[i] = &res[i]
+	vals := make([]interface{}, len(o.Columns))
+	for row := 0; row < o.RowCount; row++ {
+		for i, col := range o.Columns {
+			vals[i] = SqlValue(col.Get(row))
 		}
-		o.Rows.Scan(res...)
-		for i := range o.Columns {
-			fmt.Printf("%v\t",res[i])
+		if _, err := stmt.Exec(vals...); err != nil {
+			return 0, err
 		}
-		fmt.Println()
-		if o.RowNumber == rows && rows > 0 {
+	}
+	return o.RowCount, tx.Commit()
+}
+
+// Quotes a table or column name
+func SqlIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Calls a method of a table. The table is on the stack under its arguments
+func (v *VM) TableMethodCall(df *ObjDataFrame, name string, argCount int) {
+	args := make([]Obj, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.Pop()
+	}
+	v.Pop()
+
+	switch name {
+	case "column":
+		v.Push(df.Column(string(args[0].(ObjString))))
+	case "totable":
+		rows, err := df.ToTable(v.db, string(args[0].(ObjString)))
+		if err != nil {
+			v.Error("Can't write table '%s': %s", args[0].ShowValue(), err.Error())
+		}
+		v.Push(ObjInteger(rows))
+	case "agg":
+		v.Push(v.Aggregate(df, args))
+	default:
+		v.Error("Table has no method named '%s'", name)
+	}
+}
+
+// Sums up each group of rows of a frame in a row of a new frame. The arguments
+// come in threes: the name of the new column, the aggregate and the column
+// it's taken over. The aggregate is either one that agg knows by name or a
+// function that gets the group's values as an array. The new frame starts
+// with the columns the rows were grouped by
+func (v *VM) Aggregate(df *ObjDataFrame, args []Obj) *ObjDataFrame {
+	if len(args) == 0 || len(args)%3 != 0 {
+		v.Error("agg takes a name, an aggregate and a column for each new column")
+	}
+
+	groups := df.GroupRows()
+	firsts := make([]int, len(groups))
+	for i, rows := range groups {
+		firsts[i] = -1
+		if len(rows) > 0 {
+			firsts[i] = rows[0]
+		}
+	}
+
+	result := &ObjDataFrame{Name: df.Name, RowCount: len(groups)}
+	for _, col := range df.ColumnsNamed(df.Groups) {
+		result.Columns = append(result.Columns, col.Take(firsts))
+	}
+
+	for i := 0; i < len(args); i += 3 {
+		name, okName := args[i].(ObjString)
+		colName, okCol := args[i+2].(ObjString)
+		if !okName || !okCol {
+			v.Error("The names of the columns given to agg must be strings")
+		}
+		src := df.Columns[df.ColumnIndex(string(colName))]
+		col := NewDataColumn(string(name), VAL_NIL)
+
+		switch how := args[i+1].(type) {
+		case ObjString:
+			for _, rows := range groups {
+				col.Append(src.Summarise(string(how), rows))
+			}
+		case *ObjClosure:
+			for _, rows := range groups {
+				col.Append(v.CallClosure(how, src.Take(rows).Array()))
+			}
+		default:
+			v.Error("An aggregate must be the name of one or a function, not %s", how.ShowValue())
+		}
+		result.Columns = append(result.Columns, col)
+	}
+	return result
+}
+
+func (o *ObjDataFrame) PrintHeader() {
+	fmt.Println(o.header())
+}
+
+func (o *ObjDataFrame) header() string {
+	names := make([]string, len(o.Columns))
+	for i, col := range o.Columns {
+		names[i] = col.Name
+	}
+	return strings.Join(names, "\t")
+}
+
+func (o *ObjDataFrame) PrintData(rows int64) {
+	fmt.Print(o.Text(rows))
+}
+
+// The column names and then the rows, up to the given number of them if it
+// isn't 0, a line each with tabs between the values. Nulls show as NULL
+func (o *ObjDataFrame) Text(rows int64) string {
+	var text strings.Builder
+	text.WriteString(o.header() + "\n")
+
+	values := make([]string, len(o.Columns))
+	for r := 0; r < o.RowCount; r++ {
+		if int64(r) == rows && rows > 0 {
 			break
 		}
+		for i, col := range o.Columns {
+			if col.IsNull(r) {
+				values[i] = "NULL"
+			} else {
+				values[i] = fmt.Sprintf("%v", col.Get(r).ToValue())
+			}
+		}
+		text.WriteString(strings.Join(values, "\t") + "\n")
 	}
-}
\ No newline at end of file
+	return text.String()
+}
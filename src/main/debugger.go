@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/* ---------------------------------------------------------------------------
+Source level debugger (coyote debug script.cy). The VM hands every
+instruction to Trace before it runs it. Trace works out whether the
+instruction starts a new line and stops if that line has a breakpoint or
+finishes the step that was asked for. While stopped, the front end takes
+over: the console reads commands from the terminal, the Debug Adapter
+Protocol front end (dap.go) answers an editor.
+
+Variables are found by the names they have in the source. The compiler
+leaves the names of locals and upvalues in each function along with the
+stretch of code every local is in scope for, FOR loop variables included.
+Globals come from the compiler's table of them, which is why the debugger
+only runs source files.
+------------------------------------------------------------------------------*/
+
+type DebugMode int
+
+const (
+	DEBUG_RUN       DebugMode = iota // Only stop at breakpoints
+	DEBUG_STEP_IN                    // Stop at the next line, wherever it is
+	DEBUG_STEP_OVER                  // Stop at the next line of this frame or the ones below it
+	DEBUG_STEP_OUT                   // Stop once this frame returns
+)
+
+// Takes over while the program is stopped and returns once it should carry on
+type DebugFrontend interface {
+	Stopped(d *Debugger, reason string)
+}
+
+type Breakpoint struct {
+	Id   int
+	File string
+	Line int
+}
+
+type Debugger struct {
+	vm          *VM
+	frontend    DebugFrontend
+	MainFile    string
+	Breakpoints []Breakpoint
+	Watches     []string
+
+	mode      DebugMode
+	stepDepth int // Frame depth when the step started
+	stepFile  string
+	stepLine  int
+
+	// Where the last instruction was, to tell when a new line starts
+	file  string
+	line  int
+	depth int
+
+	lastError   *RuntimeError
+	nextBreakId int
+
+	// Front ends that take requests while the program runs change the
+	// breakpoints from another goroutine, and can ask for it to stop
+	lock    sync.Mutex
+	pausing int32
+}
+
+// A value with the name it goes by in the source
+type DebugVariable struct {
+	Name  string
+	Value Obj
+}
+
+func NewDebugger(vm *VM, mainFile string, frontend DebugFrontend) *Debugger {
+	d := &Debugger{
+		vm:          vm,
+		frontend:    frontend,
+		MainFile:    mainFile,
+		nextBreakId: 1,
+	}
+	vm.Debugger = d
+	return d
+}
+
+// Runs before every instruction
+func (d *Debugger) Trace() {
+	v := d.vm
+	if atomic.CompareAndSwapInt32(&d.pausing, 1, 0) {
+		d.file, d.line, d.depth = v.CurrentFile(), v.CurrentLine(), v.fp
+		d.Stop("pause")
+		return
+	}
+	file, line := v.CurrentFile(), v.CurrentLine()
+	if file == d.file && line == d.line && v.fp == d.depth {
+		return
+	}
+	d.file, d.line, d.depth = file, line, v.fp
+
+	reason := ""
+	switch d.mode {
+	case DEBUG_STEP_IN:
+		if v.fp != d.stepDepth || line != d.stepLine || file != d.stepFile {
+			reason = "step"
+		}
+	case DEBUG_STEP_OVER:
+		if v.fp < d.stepDepth || (v.fp == d.stepDepth && (line != d.stepLine || file != d.stepFile)) {
+			reason = "step"
+		}
+	case DEBUG_STEP_OUT:
+		if v.fp < d.stepDepth {
+			reason = "step"
+		}
+	}
+	if reason == "" && d.HasBreakpoint(file, line) {
+		reason = "breakpoint"
+	}
+	if reason != "" {
+		d.Stop(reason)
+	}
+}
+
+// Stops where the VM is right now
+func (d *Debugger) Stop(reason string) {
+	d.mode = DEBUG_RUN
+	d.frontend.Stopped(d, reason)
+}
+
+// Gives the user a look at an error nothing is going to catch before the
+// frames it happened in get unwound
+func (d *Debugger) Uncaught(err *RuntimeError) {
+	if err == d.lastError {
+		return
+	}
+	d.lastError = err
+	d.Stop("exception: " + err.Message)
+}
+
+// Stops the program at the next instruction it runs
+func (d *Debugger) Pause() {
+	atomic.StoreInt32(&d.pausing, 1)
+}
+
+// Carries on running. Steps are measured from where the VM is now
+func (d *Debugger) Resume(mode DebugMode) {
+	d.mode = mode
+	d.stepDepth = d.vm.fp
+	d.stepFile = d.vm.CurrentFile()
+	d.stepLine = d.vm.CurrentLine()
+}
+
+/* ---------------------------------------------------------------------------
+Breakpoints
+------------------------------------------------------------------------------*/
+
+func (d *Debugger) AddBreakpoint(file string, line int) Breakpoint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.addBreakpoint(file, line)
+}
+
+func (d *Debugger) addBreakpoint(file string, line int) Breakpoint {
+	bp := Breakpoint{Id: d.nextBreakId, File: file, Line: line}
+	d.nextBreakId++
+	d.Breakpoints = append(d.Breakpoints, bp)
+	return bp
+}
+
+func (d *Debugger) RemoveBreakpoint(id int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, bp := range d.Breakpoints {
+		if bp.Id == id {
+			d.Breakpoints = append(d.Breakpoints[:i], d.Breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the breakpoints of a file, which is how editors send them
+func (d *Debugger) SetBreakpoints(file string, lines []int) []Breakpoint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	kept := d.Breakpoints[:0]
+	for _, bp := range d.Breakpoints {
+		if !SameFile(bp.File, file) {
+			kept = append(kept, bp)
+		}
+	}
+	d.Breakpoints = kept
+
+	added := make([]Breakpoint, 0, len(lines))
+	for _, line := range lines {
+		added = append(added, d.addBreakpoint(file, line))
+	}
+	return added
+}
+
+func (d *Debugger) HasBreakpoint(file string, line int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, bp := range d.Breakpoints {
+		if bp.Line == line && SameFile(bp.File, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Breakpoints can be given with a path that's written differently to the one
+// the code was compiled with, or just by the file's name
+func SameFile(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA == nil && errB == nil && absA == absB {
+		return true
+	}
+	return !strings.ContainsRune(a, filepath.Separator) && filepath.Base(b) == a
+}
+
+/* ---------------------------------------------------------------------------
+Frames and variables. Frames are numbered from the innermost one, which is 0
+------------------------------------------------------------------------------*/
+
+func (d *Debugger) FrameCount() int {
+	return d.vm.fp
+}
+
+func (d *Debugger) Frame(index int) *CallFrame {
+	if index < 0 || index >= d.vm.fp {
+		return nil
+	}
+	return &d.vm.Frames[d.vm.fp-1-index]
+}
+
+func (d *Debugger) FrameName(index int) string {
+	frame := d.Frame(index)
+	if frame == nil || frame.Closure == nil {
+		return ""
+	}
+	return frame.Closure.Function.DisplayName()
+}
+
+func (d *Debugger) FrameLocation(index int) (string, int) {
+	frame := d.Frame(index)
+	if frame == nil || frame.Closure == nil {
+		return "", 0
+	}
+	return frame.Closure.Function.Code.File, d.vm.LineOf(frame)
+}
+
+func (d *Debugger) Locals(index int) []DebugVariable {
+	frame := d.Frame(index)
+	if frame == nil || frame.Closure == nil {
+		return nil
+	}
+	vars := make([]DebugVariable, 0)
+	seen := make(map[int]int)
+	for _, info := range frame.Closure.Function.Locals {
+		// Unnamed slots hold the function itself and compiler temporaries
+		if info.Name == "" || strings.HasPrefix(info.Name, " ") || !info.InScope(frame.ip) {
+			continue
+		}
+		variable := DebugVariable{Name: info.Name}
+		slot := info.Slot
+		if info.Register {
+			variable.Value = ObjInteger(d.vm.Registers[info.Slot])
+			slot = -1 - slot
+		} else {
+			variable.Value = frame.slots[info.Slot]
+		}
+		// A later declaration of the same slot hides the earlier one
+		if i, ok := seen[slot]; ok {
+			vars[i] = variable
+			continue
+		}
+		seen[slot] = len(vars)
+		vars = append(vars, variable)
+	}
+	return vars
+}
+
+func (d *Debugger) Upvalues(index int) []DebugVariable {
+	frame := d.Frame(index)
+	if frame == nil || frame.Closure == nil {
+		return nil
+	}
+	vars := make([]DebugVariable, 0)
+	names := frame.Closure.Function.UpvalueNames
+	for i, upvalue := range frame.Closure.Upvalues {
+		if i >= len(names) || upvalue == nil || upvalue.Reference == nil {
+			continue
+		}
+		vars = append(vars, DebugVariable{Name: names[i], Value: *upvalue.Reference})
+	}
+	return vars
+}
+
+// Globals of modules other than the main one go by their qualified name
+func (d *Debugger) Globals() []DebugVariable {
+	vars := make([]DebugVariable, 0, GlobalCount)
+	for i := int16(0); i < GlobalCount && int(i) < len(d.vm.Globals); i++ {
+		name := GlobalVars[i].name
+		if module := GlobalVars[i].Module; module != nil && module.ParentModule != nil {
+			name = module.Name + "." + name
+		}
+		vars = append(vars, DebugVariable{Name: name, Value: d.vm.Globals[i]})
+	}
+	return vars
+}
+
+// Finds a name the way the compiler would from inside the frame: locals
+// (loop variables among them), then upvalues, then globals
+func (d *Debugger) Lookup(index int, name string) (Obj, bool) {
+	for _, scope := range [][]DebugVariable{d.Locals(index), d.Upvalues(index)} {
+		for i := len(scope) - 1; i >= 0; i-- {
+			if scope[i].Name == name {
+				return scope[i].Value, true
+			}
+		}
+	}
+	for _, global := range d.Globals() {
+		if global.Name == name {
+			return global.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Evaluates a watch: a name followed by any number of .property, [index]
+// or $key to get at the inside of objects, arrays and lists. Nothing gets
+// compiled or run, so operators and calls aren't understood and an index
+// has to be a number
+func (d *Debugger) Evaluate(index int, expr string) (Obj, error) {
+	expr = strings.TrimSpace(expr)
+	end := strings.IndexAny(expr, ".[$")
+	if end == -1 {
+		end = len(expr)
+	}
+	name := expr[:end]
+	if !debugName(name) {
+		return nil, fmt.Errorf("'%s' isn't a variable: operators and calls can't be evaluated", name)
+	}
+	val, ok := d.Lookup(index, name)
+	if !ok {
+		return nil, fmt.Errorf("no variable named '%s'", name)
+	}
+
+	rest := expr[end:]
+	for rest != "" {
+		switch rest[0] {
+		case '.', '$':
+			sep := rest[0]
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[$")
+			if end == -1 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			if sep == '.' {
+				val, ok = debugField(val, key)
+			} else {
+				val, ok = debugListItem(val, key)
+			}
+			if !ok {
+				return nil, fmt.Errorf("'%s' has nothing named '%s'", expr[:len(expr)-len(rest)-len(key)-1], key)
+			}
+		case '[':
+			close := strings.IndexByte(rest, ']')
+			if close == -1 {
+				return nil, fmt.Errorf("missing ']' in '%s'", expr)
+			}
+			i, err := strconv.ParseInt(strings.TrimSpace(rest[1:close]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("array indexes have to be numbers")
+			}
+			rest = rest[close+1:]
+			val, ok = debugElement(val, i)
+			if !ok {
+				return nil, fmt.Errorf("index %d is out of range", i)
+			}
+		default:
+			return nil, fmt.Errorf("can't make sense of '%s'", rest)
+		}
+	}
+	return val, nil
+}
+
+// Whether the text could be the name of a variable, the way the scanner
+// reads identifiers
+func debugName(name string) bool {
+	var s Scanner
+	if name == "" || s.isDigit(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !s.isAlpha(name[i]) && !s.isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func debugField(val Obj, name string) (Obj, bool) {
+	switch obj := val.(type) {
+	case *ObjInstance:
+		field, ok := obj.Fields[name]
+		return field, ok
+	}
+	return nil, false
+}
+
+func debugListItem(val Obj, key string) (Obj, bool) {
+	var list map[HashKey]Obj
+	switch obj := val.(type) {
+	case *ObjList:
+		list = obj.List
+	case ObjList:
+		list = obj.List
+	default:
+		return nil, false
+	}
+	item, ok := list[ObjString(key).HashValue()]
+	return item, ok
+}
+
+func debugElement(val Obj, index int64) (result Obj, ok bool) {
+	defer func() {
+		if recover() != nil {
+			result, ok = nil, false
+		}
+	}()
+	switch obj := val.(type) {
+	case *ObjArray:
+		return obj.GetElement(index), true
+	case ObjArray:
+		return obj.GetElement(index), true
+	}
+	return nil, false
+}
+
+func DebugValue(val Obj) string {
+	if val == nil {
+		return "nil"
+	}
+	switch obj := val.(type) {
+	case ObjString:
+		return strconv.Quote(string(obj))
+	case *ObjInstance:
+		names := make([]string, 0, len(obj.Fields))
+		for name := range obj.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = name + ": " + DebugValue(obj.Fields[name])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return val.ShowValue()
+}
+
+/* ---------------------------------------------------------------------------
+Console front end
+------------------------------------------------------------------------------*/
+
+type DebugConsole struct {
+	in    *bufio.Scanner
+	out   io.Writer
+	frame int // The frame 'print' and friends look at
+	quit  bool
+}
+
+var debugConsoleHelp = []struct {
+	Name string
+	Help string
+}{
+	{"break [file:]line", "stop when a line is reached (b)"},
+	{"delete id", "remove a breakpoint (d)"},
+	{"breakpoints", "list the breakpoints"},
+	{"continue", "run until the next breakpoint (c)"},
+	{"step", "run to the next line, going into calls (s)"},
+	{"next", "run to the next line, stepping over calls (n)"},
+	{"out", "run until the current function returns (o, finish)"},
+	{"print name", "show a variable: name, name.prop, name[2], name$key (p)"},
+	{"", "operators, calls and variable indexes aren't evaluated"},
+	{"locals", "show the locals of the frame"},
+	{"upvalues", "show the closure variables of the frame"},
+	{"globals", "show the globals"},
+	{"watch name", "show a variable every time the program stops, written as for print (w)"},
+	{"unwatch n", "stop watching"},
+	{"backtrace", "show the call stack (bt)"},
+	{"frame n", "look at the variables of another frame (f)"},
+	{"list", "show the source around the current line (l)"},
+	{"quit", "stop the program (q)"},
+}
+
+func NewDebugConsole(in io.Reader, out io.Writer) *DebugConsole {
+	return &DebugConsole{in: bufio.NewScanner(in), out: out}
+}
+
+// Debugs a source file from the terminal. The program stops before its
+// first line so that breakpoints can be set
+func DebugFile(path string, in io.Reader, out io.Writer) InterpretResult {
+	source := ReadFile(path) + "\n"
+	mod := Compile(&source, path, false)
+	if mod == nil || mod.MainFunction == nil {
+		fmt.Println("Compile error")
+		return INTERPRET_COMPILE_ERROR
+	}
+
+	console := NewDebugConsole(in, out)
+	vm := NewVM(mod.LoadedModules, false)
+	debugger := NewDebugger(vm, path, console)
+	debugger.Resume(DEBUG_STEP_IN)
+
+	fmt.Fprintf(out, "Debugging %s. Type help for the list of commands\n", path)
+	result := console.Run(vm, mod.MainFunction)
+	if !console.quit {
+		fmt.Fprintln(out, "Program finished")
+	}
+	return result
+}
+
+// Quitting unwinds the VM with a panic that gets caught here rather than
+// reported as a runtime error
+type debugQuit struct{}
+
+func (c *DebugConsole) Run(vm *VM, fn *ObjFunction) (result InterpretResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(debugQuit); !ok {
+				panic(r)
+			}
+			result = INTERPRET_OK
+		}
+	}()
+	return vm.Run(fn)
+}
+
+func (c *DebugConsole) Stopped(d *Debugger, reason string) {
+	c.frame = 0
+	file, line := d.FrameLocation(0)
+	if reason == "step" {
+		fmt.Fprintf(c.out, "%s:%d in %s\n", file, line, d.FrameName(0))
+	} else {
+		fmt.Fprintf(c.out, "Stopped (%s) at %s:%d in %s\n", reason, file, line, d.FrameName(0))
+	}
+	c.ShowSourceLine(file, line)
+	c.ShowWatches(d)
+
+	for {
+		fmt.Fprint(c.out, "(debug) ")
+		if !c.in.Scan() {
+			// Nobody left to ask, so run to the end
+			d.Resume(DEBUG_RUN)
+			d.Breakpoints = nil
+			return
+		}
+		if c.Command(d, strings.TrimSpace(c.in.Text())) {
+			return
+		}
+	}
+}
+
+// Runs a command and reports whether the program should carry on
+func (c *DebugConsole) Command(d *Debugger, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	cmd := fields[0]
+	arg := strings.TrimSpace(strings.TrimPrefix(line, cmd))
+
+	switch cmd {
+	case "c", "continue":
+		d.Resume(DEBUG_RUN)
+		return true
+	case "s", "step":
+		d.Resume(DEBUG_STEP_IN)
+		return true
+	case "n", "next":
+		d.Resume(DEBUG_STEP_OVER)
+		return true
+	case "o", "out", "finish":
+		d.Resume(DEBUG_STEP_OUT)
+		return true
+	case "q", "quit":
+		c.quit = true
+		d.vm.Debugger = nil
+		panic(debugQuit{})
+
+	case "b", "break":
+		file, line, err := c.ParseLocation(d, arg)
+		if err != nil {
+			fmt.Fprintln(c.out, err)
+			break
+		}
+		bp := d.AddBreakpoint(file, line)
+		fmt.Fprintf(c.out, "Breakpoint %d at %s:%d\n", bp.Id, bp.File, bp.Line)
+	case "d", "delete":
+		id, err := strconv.Atoi(arg)
+		if err != nil || !d.RemoveBreakpoint(id) {
+			fmt.Fprintf(c.out, "No breakpoint %s\n", arg)
+		}
+	case "breakpoints", "info":
+		if len(d.Breakpoints) == 0 {
+			fmt.Fprintln(c.out, "No breakpoints")
+		}
+		for _, bp := range d.Breakpoints {
+			fmt.Fprintf(c.out, "%d  %s:%d\n", bp.Id, bp.File, bp.Line)
+		}
+
+	case "p", "print":
+		val, err := d.Evaluate(c.frame, arg)
+		if err != nil {
+			fmt.Fprintln(c.out, err)
+			break
+		}
+		fmt.Fprintf(c.out, "%s = %s\n", arg, DebugValue(val))
+	case "locals":
+		c.ShowVariables(d.Locals(c.frame))
+	case "upvalues":
+		c.ShowVariables(d.Upvalues(c.frame))
+	case "globals":
+		c.ShowVariables(d.Globals())
+	case "w", "watch":
+		if arg != "" {
+			d.Watches = append(d.Watches, arg)
+		}
+		c.ShowWatches(d)
+	case "unwatch":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(d.Watches) {
+			fmt.Fprintf(c.out, "No watch %s\n", arg)
+			break
+		}
+		d.Watches = append(d.Watches[:n-1], d.Watches[n:]...)
+
+	case "bt", "backtrace", "where":
+		for i := 0; i < d.FrameCount(); i++ {
+			file, line := d.FrameLocation(i)
+			marker := " "
+			if i == c.frame {
+				marker = "*"
+			}
+			fmt.Fprintf(c.out, "%s#%d  %s at %s:%d\n", marker, i, d.FrameName(i), file, line)
+		}
+	case "f", "frame":
+		n, err := strconv.Atoi(arg)
+		if err != nil || d.Frame(n) == nil {
+			fmt.Fprintf(c.out, "No frame %s\n", arg)
+			break
+		}
+		c.frame = n
+		file, line := d.FrameLocation(n)
+		fmt.Fprintf(c.out, "#%d  %s at %s:%d\n", n, d.FrameName(n), file, line)
+	case "l", "list":
+		file, line := d.FrameLocation(c.frame)
+		c.ShowSource(file, line, 5)
+
+	case "h", "help":
+		for _, h := range debugConsoleHelp {
+			fmt.Fprintf(c.out, "  %-20s %s\n", h.Name, h.Help)
+		}
+	default:
+		fmt.Fprintf(c.out, "Unknown command '%s'. Type help for the list of commands\n", cmd)
+	}
+	return false
+}
+
+// Breakpoints are given as file:line, or just line for the current file
+func (c *DebugConsole) ParseLocation(d *Debugger, arg string) (string, int, error) {
+	file, _ := d.FrameLocation(c.frame)
+	if file == "" {
+		file = d.MainFile
+	}
+	lineText := arg
+	if i := strings.LastIndexByte(arg, ':'); i != -1 {
+		file = arg[:i]
+		lineText = arg[i+1:]
+	}
+	line, err := strconv.Atoi(strings.TrimSpace(lineText))
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("Expected [file:]line but got '%s'", arg)
+	}
+	return file, line, nil
+}
+
+func (c *DebugConsole) ShowVariables(vars []DebugVariable) {
+	if len(vars) == 0 {
+		fmt.Fprintln(c.out, "None")
+		return
+	}
+	sorted := append([]DebugVariable(nil), vars...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, v := range sorted {
+		fmt.Fprintf(c.out, "  %s = %s\n", v.Name, DebugValue(v.Value))
+	}
+}
+
+func (c *DebugConsole) ShowWatches(d *Debugger) {
+	for i, expr := range d.Watches {
+		val, err := d.Evaluate(c.frame, expr)
+		if err != nil {
+			fmt.Fprintf(c.out, "  %d: %s: %s\n", i+1, expr, err)
+			continue
+		}
+		fmt.Fprintf(c.out, "  %d: %s = %s\n", i+1, expr, DebugValue(val))
+	}
+}
+
+func (c *DebugConsole) ShowSourceLine(file string, line int) {
+	c.ShowSource(file, line, 0)
+}
+
+func (c *DebugConsole) ShowSource(file string, line int, around int) {
+	lines := debugSourceLines(file)
+	for n := line - around; n <= line+around; n++ {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		fmt.Fprintf(c.out, "%s%4d  %s\n", marker, n, lines[n-1])
+	}
+}
+
+var debugSources = make(map[string][]string)
+
+func debugSourceLines(file string) []string {
+	if lines, ok := debugSources[file]; ok {
+		return lines
+	}
+	var lines []string
+	if data, err := ioutil.ReadFile(file); err == nil {
+		lines = strings.Split(string(data), "\n")
+	}
+	debugSources[file] = lines
+	return lines
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+/* ---------------------------------------------------------------------------
+Files. A file is opened in one of a handful of modes and read or written a
+line or a number of bytes at a time. Reads and writes share a position, so
+a file opened for both can be read up to a point and written from there.
+------------------------------------------------------------------------------*/
+
+type ObjFile struct {
+	Path   string
+	Mode   string
+	file   *os.File
+	reader *bufio.Reader
+	writer *bufio.Writer
+	flags  int
+	lock   sync.Mutex // Threads can share a file
+}
+
+// The files a program has open, shared by all of its threads so that they
+// can be closed when the program ends
+type OpenFiles struct {
+	lock  sync.Mutex
+	files []*ObjFile
+}
+
+func (o *OpenFiles) Add(f *ObjFile) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.files = append(o.files, f)
+}
+
+// Closes every file and gives back the ones that couldn't be closed cleanly
+func (o *OpenFiles) CloseAll() map[*ObjFile]error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	failed := make(map[*ObjFile]error)
+	for _, f := range o.files {
+		if err := f.Close(); err != nil {
+			failed[f] = err
+		}
+	}
+	o.files = nil
+	return failed
+}
+
+// The modes a file can be opened in, with the short name of each
+var FileModes = map[string]int{
+	"r":      os.O_RDONLY,
+	"read":   os.O_RDONLY,
+	"w":      os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"write":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"a":      os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"append": os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"c":      os.O_RDWR | os.O_CREATE | os.O_EXCL, // The file mustn't be there already
+	"create": os.O_RDWR | os.O_CREATE | os.O_EXCL,
+	"rw":     os.O_RDWR | os.O_CREATE,
+}
+
+// Interface functions
+func (o *ObjFile) ShowValue() string    { return o.Path }
+func (o *ObjFile) Type() ValueType      { return VAL_FILE }
+func (o *ObjFile) ToBytes() []byte      { return []byte(o.Path) }
+func (o *ObjFile) ToValue() interface{} { return o }
+func (o *ObjFile) Print() string {
+	return "<file:" + o.Path + ">"
+}
+
+func OpenFileMode(path string, mode string) (*ObjFile, error) {
+	flags, ok := FileModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("'%s' isn't a mode a file can be opened in", mode)
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjFile{
+		Path:   path,
+		Mode:   mode,
+		file:   file,
+		reader: bufio.NewReader(file),
+		writer: bufio.NewWriter(file),
+		flags:  flags,
+	}, nil
+}
+
+func (o *ObjFile) IsOpen() bool {
+	return o.file != nil
+}
+
+func (o *ObjFile) CanRead() bool {
+	return o.flags&os.O_WRONLY == 0
+}
+
+func (o *ObjFile) CanWrite() bool {
+	return o.flags&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// Anything written goes out before reading, so what's read is up to date
+func (o *ObjFile) startRead() error {
+	if !o.CanRead() {
+		return fmt.Errorf("the file was opened for writing only")
+	}
+	return o.writer.Flush()
+}
+
+// What was read ahead into the buffer gets handed back before writing, so
+// the write lands right after what was last read
+func (o *ObjFile) startWrite() error {
+	if !o.CanWrite() {
+		return fmt.Errorf("the file was opened for reading only")
+	}
+	if buffered := o.reader.Buffered(); buffered > 0 {
+		if _, err := o.file.Seek(int64(-buffered), io.SeekCurrent); err != nil {
+			return err
+		}
+		o.reader.Reset(o.file)
+	}
+	return nil
+}
+
+// The next line without its line break, and false once there are no more
+func (o *ObjFile) ReadLine() (string, bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.startRead(); err != nil {
+		return "", false, err
+	}
+	line, err := o.reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+	} else if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), true, nil
+}
+
+// Up to the given number of bytes, fewer at the end of the file, and false
+// once there's nothing left
+func (o *ObjFile) Read(count int) (string, bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.startRead(); err != nil {
+		return "", false, err
+	}
+	if count < 0 {
+		return "", false, fmt.Errorf("can't read %d bytes", count)
+	}
+	buf := make([]byte, count)
+	n, err := io.ReadFull(o.reader, buf)
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	return string(buf[:n]), true, nil
+}
+
+// Everything from the current position to the end of the file
+func (o *ObjFile) ReadAll() (string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.startRead(); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(o.reader)
+	return string(data), err
+}
+
+func (o *ObjFile) Write(data string) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.startWrite(); err != nil {
+		return 0, err
+	}
+	return o.writer.WriteString(data)
+}
+
+// Whether the file has nothing more to read
+func (o *ObjFile) EOF() (bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.CanRead() {
+		return false, nil
+	}
+	if err := o.startRead(); err != nil {
+		return false, err
+	}
+	_, err := o.reader.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// Moves to a byte offset from the start of the file
+func (o *ObjFile) SeekTo(offset int64) (int64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.writer.Flush(); err != nil {
+		return 0, err
+	}
+	pos, err := o.file.Seek(offset, io.SeekStart)
+	o.reader.Reset(o.file)
+	return pos, err
+}
+
+// The byte offset that the next read or write starts from
+func (o *ObjFile) Position() (int64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	pos, err := o.file.Seek(0, io.SeekCurrent)
+	return pos - int64(o.reader.Buffered()) + int64(o.writer.Buffered()), err
+}
+
+// Writes out anything still buffered and closes the file. Closing it again
+// does nothing
+func (o *ObjFile) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.IsOpen() {
+		return nil
+	}
+	err := o.writer.Flush()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	o.file = nil
+	return err
+}
+
+// Types of the properties and methods of a file for the compiler
+var FileProperties = map[string]ExpressionData{
+	"path":     scalarString,
+	"mode":     scalarString,
+	"position": {Value: VAL_INTEGER, ObjType: VAR_SCALAR},
+	"eof":      {Value: VAL_BOOL, ObjType: VAR_SCALAR},
+}
+
+var FileMethods = map[string]BuiltinMethod{
+	"readline":  {0, scalarString},
+	"read":      {1, scalarString},
+	"readall":   {0, scalarString},
+	"write":     {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"writeline": {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"seek":      {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"close":     {0, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+	"lines":     {0, ExpressionData{Value: VAL_FILE, ObjType: VAR_FILE}},
+}
+
+// Raises a runtime error for anything that went wrong with the file
+func (v *VM) fileError(f *ObjFile, err error) {
+	if err != nil {
+		v.Error("File '%s': %s", f.Path, err.Error())
+	}
+}
+
+func (v *VM) checkOpen(f *ObjFile) {
+	if !f.IsOpen() {
+		v.Error("File '%s' has been closed", f.Path)
+	}
+}
+
+func (v *VM) FileProperty(f *ObjFile, name string) Obj {
+	switch name {
+	case "path":
+		return ObjString(f.Path)
+	case "mode":
+		return ObjString(f.Mode)
+	}
+	v.checkOpen(f)
+	switch name {
+	case "position":
+		pos, err := f.Position()
+		v.fileError(f, err)
+		return ObjInteger(pos)
+	case "eof":
+		eof, err := f.EOF()
+		v.fileError(f, err)
+		return &ObjBool{Value: eof}
+	}
+	v.Error("File has no property named '%s'", name)
+	return nil
+}
+
+// The next line of the file, or nil at the end of it. Scanning a file goes
+// through its lines this way
+func (v *VM) FileLine(f *ObjFile) (Obj, bool) {
+	v.checkOpen(f)
+	line, ok, err := f.ReadLine()
+	v.fileError(f, err)
+	if !ok {
+		return NULL{}, false
+	}
+	return ObjString(line), true
+}
+
+// Calls a method of a file. The file is on the stack under its arguments
+func (v *VM) FileMethodCall(f *ObjFile, name string, argCount int) {
+	args := make([]Obj, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.Pop()
+	}
+	v.Pop()
+
+	if name == "close" {
+		v.fileError(f, f.Close())
+		v.Push(NULL{})
+		return
+	}
+	v.checkOpen(f)
+
+	switch name {
+	case "readline":
+		line, _ := v.FileLine(f)
+		v.Push(line)
+	case "read":
+		data, ok, err := f.Read(int(args[0].(ObjInteger)))
+		v.fileError(f, err)
+		if !ok {
+			v.Push(NULL{})
+			return
+		}
+		v.Push(ObjString(data))
+	case "readall":
+		data, err := f.ReadAll()
+		v.fileError(f, err)
+		v.Push(ObjString(data))
+	case "write", "writeline":
+		data := args[0].ShowValue()
+		if name == "writeline" {
+			data += "\n"
+		}
+		n, err := f.Write(data)
+		v.fileError(f, err)
+		v.Push(ObjInteger(n))
+	case "seek":
+		pos, err := f.SeekTo(int64(args[0].(ObjInteger)))
+		v.fileError(f, err)
+		v.Push(ObjInteger(pos))
+	case "lines":
+		v.Push(f)
+	default:
+		v.Error("File has no method named '%s'", name)
+	}
+}
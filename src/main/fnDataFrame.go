@@ -38,6 +38,86 @@ var UseDatabase NativeFn = func(vm *VM, args int, argpos int) Obj {
 	return nil
 }
 
+// Dataframe transformations ---------------------------------------
+// Each of these makes a new frame and leaves the one it was given as it was
 
+// Pops the string arguments that come after the frame
+func popStrings(vm *VM, count int) []string {
+	strs := make([]string, count)
+	for i := count - 1; i >= 0; i-- {
+		strs[i] = string(vm.Pop().(ObjString))
+	}
+	return strs
+}
+
+// Keeps the rows the function returns true for
+var DfFilter NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn := vm.Pop().(*ObjClosure)
+	df := vm.Pop().(*ObjDataFrame)
+
+	var rows []int
+	for row := 0; row < df.RowCount; row++ {
+		keep, ok := vm.CallClosure(fn, df.Row(int64(row))).(*ObjBool)
+		if !ok {
+			vm.Error("The function given to filter must return a bool")
+		}
+		if keep.Value {
+			rows = append(rows, row)
+		}
+	}
+	return df.Take(rows)
+}
+
+var DfColumns NativeFn = func(vm *VM, args int, argpos int) Obj {
+	names := popStrings(vm, args-1)
+	df := vm.Pop().(*ObjDataFrame)
+	return df.Select(names)
+}
+
+var DfRename NativeFn = func(vm *VM, args int, argpos int) Obj {
+	if args%2 == 0 {
+		vm.Error("rename takes pairs of the old and the new name of a column")
+	}
+	names := popStrings(vm, args-1)
+	df := vm.Pop().(*ObjDataFrame)
+	return df.Rename(names)
+}
 
+// Adds a column worked out from each row by a function
+var DfMutate NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn := vm.Pop().(*ObjClosure)
+	name := string(vm.Pop().(ObjString))
+	df := vm.Pop().(*ObjDataFrame)
+
+	col := NewDataColumn(name, VAL_NIL)
+	for row := 0; row < df.RowCount; row++ {
+		col.Append(vm.CallClosure(fn, df.Row(int64(row))))
+	}
+	return df.WithColumn(col)
+}
+
+var DfSort NativeFn = func(vm *VM, args int, argpos int) Obj {
+	keys := popStrings(vm, args-1)
+	df := vm.Pop().(*ObjDataFrame)
+	return df.Sort(keys)
+}
+
+var DfGroupBy NativeFn = func(vm *VM, args int, argpos int) Obj {
+	keys := popStrings(vm, args-1)
+	df := vm.Pop().(*ObjDataFrame)
+	return df.GroupBy(keys)
+}
 
+var DfInnerJoin NativeFn = func(vm *VM, args int, argpos int) Obj {
+	key := string(vm.Pop().(ObjString))
+	right := vm.Pop().(*ObjDataFrame)
+	left := vm.Pop().(*ObjDataFrame)
+	return left.Join(right, key, false)
+}
+
+var DfLeftJoin NativeFn = func(vm *VM, args int, argpos int) Obj {
+	key := string(vm.Pop().(ObjString))
+	right := vm.Pop().(*ObjDataFrame)
+	left := vm.Pop().(*ObjDataFrame)
+	return left.Join(right, key, true)
+}
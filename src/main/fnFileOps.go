@@ -1,45 +1,104 @@
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"os"
+	"unicode/utf8"
 )
 
 // File operations ----------------------------------------------
+// openfile(path, <mode>) opens a file for reading unless it's given one of
+// the other modes in FileModes
 var OpenFile NativeFn = func(vm *VM, args int, argpos int) Obj {
-	fileName := string(vm.Pop().(ObjString))
-	file, err := os.Open(fileName)
+	mode := "r"
+	if args > 1 {
+		mode = string(vm.Pop().(ObjString))
+	}
+	path := string(vm.Pop().(ObjString))
+
+	file, err := OpenFileMode(path, mode)
 	if err != nil {
-		log.Panicf("Error opening file '%s'", fileName)
+		vm.Error("Can't open '%s': %s", path, err.Error())
 	}
+	vm.Files.Add(file)
+	return file
+}
 
-	class := &ObjClass{
-		Fields: make(map[string]Obj),
+// Delimited files ----------------------------------------------
+// readcsv(path, <options>) and writecsv(table, path, <options>). The options
+// are a list of strings: "delimiter" and "quote" are single characters, with
+// "tab" for a tab, and "header" is "true", "false" or "auto"
+
+var ReadCsvFile NativeFn = func(vm *VM, args int, argpos int) Obj {
+	options := DefaultCsvOptions
+	if args > 1 {
+		options = vm.CsvOptions(vm.Pop().(*ObjList))
 	}
-	// Load some properties
-	class.Fields["position"] = ObjInteger(0)
+	path := string(vm.Pop().(ObjString))
 
-	// Build the native methods here ************************
+	df, err := ReadCsv(path, options)
+	if err != nil {
+		vm.Error("Can't read '%s': %s", path, err.Error())
+	}
+	return df
+}
 
-	// read(<start:int>, <bytes:int>) returns []bytes
+// Returns the number of rows written
+var WriteCsvFile NativeFn = func(vm *VM, args int, argpos int) Obj {
+	options := DefaultCsvOptions
+	if args > 2 {
+		options = vm.CsvOptions(vm.Pop().(*ObjList))
+	}
+	path := string(vm.Pop().(ObjString))
+	df := vm.Pop().(*ObjDataFrame)
 
-	var fnFread NativeFn = func(vm *VM, args int, argpos int) Obj {
-		file, _ := ioutil.ReadFile(fileName)
-		return ObjString(string(file))
+	rows, err := df.WriteCsv(path, options)
+	if err != nil {
+		vm.Error("Can't write '%s': %s", path, err.Error())
 	}
-	class.Fields["read"] = FuncToNative(&fnFread)
+	return ObjInteger(rows)
+}
 
-	// readall: Returns the full contents of the file
-	var fnFreadAll NativeFn = func(vm *VM, args int, argpos int) Obj {
-		file, err := ioutil.ReadFile(file.Name())
-		if err != nil {
-			log.Panicf("Error reading file '%s'", fileName)
+// Reads the options of readcsv and writecsv out of their list
+func (v *VM) CsvOptions(list *ObjList) CsvOptions {
+	options := DefaultCsvOptions
+	option := func(name string) (string, bool) {
+		val, ok := list.List[ObjString(name).HashValue()]
+		if !ok {
+			return "", false
 		}
-		return ObjString(file)
+		str, ok := val.(ObjString)
+		if !ok {
+			v.Error("The '%s' option must be a string", name)
+		}
+		return string(str), true
+	}
+	char := func(name string, val string) rune {
+		if val == "tab" || val == `\t` {
+			return '\t'
+		}
+		if utf8.RuneCountInString(val) != 1 {
+			v.Error("The '%s' option must be a single character", name)
+		}
+		r, _ := utf8.DecodeRuneInString(val)
+		return r
 	}
-	class.Fields["readall"] = FuncToNative(&fnFreadAll)
-
-	return class
 
+	if val, ok := option("delimiter"); ok {
+		options.Delimiter = char("delimiter", val)
+	}
+	if val, ok := option("quote"); ok {
+		options.Quote = char("quote", val)
+	}
+	if val, ok := option("header"); ok {
+		switch val {
+		case "true":
+			options.Header = CSV_HEADER_YES
+		case "false":
+			options.Header = CSV_HEADER_NO
+		case "auto":
+			options.Header = CSV_HEADER_AUTO
+		default:
+			v.Error("The 'header' option must be \"true\", \"false\" or \"auto\"")
+		}
+	}
+	return options
 }
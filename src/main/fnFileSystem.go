@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Filesystem ---------------------------------------------------
+// The fs natives work on whole files and directories. Anything that goes
+// wrong is a runtime error, apart from the checks exists and isdir make
+
+func StringArray(items []string) *ObjArray {
+	elements := make([]Obj, len(items))
+	for i, item := range items {
+		elements[i] = ObjString(item)
+	}
+	return &ObjArray{
+		ElementCount: len(items),
+		ElementTypes: VAL_STRING,
+		Elements:     elements,
+		DimCount:     1,
+		Dimensions:   []int{len(items)},
+	}
+}
+
+// fs.listdir(dir) gives back the names of the entries of a directory, sorted
+var FsListDir NativeFn = func(vm *VM, args int, argpos int) Obj {
+	dir := string(vm.Pop().(ObjString))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		vm.Error("Can't list '%s': %s", dir, err.Error())
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return StringArray(names)
+}
+
+// fs.glob(pattern) gives back the paths that match a pattern such as
+// "data/*.csv", sorted
+var FsGlob NativeFn = func(vm *VM, args int, argpos int) Obj {
+	pattern := string(vm.Pop().(ObjString))
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		vm.Error("Bad pattern '%s': %s", pattern, err.Error())
+	}
+	sort.Strings(paths)
+	return StringArray(paths)
+}
+
+var FsExists NativeFn = func(vm *VM, args int, argpos int) Obj {
+	_, err := os.Stat(string(vm.Pop().(ObjString)))
+	return &ObjBool{Value: err == nil}
+}
+
+var FsIsDir NativeFn = func(vm *VM, args int, argpos int) Obj {
+	info, err := os.Stat(string(vm.Pop().(ObjString)))
+	return &ObjBool{Value: err == nil && info.IsDir()}
+}
+
+// fs.mkdir(dir) makes the directory along with any parents it's missing
+var FsMkdir NativeFn = func(vm *VM, args int, argpos int) Obj {
+	dir := string(vm.Pop().(ObjString))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		vm.Error("Can't make directory '%s': %s", dir, err.Error())
+	}
+	return nil
+}
+
+// fs.remove(path) removes a file or an empty directory
+var FsRemove NativeFn = func(vm *VM, args int, argpos int) Obj {
+	path := string(vm.Pop().(ObjString))
+	if err := os.Remove(path); err != nil {
+		vm.Error("Can't remove '%s': %s", path, err.Error())
+	}
+	return nil
+}
+
+// fs.rename(from, to) moves a file or directory, replacing a file already at to
+var FsRename NativeFn = func(vm *VM, args int, argpos int) Obj {
+	to := string(vm.Pop().(ObjString))
+	from := string(vm.Pop().(ObjString))
+	if err := os.Rename(from, to); err != nil {
+		vm.Error("Can't rename '%s' to '%s': %s", from, to, err.Error())
+	}
+	return nil
+}
+
+// fs.copy(from, to) copies a file and gives back the number of bytes copied
+var FsCopy NativeFn = func(vm *VM, args int, argpos int) Obj {
+	to := string(vm.Pop().(ObjString))
+	from := string(vm.Pop().(ObjString))
+	bytes, err := CopyFile(from, to)
+	if err != nil {
+		vm.Error("Can't copy '%s' to '%s': %s", from, to, err.Error())
+	}
+	return ObjInteger(bytes)
+}
+
+// The copy gets the permissions of the original
+func CopyFile(from string, to string) (int64, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	bytes, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return bytes, err
+}
+
+// fs.stat(path) gives back a list of the name, size, mtime (in seconds since
+// 1970), isdir and mode of a file
+var FsStat NativeFn = func(vm *VM, args int, argpos int) Obj {
+	path := string(vm.Pop().(ObjString))
+	info, err := os.Stat(path)
+	if err != nil {
+		vm.Error("Can't stat '%s': %s", path, err.Error())
+	}
+	list := new(ObjList)
+	list.Init(VAL_STRING, 0)
+	list.HValueType = ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	list.AddNew(ObjString("name"), ObjString(info.Name()))
+	list.AddNew(ObjString("size"), ObjInteger(info.Size()))
+	list.AddNew(ObjString("mtime"), ObjInteger(info.ModTime().Unix()))
+	list.AddNew(ObjString("isdir"), &ObjBool{Value: info.IsDir()})
+	list.AddNew(ObjString("mode"), ObjString(info.Mode().String()))
+	list.ElementCount = len(list.Keys)
+	return list
+}
+
+// fs.tempdir() makes a new empty directory under the system's temporary
+// directory and gives back its path. It's left for the program to remove
+var FsTempDir NativeFn = func(vm *VM, args int, argpos int) Obj {
+	dir, err := ioutil.TempDir("", "coyote")
+	if err != nil {
+		vm.Error("Can't make a temporary directory: %s", err.Error())
+	}
+	return ObjString(dir)
+}
+
+// Paths --------------------------------------------------------
+
+// path.join(parts...) joins the parts with the separator of the system
+var PathJoin NativeFn = func(vm *VM, args int, argpos int) Obj {
+	parts := popStrings(vm, args)
+	return ObjString(filepath.Join(parts...))
+}
+
+var PathBase NativeFn = func(vm *VM, args int, argpos int) Obj {
+	return ObjString(filepath.Base(string(vm.Pop().(ObjString))))
+}
+
+var PathDir NativeFn = func(vm *VM, args int, argpos int) Obj {
+	return ObjString(filepath.Dir(string(vm.Pop().(ObjString))))
+}
+
+// path.ext(path) gives back the extension with its dot, or "" if there isn't one
+var PathExt NativeFn = func(vm *VM, args int, argpos int) Obj {
+	return ObjString(filepath.Ext(string(vm.Pop().(ObjString))))
+}
@@ -0,0 +1,103 @@
+package main
+
+import "net"
+
+// HTTP ---------------------------------------------------------
+// Each of the requests gives back a list of the status, headers and body of
+// the response. The headers to send are a list, and can be left out
+
+// http.get(url, <headers>)
+var HttpGet NativeFn = func(vm *VM, args int, argpos int) Obj {
+	var headers *ObjList
+	if args > 1 {
+		headers = vm.Pop().(*ObjList)
+	}
+	url := string(vm.Pop().(ObjString))
+	return vm.HttpRequest("GET", url, NULL{}, headers)
+}
+
+// http.post(url, body, <headers>)
+var HttpPost NativeFn = func(vm *VM, args int, argpos int) Obj {
+	var headers *ObjList
+	if args > 2 {
+		headers = vm.Pop().(*ObjList)
+	}
+	body := vm.Pop()
+	url := string(vm.Pop().(ObjString))
+	return vm.HttpRequest("POST", url, body, headers)
+}
+
+// http.request(method, url, <body>, <headers>)
+var HttpRequestNative NativeFn = func(vm *VM, args int, argpos int) Obj {
+	var headers *ObjList
+	var body Obj = NULL{}
+	if args > 3 {
+		headers = vm.Pop().(*ObjList)
+	}
+	if args > 2 {
+		body = vm.Pop()
+	}
+	url := string(vm.Pop().(ObjString))
+	method := string(vm.Pop().(ObjString))
+	return vm.HttpRequest(method, url, body, headers)
+}
+
+// http.json(r) decodes the body of a response or a request as JSON
+var HttpJson NativeFn = func(vm *VM, args int, argpos int) Obj {
+	r := vm.Pop().(*ObjList)
+	body, ok := listValue(r, "body").(ObjString)
+	if !ok {
+		vm.Error("http.json needs a response or a request with a body")
+	}
+	val, err := JsonDecode([]byte(body))
+	if err != nil {
+		vm.Error("Invalid JSON: %s", err.Error())
+	}
+	return val
+}
+
+// http.response(status, body, <headers>) makes the response a handler gives
+// back. The body can be anything http.post can send
+var HttpResponse NativeFn = func(vm *VM, args int, argpos int) Obj {
+	var headers Obj = NewKeyedList()
+	if args > 2 {
+		headers = vm.Pop()
+	}
+	body := vm.Pop()
+	status := vm.Pop()
+
+	response := NewKeyedList()
+	addKey(response, "status", status)
+	addKey(response, "headers", headers)
+	addKey(response, "body", body)
+	return response
+}
+
+// http.serve(addr, handler) answers requests on a "host:port", or on a
+// listener made by net.listen, with what the handler gives back. It returns
+// once the listener is closed
+var HttpServe NativeFn = func(vm *VM, args int, argpos int) Obj {
+	handler, ok := vm.Pop().(*ObjClosure)
+	if !ok {
+		vm.Error("Requests have to be handled by a function")
+	}
+
+	var listener net.Listener
+	switch on := vm.Pop().(type) {
+	case ObjString:
+		l, err := net.Listen("tcp", string(on))
+		if err != nil {
+			vm.Error("Can't listen on '%s': %s", string(on), err.Error())
+		}
+		listener = l
+	case *ObjListener:
+		listener = on.listener
+	default:
+		vm.Error("http.serve needs an address or a listener to serve on")
+	}
+
+	if err := vm.Serve(listener, handler); err != nil {
+		vm.Error("Serving on '%s' failed: %s", listener.Addr().String(), err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// JSON ---------------------------------------------------------
+// What a decoded value is depends on the JSON, so the compiler leaves its
+// type to be checked when the program runs
+
+var JsonDecodeString NativeFn = func(vm *VM, args int, argpos int) Obj {
+	data := string(vm.Pop().(ObjString))
+	val, err := JsonDecode([]byte(data))
+	if err != nil {
+		vm.Error("Invalid JSON: %s", err.Error())
+	}
+	return val
+}
+
+// jsonencode(value, <pretty:bool>)
+var JsonEncodeValue NativeFn = func(vm *VM, args int, argpos int) Obj {
+	pretty := false
+	if args > 1 {
+		pretty = vm.Pop().(*ObjBool).Value
+	}
+	data, err := JsonEncode(vm.Pop(), pretty)
+	if err != nil {
+		vm.Error("Can't encode JSON: %s", err.Error())
+	}
+	return ObjString(data)
+}
+
+var ReadJsonFile NativeFn = func(vm *VM, args int, argpos int) Obj {
+	path := string(vm.Pop().(ObjString))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		vm.Error("Can't read '%s': %s", path, err.Error())
+	}
+	val, err := JsonDecode(data)
+	if err != nil {
+		vm.Error("Invalid JSON in '%s': %s", path, err.Error())
+	}
+	return val
+}
+
+// writejson(value, path, <pretty:bool>)
+var WriteJsonFile NativeFn = func(vm *VM, args int, argpos int) Obj {
+	pretty := false
+	if args > 2 {
+		pretty = vm.Pop().(*ObjBool).Value
+	}
+	path := string(vm.Pop().(ObjString))
+	data, err := JsonEncode(vm.Pop(), pretty)
+	if err != nil {
+		vm.Error("Can't encode JSON: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		vm.Error("Can't write '%s': %s", path, err.Error())
+	}
+	return nil
+}
+
+// readjsonl(path, func(value)) calls the function with the value on each line
+// of a JSON lines file as it's read, so the file can be any size. Returns the
+// number of lines read
+var ReadJsonLines NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn := vm.Pop().(*ObjClosure)
+	path := string(vm.Pop().(ObjString))
+	file, err := os.Open(path)
+	if err != nil {
+		vm.Error("Can't read '%s': %s", path, err.Error())
+	}
+	defer file.Close()
+
+	reader := NewJsonLinesReader(file)
+	count := 0
+	for {
+		val, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			vm.Error("Invalid JSON in '%s': %s", path, err.Error())
+		}
+		vm.CallClosure(fn, val)
+		count++
+	}
+	return ObjInteger(count)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// TCP ----------------------------------------------------------
+// net.dial(addr, <seconds>) connects to a "host:port", giving up after the
+// number of seconds if it's given
+var NetDial NativeFn = func(vm *VM, args int, argpos int) Obj {
+	var timeout time.Duration
+	if args > 1 {
+		timeout = time.Duration(vm.seconds(vm.Pop()) * float64(time.Second))
+	}
+	addr := string(vm.Pop().(ObjString))
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		vm.Error("Can't connect to '%s': %s", addr, err.Error())
+	}
+	return NewConnection(conn)
+}
+
+// net.listen(addr) listens for connections on a "host:port". Port 0 picks
+// a free port, which the listener's addr gives back
+var NetListen NativeFn = func(vm *VM, args int, argpos int) Obj {
+	addr := string(vm.Pop().(ObjString))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		vm.Error("Can't listen on '%s': %s", addr, err.Error())
+	}
+	return &ObjListener{listener: listener}
+}
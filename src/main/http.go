@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* ---------------------------------------------------------------------------
+HTTP. Requests and responses are lists so that a script reads them with '$'.
+A response has a status, headers and a body, and a request handed to a
+server's handler has a method, a path, a query, headers and a body. A handler
+makes its response with http.response, or gives back the body of a 200. A '-' can't follow a '$', so header names are given in lower
+case with '_' in place of '-', as in content_type, and go back the other way
+when they're sent.
+
+A body that isn't a string is sent as JSON. http.serve handles each request
+on a VM of its own the way a spawned thread runs, with its own copies of the
+globals and of what the handler captured, so requests can be handled at the
+same time.
+------------------------------------------------------------------------------*/
+
+// Requests the client makes give up after this long
+var HttpClient = &http.Client{Timeout: 60 * time.Second}
+
+// A list keyed by string that can hold values of any type
+func NewKeyedList() *ObjList {
+	list := new(ObjList)
+	list.Init(VAL_STRING, 0)
+	list.HValueType = ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	return list
+}
+
+func addKey(list *ObjList, key string, val Obj) {
+	list.AddNew(ObjString(key), val)
+	list.ElementCount = len(list.Keys)
+}
+
+// The name a header goes by in a list, and the other way round
+func HeaderKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+func HeaderName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Headers as a list, sorted by name. A header given more than once has its
+// values joined by commas
+func HeaderList(header http.Header) *ObjList {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := NewKeyedList()
+	for _, name := range names {
+		addKey(list, HeaderKey(name), ObjString(strings.Join(header[name], ", ")))
+	}
+	return list
+}
+
+// Sets the headers in a list. The values can be of any type
+func SetHeaders(header http.Header, list *ObjList) {
+	if list == nil {
+		return
+	}
+	for _, key := range list.Keys {
+		header.Set(HeaderName(key.ShowValue()), list.List[ListKey(key)].ShowValue())
+	}
+}
+
+// What gets sent for a body and its content type. A string goes as it is,
+// nil or an empty string is no body and anything else is JSON
+func HttpBody(body Obj) ([]byte, string, error) {
+	switch b := body.(type) {
+	case nil, NULL:
+		return nil, "", nil
+	case ObjString:
+		if b == "" {
+			return nil, "", nil
+		}
+		return []byte(b), "text/plain; charset=utf-8", nil
+	}
+	data, err := JsonEncode(body, false)
+	return data, "application/json", err
+}
+
+// The value of a key of a list, or nil if the list doesn't have it
+func listValue(list *ObjList, key string) Obj {
+	if val, ok := list.List[ListKey(ObjString(key))]; ok {
+		return val
+	}
+	return NULL{}
+}
+
+/* ---------------------------------------------------------------------------
+Client
+------------------------------------------------------------------------------*/
+
+// Sends a request and gives back the response as a list of its status,
+// headers and body
+func (v *VM) HttpRequest(method string, url string, body Obj, headers *ObjList) *ObjList {
+	data, contentType, err := HttpBody(body)
+	if err != nil {
+		v.Error("Can't encode the body of %s %s as JSON: %s", method, url, err.Error())
+	}
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), url, reader)
+	if err != nil {
+		v.Error("Can't make the request %s %s: %s", method, url, err.Error())
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	SetHeaders(req.Header, headers)
+
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		v.Error("%s %s failed: %s", strings.ToUpper(method), url, err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		v.Error("Can't read the response to %s %s: %s", strings.ToUpper(method), url, err.Error())
+	}
+
+	response := NewKeyedList()
+	addKey(response, "status", ObjInteger(resp.StatusCode))
+	addKey(response, "headers", HeaderList(resp.Header))
+	addKey(response, "body", ObjString(respBody))
+	return response
+}
+
+/* ---------------------------------------------------------------------------
+Server
+------------------------------------------------------------------------------*/
+
+// Answers requests with the handler until the listener is closed
+func (v *VM) Serve(listener net.Listener, handler *ObjClosure) error {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v.ServeRequest(handler, w, r)
+		}),
+	}
+	err := server.Serve(listener)
+	// Clients keep their connections open between requests, and those would
+	// go on being answered after the listener has closed. Requests already
+	// being handled get to finish
+	server.Shutdown(context.Background())
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// The request a handler is given
+func RequestList(r *http.Request, body []byte) *ObjList {
+	query := NewKeyedList()
+	values := r.URL.Query()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		addKey(query, key, ObjString(values.Get(key)))
+	}
+
+	request := NewKeyedList()
+	addKey(request, "method", ObjString(r.Method))
+	addKey(request, "path", ObjString(r.URL.Path))
+	addKey(request, "query", query)
+	addKey(request, "headers", HeaderList(r.Header))
+	addKey(request, "body", ObjString(body))
+	return request
+}
+
+// Runs the handler for one request on a VM of its own. A runtime error in
+// the handler is reported and answered with a 500
+func (v *VM) ServeRequest(handler *ObjClosure, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	copies := make(map[Obj]Obj)
+	vm := v.NewThreadVM(copies)
+	closure := ThreadCopy(handler, copies).(*ObjClosure)
+
+	defer func() {
+		if r := recover(); r != nil {
+			rtErr := vm.ToRuntimeError(r)
+			rtErr.Print()
+			http.Error(w, rtErr.Message, http.StatusInternalServerError)
+		}
+	}()
+	result := vm.CallClosure(closure, RequestList(r, body))
+	vm.WriteResponse(w, result)
+}
+
+// Sends what a handler gave back. A list is a response with a status,
+// headers and a body, any of which can be left out. Anything else is the
+// body of a 200
+func (v *VM) WriteResponse(w http.ResponseWriter, result Obj) {
+	status := http.StatusOK
+	var headers *ObjList
+	body := result
+	if list, ok := result.(*ObjList); ok {
+		if s, ok := listValue(list, "status").(ObjInteger); ok {
+			status = int(s)
+		}
+		headers, _ = listValue(list, "headers").(*ObjList)
+		body = listValue(list, "body")
+	}
+
+	data, contentType, err := HttpBody(body)
+	if err != nil {
+		v.Error("Can't encode the response as JSON: %s", err.Error())
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	SetHeaders(w.Header(), headers)
+	w.WriteHeader(status)
+	w.Write(data)
+}
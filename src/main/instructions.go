@@ -170,12 +170,23 @@ func (i *Instructions) ToByteCode() []byte {
 }
 
 func (i *Instructions) ToChunk() *Chunk {
-	return &Chunk{
-		Code:           i.ToByteCode(),
+	chunk := &Chunk{
 		Count:          i.BytePosition,
+		Lines:          make([]LineRun, 0),
 		Constants:      i.Constants,
 		ConstantsCount: int(i.ConstantsCount),
 	}
+
+	// Build the code and the line table in the same pass so that the VM can
+	// find its way back to the source from any byte in the code
+	code := make([]byte, 0)
+	for j := 0; j < i.Count; j++ {
+		chunk.AddLine(len(code), i.OpCode[j].Line+1)
+		code = append(code, i.OpCode[j].ToBytes()...)
+	}
+	chunk.Code = code
+
+	return chunk
 }
 
 func (i *Instructions) Display() {
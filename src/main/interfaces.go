@@ -15,6 +15,11 @@ const (
 	VAR_TABLE
 	VAR_RANGE
 	VAR_OBJECT
+	VAR_FILE
+	VAR_CHANNEL
+	VAR_THREAD
+	VAR_CONNECTION
+	VAR_LISTENER
 )
 
 var VarTypeLabel = map[VarType]string{
@@ -30,6 +35,11 @@ var VarTypeLabel = map[VarType]string{
 	VAR_TABLE: 	  "Table",
 	VAR_RANGE:	  "Range",
 	VAR_OBJECT:   "Object",
+	VAR_FILE:     "File",
+	VAR_CHANNEL:  "Channel",
+	VAR_THREAD:   "Thread",
+	VAR_CONNECTION: "Connection",
+	VAR_LISTENER: "Listener",
 
 }
 
@@ -61,6 +71,11 @@ const (
 	VAL_TABLE
 	VAL_RANGE
 	VAL_OBJECT
+	VAL_FILE
+	VAL_CHANNEL
+	VAL_THREAD
+	VAL_CONNECTION
+	VAL_LISTENER
 )
 
 var ValueTypeLabel = map[ValueType]string{
@@ -89,6 +104,11 @@ var ValueTypeLabel = map[ValueType]string{
 	VAL_TABLE:      "Table" ,
 	VAL_RANGE:      "Range" ,
 	VAL_OBJECT:     "Object" ,
+	VAL_FILE:       "File",
+	VAL_CHANNEL:    "Channel",
+	VAL_THREAD:     "Thread",
+	VAL_CONNECTION: "Connection",
+	VAL_LISTENER:   "Listener",
 }
 
 type FunctionType byte
@@ -108,6 +128,12 @@ const (
 	PROTECTED
 )
 
+var AccessorLabel = map[AccessorType]string{
+	PUBLIC:    "public",
+	PRIVATE:   "private",
+	PROTECTED: "protected",
+}
+
 type ClassComponentType byte
 
 const (
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+/* ---------------------------------------------------------------------------
+JSON. Objects become lists keyed by string, arrays become one dimensional
+arrays, numbers without a fraction or exponent become ints and the rest of
+the numbers become floats. The keys of an object keep the order they were
+written in, both ways.
+
+Going the other way, lists, arrays, tables, enums and instances of classes
+can all be encoded. A table is an array of its rows and an instance is an
+object of its fields, leaving out its methods.
+------------------------------------------------------------------------------*/
+
+// Decodes a single JSON value. Anything after it other than white space is
+// an error
+func JsonDecode(data []byte) (Obj, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	val, err := jsonValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return val, nil
+}
+
+func jsonValue(dec *json.Decoder) (Obj, error) {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			return jsonObject(dec)
+		}
+		return jsonArray(dec)
+	case string:
+		return ObjString(t), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			return ObjInteger(i), nil
+		}
+		f, err := strconv.ParseFloat(string(t), 64)
+		if err != nil {
+			return nil, err
+		}
+		return ObjFloat(f), nil
+	case bool:
+		return &ObjBool{Value: t}, nil
+	case nil:
+		return NULL{}, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+func jsonObject(dec *json.Decoder) (Obj, error) {
+	list := new(ObjList)
+	list.Init(VAL_STRING, 0)
+	list.HValueType = ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		val, err := jsonValue(dec)
+		if err != nil {
+			return nil, err
+		}
+		list.AddNew(ObjString(key.(string)), val)
+		list.ElementCount++
+	}
+	// The closing brace
+	_, err := dec.Token()
+	return list, err
+}
+
+// The elements of an array all of the same type make an array of that type
+func jsonArray(dec *json.Decoder) (Obj, error) {
+	var elements []Obj
+	elemType := VAL_NIL
+	for dec.More() {
+		val, err := jsonValue(dec)
+		if err != nil {
+			return nil, err
+		}
+		if len(elements) == 0 {
+			elemType = val.Type()
+		} else if val.Type() != elemType {
+			elemType = VAL_NIL
+		}
+		elements = append(elements, val)
+	}
+	// The closing bracket
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if elements == nil {
+		elements = []Obj{}
+	}
+	return &ObjArray{
+		ElementCount: len(elements),
+		ElementTypes: elemType,
+		Elements:     elements,
+		DimCount:     1,
+		Dimensions:   []int{len(elements)},
+	}, nil
+}
+
+// Encodes a value as JSON, indented two spaces a level if it's to be pretty
+func JsonEncode(val Obj, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeJson(&buf, val); err != nil {
+		return nil, err
+	}
+	if !pretty {
+		return buf.Bytes(), nil
+	}
+	var out bytes.Buffer
+	err := json.Indent(&out, buf.Bytes(), "", "  ")
+	return out.Bytes(), err
+}
+
+func writeJson(buf *bytes.Buffer, val Obj) error {
+	switch v := val.(type) {
+	case nil, NULL:
+		buf.WriteString("null")
+	case ObjInteger:
+		buf.WriteString(strconv.FormatInt(int64(v), 10))
+	case ObjFloat:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("%v can't be encoded as JSON", f)
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case ObjByte:
+		buf.WriteString(strconv.Itoa(int(v.Value)))
+	case *ObjBool:
+		buf.WriteString(strconv.FormatBool(v.Value))
+	case ObjString:
+		writeJsonString(buf, string(v))
+	case *ObjList:
+		buf.WriteByte('{')
+		for i, key := range v.Keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJsonString(buf, fmt.Sprintf("%v", key.ToValue()))
+			buf.WriteByte(':')
+			if err := writeJson(buf, v.List[ListKey(key)]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case *ObjArray:
+		return writeJsonArray(buf, v, nil)
+	case *ObjDataFrame:
+		buf.WriteByte('[')
+		for row := 0; row < v.RowCount; row++ {
+			if row > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJson(buf, v.Row(int64(row))); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case *ObjEnum:
+		tags := make([]string, 0, len(v.Data))
+		for tag := range v.Data {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return v.Data[tags[i]].Value < v.Data[tags[j]].Value })
+		return writeJsonFields(buf, tags, func(tag string) Obj { return v.Data[tag] })
+	case *ObjInstance:
+		var names []string
+		for name, field := range v.Fields {
+			switch field.(type) {
+			case *ObjClosure, ObjNative, *ObjNative:
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return writeJsonFields(buf, names, func(name string) Obj { return v.Fields[name] })
+	default:
+		return fmt.Errorf("a %s can't be encoded as JSON", ValueTypeLabel[val.Type()])
+	}
+	return nil
+}
+
+func writeJsonFields(buf *bytes.Buffer, names []string, field func(string) Obj) error {
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJsonString(buf, name)
+		buf.WriteByte(':')
+		if err := writeJson(buf, field(name)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// Arrays of more than one dimension become arrays of arrays
+func writeJsonArray(buf *bytes.Buffer, a *ObjArray, indexes []int64) error {
+	size := a.ElementCount
+	if a.DimCount > 1 {
+		size = a.Dimensions[len(indexes)]
+	}
+	buf.WriteByte('[')
+	for i := 0; i < size; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		at := append(indexes, int64(i))
+		var err error
+		if a.DimCount > 1 && len(at) < a.DimCount {
+			err = writeJsonArray(buf, a, at)
+		} else {
+			err = writeJson(buf, a.GetElement(at...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func writeJsonString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode ends with a new line
+	buf.Truncate(buf.Len() - 1)
+}
+
+// Reads a file of JSON lines, one value to a line, without holding more than
+// a line in memory at a time. Blank lines are skipped
+type JsonLinesReader struct {
+	in   *bufio.Reader
+	Line int
+}
+
+func NewJsonLinesReader(in io.Reader) *JsonLinesReader {
+	return &JsonLinesReader{in: bufio.NewReader(in)}
+}
+
+// The value on the next line that isn't blank, or io.EOF at the end of the file
+func (r *JsonLinesReader) Read() (Obj, error) {
+	for {
+		line, err := r.in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		r.Line++
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		val, decodeErr := JsonDecode(line)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("line %d: %s", r.Line, decodeErr.Error())
+		}
+		return val, nil
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ---------------------------------------------------------------------------
+Language server (coyote lsp). Speaks JSON-RPC over stdin and stdout using the
+Language Server Protocol. Every time a document is opened or changed it gets
+compiled with Analyzing set, and the recorded symbols, references and errors
+answer the editor's requests until the next change:
+
+	textDocument/publishDiagnostics  syntax and type errors
+	textDocument/hover               the type of the name under the cursor
+	textDocument/definition          where a global, local or property is declared
+	textDocument/completion          natives, module level names and keywords
+	textDocument/documentSymbol      the functions, classes and enums in the file
+
+Documents are synced in full on every change. LSP positions count UTF-16 code
+units while tokens count bytes, so positions get converted both ways.
+------------------------------------------------------------------------------*/
+
+type lspServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*lspDocument
+	shutdown  bool
+}
+
+type lspDocument struct {
+	URI      string
+	Path     string
+	Text     string
+	Analysis *Analysis
+}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	LSP_PARSE_ERROR      = -32700
+	LSP_METHOD_NOT_FOUND = -32601
+	LSP_INVALID_PARAMS   = -32602
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+// Kinds from the protocol
+const (
+	LSP_SEVERITY_ERROR   = 1
+	LSP_SEVERITY_WARNING = 2
+
+	LSP_SYMBOL_CLASS    = 5
+	LSP_SYMBOL_METHOD   = 6
+	LSP_SYMBOL_PROPERTY = 7
+	LSP_SYMBOL_ENUM     = 10
+	LSP_SYMBOL_FUNCTION = 12
+	LSP_SYMBOL_VARIABLE = 13
+
+	LSP_COMPLETION_METHOD   = 2
+	LSP_COMPLETION_FUNCTION = 3
+	LSP_COMPLETION_VARIABLE = 6
+	LSP_COMPLETION_CLASS    = 7
+	LSP_COMPLETION_PROPERTY = 10
+	LSP_COMPLETION_ENUM     = 13
+	LSP_COMPLETION_KEYWORD  = 14
+)
+
+var lspSymbolKind = map[SymbolKind]int{
+	SYMBOL_VARIABLE:  LSP_SYMBOL_VARIABLE,
+	SYMBOL_PARAMETER: LSP_SYMBOL_VARIABLE,
+	SYMBOL_FUNCTION:  LSP_SYMBOL_FUNCTION,
+	SYMBOL_CLASS:     LSP_SYMBOL_CLASS,
+	SYMBOL_ENUM:      LSP_SYMBOL_ENUM,
+	SYMBOL_PROPERTY:  LSP_SYMBOL_PROPERTY,
+	SYMBOL_METHOD:    LSP_SYMBOL_METHOD,
+}
+
+var lspCompletionKind = map[SymbolKind]int{
+	SYMBOL_VARIABLE:  LSP_COMPLETION_VARIABLE,
+	SYMBOL_PARAMETER: LSP_COMPLETION_VARIABLE,
+	SYMBOL_FUNCTION:  LSP_COMPLETION_FUNCTION,
+	SYMBOL_CLASS:     LSP_COMPLETION_CLASS,
+	SYMBOL_ENUM:      LSP_COMPLETION_ENUM,
+	SYMBOL_PROPERTY:  LSP_COMPLETION_PROPERTY,
+	SYMBOL_METHOD:    LSP_COMPLETION_METHOD,
+}
+
+// Serves one editor until it says exit or closes the connection. Anything
+// that writes to stdout has to be pointed somewhere else before this gets
+// called since stdout is the protocol's
+func ServeLanguageServer(in io.Reader, out io.Writer) int {
+	server := &lspServer{
+		in:        bufio.NewReader(in),
+		out:       out,
+		documents: make(map[string]*lspDocument),
+	}
+	RegisterFunctions()
+
+	for {
+		body, err := server.ReadMessage()
+		if err == io.EOF {
+			return 1
+		}
+		if err != nil {
+			server.Respond(nil, nil, &lspError{Code: LSP_PARSE_ERROR, Message: err.Error()})
+			continue
+		}
+
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			server.Respond(nil, nil, &lspError{Code: LSP_PARSE_ERROR, Message: err.Error()})
+			continue
+		}
+		if req.Method == "exit" {
+			if server.shutdown {
+				return 0
+			}
+			return 1
+		}
+		server.Handle(&req)
+	}
+}
+
+// Messages are a JSON body behind a Content-Length header
+func (s *lspServer) ReadMessage() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length header: %s", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message has no Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *lspServer) WriteMessage(message interface{}) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) Respond(id *json.RawMessage, result interface{}, err *lspError) {
+	s.WriteMessage(lspResponse{JSONRPC: "2.0", ID: id, Result: result, Error: err})
+}
+
+func (s *lspServer) Notify(method string, params interface{}) {
+	s.WriteMessage(lspNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *lspServer) Handle(req *lspRequest) {
+	var result interface{}
+	var err error
+
+	switch req.Method {
+	case "initialize":
+		result = map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // Full
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+			},
+			"serverInfo": map[string]string{"name": "coyote"},
+		}
+	case "shutdown":
+		s.shutdown = true
+	case "textDocument/didOpen":
+		err = s.DidOpen(req.Params)
+	case "textDocument/didChange":
+		err = s.DidChange(req.Params)
+	case "textDocument/didClose":
+		err = s.DidClose(req.Params)
+	case "textDocument/hover":
+		result, err = s.Hover(req.Params)
+	case "textDocument/definition":
+		result, err = s.Definition(req.Params)
+	case "textDocument/completion":
+		result, err = s.Completion(req.Params)
+	case "textDocument/documentSymbol":
+		result, err = s.DocumentSymbols(req.Params)
+	default:
+		// Notifications we don't know about get ignored
+		if req.ID != nil {
+			s.Respond(req.ID, nil, &lspError{Code: LSP_METHOD_NOT_FOUND, Message: "method not found: " + req.Method})
+		}
+		return
+	}
+
+	if req.ID == nil {
+		return
+	}
+	if err != nil {
+		s.Respond(req.ID, nil, &lspError{Code: LSP_INVALID_PARAMS, Message: err.Error()})
+		return
+	}
+	s.Respond(req.ID, result, nil)
+}
+
+/* ---------------------------------------------------------------------------
+Document sync
+------------------------------------------------------------------------------*/
+
+func (s *lspServer) DidOpen(params json.RawMessage) error {
+	var p struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	doc := &lspDocument{
+		URI:  p.TextDocument.URI,
+		Path: uriToPath(p.TextDocument.URI),
+		Text: p.TextDocument.Text,
+	}
+	s.documents[doc.URI] = doc
+	s.Analyze(doc)
+	return nil
+}
+
+func (s *lspServer) DidChange(params json.RawMessage) error {
+	var p struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	doc, err := s.Document(p.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+	if len(p.ContentChanges) == 0 {
+		return nil
+	}
+	doc.Text = p.ContentChanges[len(p.ContentChanges)-1].Text
+	s.Analyze(doc)
+	return nil
+}
+
+func (s *lspServer) DidClose(params json.RawMessage) error {
+	var p struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	delete(s.documents, p.TextDocument.URI)
+	s.Notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         p.TextDocument.URI,
+		"diagnostics": []lspDiagnostic{},
+	})
+	return nil
+}
+
+func (s *lspServer) Document(uri string) (*lspDocument, error) {
+	doc, ok := s.documents[uri]
+	if !ok {
+		return nil, fmt.Errorf("document %s is not open", uri)
+	}
+	return doc, nil
+}
+
+// Compiles the document and publishes the errors found in it
+func (s *lspServer) Analyze(doc *lspDocument) {
+	doc.Analysis = AnalyzeSource(doc.Text, doc.Path)
+
+	diagnostics := []lspDiagnostic{}
+	for _, d := range doc.Analysis.Diagnostics {
+		if d.File != doc.Path {
+			continue
+		}
+		severity := LSP_SEVERITY_ERROR
+		if d.IsWarning {
+			severity = LSP_SEVERITY_WARNING
+		}
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range:    tokenRange(doc.Text, d.Token),
+			Severity: severity,
+			Source:   "coyote",
+			Message:  d.Message,
+		})
+	}
+	s.Notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         doc.URI,
+		"diagnostics": diagnostics,
+	})
+}
+
+/* ---------------------------------------------------------------------------
+Requests
+------------------------------------------------------------------------------*/
+
+// Finds the document and the byte offset a request is about
+func (s *lspServer) DocumentPosition(params json.RawMessage) (*lspDocument, int, error) {
+	var p lspTextDocumentPosition
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, 0, err
+	}
+	doc, err := s.Document(p.TextDocument.URI)
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc, positionToOffset(doc.Text, p.Position), nil
+}
+
+func (s *lspServer) Hover(params json.RawMessage) (interface{}, error) {
+	doc, offset, err := s.DocumentPosition(params)
+	if err != nil {
+		return nil, err
+	}
+	symbol, ref := doc.Analysis.SymbolAt(offset)
+
+	var description string
+	var tok Token
+	switch {
+	case ref != nil:
+		description = ref.Describe()
+		tok = ref.Token
+	case symbol != nil:
+		description = symbol.Describe()
+		tok = symbol.Token
+	default:
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{
+			"kind":  "markdown",
+			"value": "```coyote\n" + description + "\n```",
+		},
+		"range": tokenRange(doc.Text, tok),
+	}, nil
+}
+
+func (s *lspServer) Definition(params json.RawMessage) (interface{}, error) {
+	doc, offset, err := s.DocumentPosition(params)
+	if err != nil {
+		return nil, err
+	}
+	symbol, _ := doc.Analysis.SymbolAt(offset)
+	if symbol == nil {
+		return nil, nil
+	}
+
+	// Symbols from imported modules need the text of their own file
+	text := doc.Text
+	if symbol.File != doc.Path {
+		data, err := ioutil.ReadFile(symbol.File)
+		if err != nil {
+			return nil, nil
+		}
+		text = string(data)
+	}
+	return lspLocation{
+		URI:   pathToURI(symbol.File),
+		Range: tokenRange(text, symbol.Token),
+	}, nil
+}
+
+func (s *lspServer) Completion(params json.RawMessage) (interface{}, error) {
+	doc, _, err := s.DocumentPosition(params)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []lspCompletionItem{}
+	seen := make(map[string]bool)
+	add := func(item lspCompletionItem) {
+		if !seen[item.Label] {
+			seen[item.Label] = true
+			items = append(items, item)
+		}
+	}
+
+	for _, symbol := range doc.Analysis.Symbols {
+		if symbol.File != doc.Path || symbol.IsLocal || symbol.Container != nil {
+			continue
+		}
+		add(lspCompletionItem{
+			Label:  symbol.Name,
+			Kind:   lspCompletionKind[symbol.Kind],
+			Detail: symbol.Describe(),
+		})
+	}
+
+	natives := make([]string, 0, len(FunctionRegister))
+	for name := range FunctionRegister {
+		natives = append(natives, name)
+	}
+	sort.Strings(natives)
+	for _, name := range natives {
+		ref := Reference{Native: FunctionRegister[name]}
+		add(lspCompletionItem{Label: name, Kind: LSP_COMPLETION_FUNCTION, Detail: ref.Describe()})
+	}
+
+	keywords := make([]string, 0)
+	for label := range TokenLabels {
+		if label[0] >= 'a' && label[0] <= 'z' {
+			keywords = append(keywords, label)
+		}
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		add(lspCompletionItem{Label: keyword, Kind: LSP_COMPLETION_KEYWORD})
+	}
+
+	return items, nil
+}
+
+func (s *lspServer) DocumentSymbols(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.Document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	toDocumentSymbol := func(symbol *Symbol) lspDocumentSymbol {
+		r := tokenRange(doc.Text, symbol.Token)
+		return lspDocumentSymbol{
+			Name:           symbol.Name,
+			Detail:         symbol.Describe(),
+			Kind:           lspSymbolKind[symbol.Kind],
+			Range:          r,
+			SelectionRange: r,
+		}
+	}
+
+	symbols := []lspDocumentSymbol{}
+	for _, symbol := range doc.Analysis.Symbols {
+		if symbol.File != doc.Path || symbol.Container != nil {
+			continue
+		}
+		if symbol.Kind != SYMBOL_FUNCTION && symbol.Kind != SYMBOL_CLASS && symbol.Kind != SYMBOL_ENUM {
+			continue
+		}
+		docSymbol := toDocumentSymbol(symbol)
+		for _, member := range doc.Analysis.Symbols {
+			if member.Container == symbol {
+				docSymbol.Children = append(docSymbol.Children, toDocumentSymbol(member))
+			}
+		}
+		symbols = append(symbols, docSymbol)
+	}
+	return symbols, nil
+}
+
+/* ---------------------------------------------------------------------------
+Positions and URIs
+------------------------------------------------------------------------------*/
+
+func tokenRange(text string, tok Token) lspRange {
+	return lspRange{
+		Start: offsetToPosition(text, tok.Start),
+		End:   offsetToPosition(text, tok.Start+tok.Length),
+	}
+}
+
+func offsetToPosition(text string, offset int) lspPosition {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	lineStart := strings.LastIndexByte(text[:offset], '\n') + 1
+	return lspPosition{
+		Line:      strings.Count(text[:offset], "\n"),
+		Character: utf16Length(text[lineStart:offset]),
+	}
+}
+
+func positionToOffset(text string, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next == -1 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+	units := 0
+	for i, r := range text[offset:] {
+		if units >= pos.Character || r == '\n' {
+			return offset + i
+		}
+		units += utf16Length(string(r))
+	}
+	return len(text)
+}
+
+func utf16Length(s string) int {
+	units := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return units
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
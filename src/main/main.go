@@ -19,7 +19,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
@@ -27,56 +30,103 @@ func main() {
 
 	dbg := flag.Bool("debug", false, "debug mode")
 	source := flag.String("f", "", "source file")
+	compile := flag.String("c", "", "compile a source file to bytecode")
+	output := flag.String("o", "", "output file for -c (defaults to the source file with a .cyc extension)")
 
 	flag.Parse()
 
 	dbgMode := *dbg
 	SrcFile := *source
 
+	// The language server runs for as long as the editor does, so it keeps
+	// the garbage collector. The compiler prints its errors and that would
+	// corrupt the protocol on stdout
+	if flag.Arg(0) == "lsp" {
+		out := os.Stdout
+		os.Stdout = os.Stderr
+		os.Exit(ServeLanguageServer(os.Stdin, out))
+	}
+
+	// The debugger needs the source, for the names of the variables. Under
+	// an editor it speaks the Debug Adapter Protocol on stdout instead
+	if flag.Arg(0) == "debug" {
+		target := flag.Arg(1)
+		if target == "-dap" || target == "--dap" {
+			out := os.Stdout
+			os.Stdout = os.Stderr
+			os.Exit(ServeDebugAdapter(os.Stdin, out))
+		}
+		if target == "" {
+			fmt.Fprintln(os.Stderr, "Usage: coyote debug script.cy | coyote debug -dap")
+			os.Exit(64)
+		}
+		debug.SetGCPercent(-1)
+		if DebugFile(target, os.Stdin, os.Stdout) != INTERPRET_OK {
+			os.Exit(70)
+		}
+		return
+	}
+
 	debug.SetGCPercent(-1)
 
+	if *compile != "" {
+		outFile := *output
+		if outFile == "" {
+			outFile = strings.TrimSuffix(*compile, filepath.Ext(*compile)) + BytecodeExtension
+		}
+		if err := CompileFile(*compile, outFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compile %s: %s\n", *compile, err)
+			os.Exit(65)
+		}
+		return
+	}
+
 	if SrcFile == "" {
 		repl()
 	} else {
 		start := time.Now()
-		RunFile(SrcFile, dbgMode)
+		result := RunFile(SrcFile, dbgMode)
 		t := time.Now()
 		elapsed := t.Sub(start)
 		fmt.Printf("\nElapsed: %v\n", elapsed.String())
 
+		if result == INTERPRET_COMPILE_ERROR {
+			os.Exit(65)
+		}
+		if result == INTERPRET_RUNTIME_ERROR {
+			os.Exit(70)
+		}
+
 	}
 
 }
 
 func repl() {
 
-	var line string
 	fmt.Println("Coyote Copyright (C) 2020  Claude Seidman")
 	fmt.Println("This program comes with ABSOLUTELY NO WARRANTY; for details type 'show w'.")
 	fmt.Println("This is free software, and you are welcome to redistribute it")
 	fmt.Println("under certain conditions; type 'show c' for details.")
+	fmt.Println("Type :help for the REPL's commands.")
 	fmt.Println()
-	for {
-		fmt.Printf("> ")
-		if _, err := fmt.Scanln(&line); err != nil {
-			Exec(&line, false)
-		}
-	}
+	NewRepl().Loop(os.Stdin)
 }
 
-func RunFile(path string, dbgMode bool) {
+func RunFile(path string, dbgMode bool) InterpretResult {
 
 	debug.SetGCPercent(-1)
 
-	source := ReadFile(path) + "\n"
-	Exec(&source, dbgMode)
-	/*
-		if result == INTERPRET_COMPILE_ERROR {
-			os.Exit(65)
+	// Precompiled files skip the compiler altogether
+	if filepath.Ext(path) == BytecodeExtension {
+		RegisterFunctions()
+		mod, err := LoadBytecode(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load %s: %s\n", path, err)
+			return INTERPRET_COMPILE_ERROR
 		}
-		if result == INTERPRET_RUNTIME_ERROR {
-			os.Exit(70)
-		}
-	*/
+		return ExecModule(mod, dbgMode)
+	}
 
+	source := ReadFile(path) + "\n"
+	return Exec(&source, path, dbgMode)
 }
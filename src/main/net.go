@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ---------------------------------------------------------------------------
+TCP connections and listeners. A connection is read a line or a number of
+bytes at a time like a file, but a read gives back what has arrived rather
+than waiting for all it asked for. Connections and listeners are shared by
+threads rather than copied, so a server can accept in one thread and hand
+each connection to a thread of its own. A thread can read from a connection
+while another writes to it.
+------------------------------------------------------------------------------*/
+
+type ObjConnection struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+// Interface functions
+func (o *ObjConnection) ShowValue() string    { return o.conn.RemoteAddr().String() }
+func (o *ObjConnection) Type() ValueType      { return VAL_CONNECTION }
+func (o *ObjConnection) ToBytes() []byte      { return []byte(o.ShowValue()) }
+func (o *ObjConnection) ToValue() interface{} { return o }
+func (o *ObjConnection) Print() string {
+	return "<connection:" + o.ShowValue() + ">"
+}
+
+func NewConnection(conn net.Conn) *ObjConnection {
+	return &ObjConnection{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// The next line without its line break, and false once the other side has
+// closed the connection
+func (o *ObjConnection) ReadLine() (string, bool, error) {
+	o.readLock.Lock()
+	defer o.readLock.Unlock()
+	line, err := o.reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+	} else if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), true, nil
+}
+
+// Up to the given number of bytes, as many as have arrived, and false once
+// the other side has closed the connection
+func (o *ObjConnection) Read(count int) (string, bool, error) {
+	o.readLock.Lock()
+	defer o.readLock.Unlock()
+	if count < 1 {
+		return "", false, io.ErrShortBuffer
+	}
+	buf := make([]byte, count)
+	n, err := o.reader.Read(buf)
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(buf[:n]), true, nil
+}
+
+// Everything until the other side closes the connection
+func (o *ObjConnection) ReadAll() (string, error) {
+	o.readLock.Lock()
+	defer o.readLock.Unlock()
+	data, err := ioutil.ReadAll(o.reader)
+	return string(data), err
+}
+
+func (o *ObjConnection) Write(data string) (int, error) {
+	o.writeLock.Lock()
+	defer o.writeLock.Unlock()
+	return io.WriteString(o.conn, data)
+}
+
+// Closing a connection again does nothing
+func (o *ObjConnection) Close() error {
+	err := o.conn.Close()
+	if isClosedError(err) {
+		return nil
+	}
+	return err
+}
+
+type ObjListener struct {
+	listener net.Listener
+}
+
+func (o *ObjListener) ShowValue() string    { return o.listener.Addr().String() }
+func (o *ObjListener) Type() ValueType      { return VAL_LISTENER }
+func (o *ObjListener) ToBytes() []byte      { return []byte(o.ShowValue()) }
+func (o *ObjListener) ToValue() interface{} { return o }
+func (o *ObjListener) Print() string {
+	return "<listener:" + o.ShowValue() + ">"
+}
+
+// Waits for the next client to connect
+func (o *ObjListener) Accept() (*ObjConnection, error) {
+	conn, err := o.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConnection(conn), nil
+}
+
+func (o *ObjListener) Close() error {
+	err := o.listener.Close()
+	if isClosedError(err) {
+		return nil
+	}
+	return err
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+// A deadline the given number of seconds from now. No seconds at all is no
+// deadline
+func Deadline(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// Types of the properties and methods of connections and listeners for the
+// compiler
+var ConnectionProperties = map[string]ExpressionData{
+	"local":  scalarString,
+	"remote": scalarString,
+}
+
+var ConnectionMethods = map[string]BuiltinMethod{
+	"readline":      {0, scalarString},
+	"read":          {1, scalarString},
+	"readall":       {0, scalarString},
+	"write":         {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"writeline":     {1, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}},
+	"deadline":      {1, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+	"readdeadline":  {1, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+	"writedeadline": {1, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+	"close":         {0, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+}
+
+var ListenerProperties = map[string]ExpressionData{
+	"addr": scalarString,
+}
+
+var ListenerMethods = map[string]BuiltinMethod{
+	"accept": {0, ExpressionData{Value: VAL_CONNECTION, ObjType: VAR_CONNECTION}},
+	"close":  {0, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+}
+
+// Raises a runtime error for anything that went wrong with the connection.
+// Running past a deadline says so rather than giving Go's message
+func (v *VM) connectionError(c *ObjConnection, err error) {
+	if err == nil {
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		v.Error("Connection to '%s' timed out", c.ShowValue())
+	}
+	if isClosedError(err) {
+		v.Error("Connection to '%s' has been closed", c.ShowValue())
+	}
+	v.Error("Connection to '%s': %s", c.ShowValue(), err.Error())
+}
+
+// The number of seconds a deadline is given in, as an int or a float
+func (v *VM) seconds(val Obj) float64 {
+	switch s := val.(type) {
+	case ObjInteger:
+		return float64(s)
+	case ObjFloat:
+		return float64(s)
+	}
+	v.Error("A deadline is a number of seconds, not a %s", ValueTypeLabel[val.Type()])
+	return 0
+}
+
+func (v *VM) ConnectionProperty(c *ObjConnection, name string) Obj {
+	switch name {
+	case "local":
+		return ObjString(c.conn.LocalAddr().String())
+	case "remote":
+		return ObjString(c.conn.RemoteAddr().String())
+	}
+	v.Error("Connection has no property named '%s'", name)
+	return nil
+}
+
+// The next line from the connection, or nil once the other side has closed
+// it. Scanning a connection goes through its lines this way
+func (v *VM) ConnectionLine(c *ObjConnection) (Obj, bool) {
+	line, ok, err := c.ReadLine()
+	v.connectionError(c, err)
+	if !ok {
+		return NULL{}, false
+	}
+	return ObjString(line), true
+}
+
+// Calls a method of a connection. The connection is on the stack under its
+// arguments
+func (v *VM) ConnectionMethodCall(c *ObjConnection, name string, argCount int) {
+	args := make([]Obj, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.Pop()
+	}
+	v.Pop()
+
+	switch name {
+	case "readline":
+		line, _ := v.ConnectionLine(c)
+		v.Push(line)
+	case "read":
+		data, ok, err := c.Read(int(args[0].(ObjInteger)))
+		v.connectionError(c, err)
+		if !ok {
+			v.Push(NULL{})
+			return
+		}
+		v.Push(ObjString(data))
+	case "readall":
+		data, err := c.ReadAll()
+		v.connectionError(c, err)
+		v.Push(ObjString(data))
+	case "write", "writeline":
+		data := args[0].ShowValue()
+		if name == "writeline" {
+			data += "\n"
+		}
+		n, err := c.Write(data)
+		v.connectionError(c, err)
+		v.Push(ObjInteger(n))
+	case "deadline":
+		v.connectionError(c, c.conn.SetDeadline(Deadline(v.seconds(args[0]))))
+		v.Push(NULL{})
+	case "readdeadline":
+		v.connectionError(c, c.conn.SetReadDeadline(Deadline(v.seconds(args[0]))))
+		v.Push(NULL{})
+	case "writedeadline":
+		v.connectionError(c, c.conn.SetWriteDeadline(Deadline(v.seconds(args[0]))))
+		v.Push(NULL{})
+	case "close":
+		v.connectionError(c, c.Close())
+		v.Push(NULL{})
+	default:
+		v.Error("Connection has no method named '%s'", name)
+	}
+}
+
+func (v *VM) ListenerProperty(l *ObjListener, name string) Obj {
+	switch name {
+	case "addr":
+		return ObjString(l.ShowValue())
+	}
+	v.Error("Listener has no property named '%s'", name)
+	return nil
+}
+
+// Calls a method of a listener. The listener is on the stack under its
+// arguments
+func (v *VM) ListenerMethodCall(l *ObjListener, name string, argCount int) {
+	for i := 0; i <= argCount; i++ {
+		v.Pop()
+	}
+
+	switch name {
+	case "accept":
+		conn, err := l.Accept()
+		if isClosedError(err) {
+			v.Error("Listener on '%s' has been closed", l.ShowValue())
+		} else if err != nil {
+			v.Error("Listener on '%s': %s", l.ShowValue(), err.Error())
+		}
+		v.Push(conn)
+	case "close":
+		if err := l.Close(); err != nil {
+			v.Error("Listener on '%s': %s", l.ShowValue(), err.Error())
+		}
+		v.Push(NULL{})
+	default:
+		v.Error("Listener has no method named '%s'", name)
+	}
+}
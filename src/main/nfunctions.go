@@ -1,29 +1,149 @@
 package main
 
+import "strings"
+
 var FunctionRegister = make(map[string]*ObjNative)
 
+// The groups natives with a qualified name such as fs.exists belong to
+var NativeModules = make(map[string]bool)
+
 func RegisterNative(name string, ofn NativeFn, returnData ExpressionData, hasReturnValue bool) {
+	if dot := strings.Index(name, "."); dot > 0 {
+		NativeModules[name[:dot]] = true
+	}
 	FunctionRegister[name] = NewNative(&ofn)
+	FunctionRegister[name].Name = name
 	FunctionRegister[name].ReturnType = returnData
 	FunctionRegister[name].hasReturn = hasReturnValue
 }
 
+// Gives the compiler the types of a native's arguments to check calls against
+func NativeParams(name string, params ...ExpressionData) {
+	FunctionRegister[name].Params = params
+}
+
+// Same as NativeParams, but the last parameter can be given any number of times
+func NativeVariadic(name string, params ...ExpressionData) {
+	NativeParams(name, params...)
+	FunctionRegister[name].Variadic = true
+}
+
+// Same as NativeParams, but the last few parameters can be left out
+func NativeOptional(name string, optional int, params ...ExpressionData) {
+	NativeParams(name, params...)
+	FunctionRegister[name].Optional = optional
+}
+
 func RegisterFunctions() {
-	RegisterNative("OpenFile", OpenFile, ExpressionData{VAL_INTEGER, VAR_SCALAR,0}, true)
-	RegisterNative("print", Out, ExpressionData{VAL_INTEGER, VAR_UNKNOWN,0},false)
-	RegisterNative("println", Outln, ExpressionData{VAL_NIL, VAR_UNKNOWN,0},false)
-	RegisterNative("printf", Outf, ExpressionData{VAL_NIL, VAR_UNKNOWN,0}, false)
-	RegisterNative("Matrix", Matrix, ExpressionData{VAL_CLASS, VAR_CLASS,0}, true)
-	RegisterNative("newarray", array, ExpressionData{VAL_ARRAY, VAR_ARRAY,0}, true)
-	RegisterNative("mean", mean, ExpressionData{VAL_FLOAT, VAR_SCALAR,0}, true)
-	RegisterNative("wmean", wmean, ExpressionData{VAL_FLOAT, VAR_SCALAR,0}, true)
-	RegisterNative("transpose", Transpose, ExpressionData{VAL_MATRIX, VAR_MATRIX,0}, true)
+	RegisterNative("openfile", OpenFile, ExpressionData{Value: VAL_FILE, ObjType: VAR_FILE}, true)
+	NativeOptional("openfile", 1, scalarString, scalarString)
+	RegisterNative("print", Out, ExpressionData{Value: VAL_INTEGER, ObjType: VAR_UNKNOWN},false)
+	RegisterNative("println", Outln, ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN},false)
+	RegisterNative("printf", Outf, ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}, false)
+	RegisterNative("Matrix", Matrix, ExpressionData{Value: VAL_CLASS, ObjType: VAR_CLASS}, true)
+	RegisterNative("newarray", array, ExpressionData{Value: VAL_ARRAY, ObjType: VAR_ARRAY}, true)
+	RegisterNative("mean", mean, ExpressionData{Value: VAL_FLOAT, ObjType: VAR_SCALAR}, true)
+	RegisterNative("wmean", wmean, ExpressionData{Value: VAL_FLOAT, ObjType: VAR_SCALAR}, true)
+	RegisterNative("transpose", Transpose, ExpressionData{Value: VAL_MATRIX, ObjType: VAR_MATRIX}, true)
 	// Stats - Distribution
-	RegisterNative("dnorm", dnorm, ExpressionData{VAL_FLOAT, VAR_ARRAY,0}, true)
+	RegisterNative("dnorm", dnorm, ExpressionData{Value: VAL_FLOAT, ObjType: VAR_ARRAY}, true)
 	// Dataframe and database
-	RegisterNative("showdata", DfBrowse, ExpressionData{VAL_NIL, VAR_SCALAR,0}, false)
-	RegisterNative("opendb", OpenDatabase, ExpressionData{VAL_NIL, VAR_SCALAR,0}, false)
-	RegisterNative("use", UseDatabase, ExpressionData{VAL_NIL, VAR_SCALAR,0}, false)
+	RegisterNative("showdata", DfBrowse, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}, false)
+	RegisterNative("opendb", OpenDatabase, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}, false)
+	RegisterNative("use", UseDatabase, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}, false)
+	// Dataframe transformations
+	table := ExpressionData{Value: VAL_TABLE, ObjType: VAR_TABLE}
+	function := ExpressionData{Value: VAL_FUNCTION, ObjType: VAR_FUNCTION}
+	RegisterNative("filter", DfFilter, table, true)
+	NativeParams("filter", table, function)
+	RegisterNative("columns", DfColumns, table, true)
+	NativeVariadic("columns", table, scalarString)
+	RegisterNative("rename", DfRename, table, true)
+	NativeVariadic("rename", table, scalarString)
+	RegisterNative("mutate", DfMutate, table, true)
+	NativeParams("mutate", table, scalarString, function)
+	RegisterNative("sort", DfSort, table, true)
+	NativeVariadic("sort", table, scalarString)
+	RegisterNative("groupby", DfGroupBy, table, true)
+	NativeVariadic("groupby", table, scalarString)
+	RegisterNative("innerjoin", DfInnerJoin, table, true)
+	NativeParams("innerjoin", table, table, scalarString)
+	RegisterNative("leftjoin", DfLeftJoin, table, true)
+	NativeParams("leftjoin", table, table, scalarString)
+	// Delimited files
+	list := ExpressionData{Value: VAL_LIST, ObjType: VAR_HASH}
+	RegisterNative("readcsv", ReadCsvFile, table, true)
+	NativeOptional("readcsv", 1, scalarString, list)
+	RegisterNative("writecsv", WriteCsvFile, scalarInteger, true)
+	NativeOptional("writecsv", 1, table, scalarString, list)
+	// JSON
+	unknown := ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	RegisterNative("jsondecode", JsonDecodeString, unknown, true)
+	NativeParams("jsondecode", scalarString)
+	RegisterNative("jsonencode", JsonEncodeValue, scalarString, true)
+	NativeOptional("jsonencode", 1, unknown, scalarBool)
+	RegisterNative("readjson", ReadJsonFile, unknown, true)
+	NativeParams("readjson", scalarString)
+	RegisterNative("writejson", WriteJsonFile, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}, false)
+	NativeOptional("writejson", 1, unknown, scalarString, scalarBool)
+	RegisterNative("readjsonl", ReadJsonLines, scalarInteger, true)
+	NativeParams("readjsonl", scalarString, function)
+	// Filesystem and paths
+	none := ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}
+	stringArray := ExpressionData{Value: VAL_STRING, ObjType: VAR_ARRAY, Dimensions: 1}
+	RegisterNative("fs.listdir", FsListDir, stringArray, true)
+	NativeParams("fs.listdir", scalarString)
+	RegisterNative("fs.glob", FsGlob, stringArray, true)
+	NativeParams("fs.glob", scalarString)
+	RegisterNative("fs.exists", FsExists, scalarBool, true)
+	NativeParams("fs.exists", scalarString)
+	RegisterNative("fs.isdir", FsIsDir, scalarBool, true)
+	NativeParams("fs.isdir", scalarString)
+	RegisterNative("fs.mkdir", FsMkdir, none, false)
+	NativeParams("fs.mkdir", scalarString)
+	RegisterNative("fs.remove", FsRemove, none, false)
+	NativeParams("fs.remove", scalarString)
+	RegisterNative("fs.rename", FsRename, none, false)
+	NativeParams("fs.rename", scalarString, scalarString)
+	RegisterNative("fs.copy", FsCopy, scalarInteger, true)
+	NativeParams("fs.copy", scalarString, scalarString)
+	RegisterNative("fs.stat", FsStat, list, true)
+	NativeParams("fs.stat", scalarString)
+	RegisterNative("fs.tempdir", FsTempDir, scalarString, true)
+	NativeParams("fs.tempdir")
+	RegisterNative("path.join", PathJoin, scalarString, true)
+	NativeVariadic("path.join", scalarString)
+	RegisterNative("path.base", PathBase, scalarString, true)
+	NativeParams("path.base", scalarString)
+	RegisterNative("path.dir", PathDir, scalarString, true)
+	NativeParams("path.dir", scalarString)
+	RegisterNative("path.ext", PathExt, scalarString, true)
+	NativeParams("path.ext", scalarString)
+	// Parallel work
+	RegisterNative("pmap", ParallelMap, ExpressionData{Value: VAL_NIL, ObjType: VAR_ARRAY, Dimensions: 1}, true)
+	NativeOptional("pmap", 1, unknown, function, scalarInteger)
+	RegisterNative("pmutate", DfParallelMutate, table, true)
+	NativeOptional("pmutate", 1, table, scalarString, function, scalarInteger)
+	RegisterNative("pfilter", DfParallelFilter, table, true)
+	NativeOptional("pfilter", 1, table, function, scalarInteger)
+	// TCP
+	RegisterNative("net.dial", NetDial, ExpressionData{Value: VAL_CONNECTION, ObjType: VAR_CONNECTION}, true)
+	NativeOptional("net.dial", 1, scalarString, scalarFloat)
+	RegisterNative("net.listen", NetListen, ExpressionData{Value: VAL_LISTENER, ObjType: VAR_LISTENER}, true)
+	NativeParams("net.listen", scalarString)
+	// HTTP
+	RegisterNative("http.get", HttpGet, list, true)
+	NativeOptional("http.get", 1, scalarString, list)
+	RegisterNative("http.post", HttpPost, list, true)
+	NativeOptional("http.post", 1, scalarString, unknown, list)
+	RegisterNative("http.request", HttpRequestNative, list, true)
+	NativeOptional("http.request", 2, scalarString, scalarString, unknown, list)
+	RegisterNative("http.json", HttpJson, unknown, true)
+	NativeParams("http.json", list)
+	RegisterNative("http.response", HttpResponse, list, true)
+	NativeOptional("http.response", 1, scalarInteger, unknown, list)
+	RegisterNative("http.serve", HttpServe, none, false)
+	NativeParams("http.serve", unknown, function)
 }
 
 func ResolveNativeFunction(name string) *ObjNative {
@@ -2,6 +2,8 @@ package main
 
 import(
 	"fmt"
+	"os"
+	"path/filepath"
 )
 
 
@@ -18,19 +20,32 @@ On the compiler side, this is where we keep track of all nitty-grotty details ab
 type ObjModule struct {
 	ParentModule *ObjModule
 	Name string
+	Path string // Path of the file the module was compiled from
 	IsUsed bool // Is it used anywhere?
-	LoadedModules []ObjModule // The modules that this module loads
+	LoadedModules []*ObjModule // Every module the program imports, in the order OP_IMPORT refers to them
 	ModuleCount int // How many loaded modules we have
 	ModuleId []byte // This is an id value that contains information starting from the parent
 	MainFunction *ObjFunction // Starting function in the module
+	Imports map[string]*ObjModule // The modules this module imported, by their alias
 }
 
-var moduleSequence = int16(0)
+// Every module imported while compiling the program. A module imported from
+// several places is only compiled and run once
+var ModuleTable = make([]*ObjModule, 0)
+
+func NewModule(name string, path string) *ObjModule {
+	return &ObjModule{
+		Name:    name,
+		Path:    path,
+		Imports: make(map[string]*ObjModule),
+	}
+}
 
 func (c *Compiler) ImportStatement() {
 	// import <modulepath>
 	c.Consume(TOKEN_STRING,"Expect module path after 'import'")
 	modulePath := c.Parser.Previous.ToString()
+	modulePath = modulePath[1 : len(modulePath)-1]
 
 	c.Consume(TOKEN_AS,"Expect 'AS after 'import <path>'")
 	c.Consume(TOKEN_IDENTIFIER,"Expect module alias after 'import <path> AS'")
@@ -39,88 +54,177 @@ func (c *Compiler) ImportStatement() {
 	// reference to module scoped objects
 	moduleName := c.Parser.Previous.ToString()
 
-	// This is going to be where we build the module
-	var moduleObj *ObjModule
+	path := c.FindModuleFile(modulePath)
+	if path == "" {
+		c.Error(fmt.Sprintf("Module '%s' not found", modulePath))
+		return
+	}
 
 	// See if this module already has been loaded by another module
-	idx := c.ResolveModule(modulePath)
+	idx := c.ResolveModule(path)
 
 	// If not .. compile and load it
 	if idx == -1 {
-		// Compile the file with the module and fill the module variable with code
-		moduleObj = c.CompileModule(modulePath, false)
-		// Add this module to the loaded modules
-		c.Modules[c.ModuleCount] = *moduleObj
-		
-		idx = c.ModuleCount
-		c.ModuleCount++
+		// Register the module before compiling it so that an import cycle
+		// finds it rather than compiling the same files forever
+		idx = len(ModuleTable)
+		ModuleTable = append(ModuleTable, &ObjModule{Path: path})
+
+		moduleObj := c.CompileModule(path, false)
+		if moduleObj == nil {
+			c.Error(fmt.Sprintf("Unable to compile module '%s'", modulePath))
+			return
+		}
+		ModuleTable[idx] = moduleObj
+	} else if ModuleTable[idx].MainFunction == nil {
+		c.Error(fmt.Sprintf("Circular import of module '%s'", modulePath))
+		return
 	}
 
+	c.CurrentModule.Imports[moduleName] = ModuleTable[idx]
+
+	// The VM runs the module the first time it gets imported
 	c.EmitInstr(OP_IMPORT, int16(idx))
 	c.WriteComment(fmt.Sprintf("Import module %s",moduleName))
+	c.EmitOp(OP_POP)
+}
 
+// Modules are looked for relative to the file importing them first, then in
+// each of the directories in COYOTE_PATH and finally relative to the working
+// directory. The extension can be left out
+func (c *Compiler) FindModuleFile(modulePath string) string {
+	if filepath.Ext(modulePath) == "" {
+		modulePath += ".cy"
+	}
+
+	var candidates []string
+	if filepath.IsAbs(modulePath) {
+		candidates = append(candidates, modulePath)
+	} else {
+		if c.SourceFile != "" {
+			candidates = append(candidates, filepath.Join(filepath.Dir(c.SourceFile), modulePath))
+		}
+		for _, dir := range filepath.SplitList(os.Getenv("COYOTE_PATH")) {
+			if dir != "" {
+				candidates = append(candidates, filepath.Join(dir, modulePath))
+			}
+		}
+		candidates = append(candidates, modulePath)
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
 }
 
-func (c *Compiler) ResolveModule(moduleName string) int {
-
-	//curMod := c.CurrentModule
-	modName := moduleName
-
-	// Checks to see if this module had been registered
-	for i:=0;i<c.ModuleCount-1;i++ {
-		// We already have this module by comparing the name and the parental lineage
-		for c.Modules[i].Name == modName {//&& bytes.Compare(c.Modules[i].ParentModule.ModuleId,curMod.ParentModule.ModuleId) {
-			// Check to see of this is a compound definition
-			// TODO: When we start adding nested modules, get back to this
-			//if c.Match(TOKEN_DOT) {
-				// If so, check the next definition level
-			//	curMod = c.Modules[i]
-			//	modName = curMod.Name
-			//	continue
-			//}
+// Finds a module that was already imported, no matter which path it was
+// imported by
+func (c *Compiler) ResolveModule(path string) int {
+	abs, _ := filepath.Abs(path)
+	for i := range ModuleTable {
+		if modAbs, _ := filepath.Abs(ModuleTable[i].Path); modAbs == abs {
 			return i
 		}
 	}
 	return -1
 }
 
-func (c *Compiler) RegisterModule(moduleName string) int {
+// Names the module the file being compiled belongs to
+func (c *Compiler) DeclareModule() {
+	c.Consume(TOKEN_IDENTIFIER,"Expect module name after 'module'")
+	c.CurrentModule.Name = c.Parser.Previous.ToString()
+}
 
-	idx := c.ResolveModule(moduleName)
-	// If we found an existing module
-	if idx > -1 {
-		return idx
+// Checks if the name is the alias of an import followed by '.<name>'. Locals
+// with the same name as an alias hide it
+func (c *Compiler) ResolveImport(tok Token) *ObjModule {
+	if !c.Check(TOKEN_DOT) {
+		return nil
+	}
+	module, ok := c.CurrentModule.Imports[tok.ToString()]
+	if !ok {
+		return nil
 	}
+	if idx, _ := c.ResolveLocal(c.Current, tok.ToString()); idx != -1 {
+		return nil
+	}
+	return module
+}
 
-	// Get the value of the parent module. This is a string of bytes that provide a lineage trail
-	// that uniquely identfies a module of the same name but with different parental pathway. Each
-	// New module gets a 2-byte number which then is tacked on to the parent's unique identifier.
-	// That makes it possible to differentiate "file.csv.open" from "stream.csv.open" because
-	// The two references could have Id values (ex:) 010203 vs 040506
-	// Note: This is relevant only when we get to nested modules
-	//modId := append(c.CurrentModule.ModuleId,Int16ToBytes(moduleSequence)...)
-	moduleSequence++
+// Compiles a reference to a global of an imported module: <alias>.<name>
+func (c *Compiler) ModuleVariable(module *ObjModule, canAssign bool) {
+	c.Consume(TOKEN_DOT, "Expect '.' after module alias")
+	c.Consume(TOKEN_IDENTIFIER, "Expect name after module alias")
+	name := c.Parser.Previous.ToString()
 
-	mod := &ObjModule{
-		ParentModule: c.CurrentModule,
-		Name:         moduleName,
-		IsUsed:       false,
-		ModuleId: 	  nil,
+	idx := FindGlobal(module, name)
+	if idx == -1 {
+		c.Error(fmt.Sprintf("Module %s has no member named '%s'", module.Name, name))
+		PushExpressionValue(ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN})
+		return
+	}
+	c.ReferenceSymbol(c.Parser.Previous, GlobalVars[idx].Symbol, GlobalVars[idx].ExprData)
+	if GlobalVars[idx].Access == PRIVATE {
+		c.Error(fmt.Sprintf("'%s' is private to module %s", name, module.Name))
+	}
+	if canAssign && c.Match(TOKEN_EQUAL) {
+		c.Error(fmt.Sprintf("Cannot assign to '%s' from outside of module %s", name, module.Name))
 	}
 
-	c.Modules[c.ModuleCount] = *mod
-	c.CurrentModule = mod
-	c.ModuleCount++
-	return c.ModuleCount-1
+	c.EmitInstr(OP_GET_GLOBAL, idx)
+	c.WriteComment(fmt.Sprintf("OP_GET_GLOBAL name %s.%s at index %d", module.Name, name, idx))
+
+	if GlobalVars[idx].ExprData.ObjType == VAR_CLASS {
+		CurrentClass = GlobalVars[idx].Class
+	}
+	PushExpressionValue(ExpressionData{
+		Value:   GlobalVars[idx].ExprData.Value,
+		ObjType: GlobalVars[idx].ExprData.ObjType,
+	})
 }
 
-func (c *Compiler) DeclareModule() {
-	c.Consume(TOKEN_IDENTIFIER,"Expect module name after 'module'")
-	moduleName := c.Parser.Previous.ToString()
+// Module level variables and functions can be used by the modules that import
+// them unless they are declared private
+func (c *Compiler) PrivateDeclaration() {
+	if c.ScopeDepth > 0 {
+		c.Error("Only module level declarations can be private")
+	}
+	isClass := c.Match(TOKEN_CLASS)
+	if !isClass {
+		c.Consume(TOKEN_VAR, "Expect 'var' or 'class' after 'private'")
+	}
+	name := c.Parser.Current.ToString()
+	if isClass {
+		c.ClassDeclaration()
+	} else {
+		c.DeclareVariable()
+	}
 
-	c.RegisterModule(moduleName)
+	if c.ScopeDepth == 0 {
+		if idx := FindGlobal(c.CurrentModule, name); idx != -1 {
+			GlobalVars[idx].Access = PRIVATE
+		}
+	}
 }
 
+// Runs the top level code of a module the first time it gets imported. Later
+// imports just push the nil that the import statement pops
+func (v *VM) ImportModule(idx int) {
+	if v.ModuleLoaded[idx] {
+		v.Push(&NULL{})
+		return
+	}
+	v.ModuleLoaded[idx] = true
+
+	closure := &ObjClosure{
+		Function: v.Modules[idx].MainFunction,
+	}
+	v.Push(closure)
+	v.ExecCall(closure, 1)
+}
 
 /*
 The module object is very simple, but it serves as a reference point for module level
@@ -160,6 +160,21 @@ const (
 	OP_INVOKE
 	OP_IMPORT
 	// 130
+	OP_TRY
+	OP_END_TRY
+	OP_THROW
+	OP_END_FINALLY
+	OP_INT_TO_FLOAT
+	OP_INT_TO_FLOAT_LEFT
+	OP_UPDATE
+	OP_DELETE
+	OP_LOAD_CSV
+	OP_SPAWN
+	OP_MAKE_CHANNEL
+	OP_SELECT
+	OP_PFOR
+	OP_SUPER_INVOKE
+	OP_INIT
 )
 
 var OpLabel = map[byte]string{
@@ -321,4 +336,23 @@ var OpLabel = map[byte]string{
 	OP_INVOKE:		 "OP_INVOKE",
 	OP_IMPORT:		 "OP_IMPORT",
 
+	OP_TRY:          "OP_TRY",
+	OP_END_TRY:      "OP_END_TRY",
+	OP_THROW:        "OP_THROW",
+	OP_END_FINALLY:  "OP_END_FINALLY",
+
+	OP_INT_TO_FLOAT:      "OP_INT_TO_FLOAT",
+	OP_INT_TO_FLOAT_LEFT: "OP_INT_TO_FLOAT_LEFT",
+
+	OP_UPDATE:   "OP_UPDATE",
+	OP_DELETE:   "OP_DELETE",
+	OP_LOAD_CSV: "OP_LOAD_CSV",
+
+	OP_SPAWN:        "OP_SPAWN",
+	OP_MAKE_CHANNEL: "OP_MAKE_CHANNEL",
+	OP_SELECT:       "OP_SELECT",
+	OP_PFOR:         "OP_PFOR",
+	OP_SUPER_INVOKE: "OP_SUPER_INVOKE",
+	OP_INIT:         "OP_INIT",
+
 }
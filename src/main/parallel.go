@@ -0,0 +1,197 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/* ---------------------------------------------------------------------------
+Parallel loops. pmap, pfor, pmutate and pfilter split their work into as many
+parts as there are workers, one run of rows or elements after another, and
+each worker goes through its part on a VM of its own the way a spawned thread
+does, with its own copies of the globals and of what the function captured.
+
+The results come back in the order of the work, whichever worker finished
+first. A runtime error stops the workers from going on to any element after
+the one that failed, but the elements before it still run in case one of
+them fails too. Once the workers have all stopped the error of the earliest
+element that failed is raised again where the loop was started.
+------------------------------------------------------------------------------*/
+
+// The number of workers when none is given
+func DefaultWorkers() int {
+	return runtime.NumCPU()
+}
+
+// Calls the closure once for each of count elements, spread over up to the
+// given number of workers, and gives back what each call returned. args
+// gives the arguments for an element
+func (v *VM) Parallel(fn *ObjClosure, count int, workers int, args func(i int) []Obj) []Obj {
+	if workers < 1 {
+		v.Error("Can't run on %d workers", workers)
+	}
+	if workers > count {
+		workers = count
+	}
+	results := make([]Obj, count)
+	if count == 0 {
+		return results
+	}
+
+	var wg sync.WaitGroup
+	// The earliest element that has failed so far
+	lowest := int64(count)
+	errs := make([]*RuntimeError, workers)
+	failedAt := make([]int, workers)
+	size := (count + workers - 1) / workers
+
+	for w := 0; w < workers; w++ {
+		start, end := w*size, (w+1)*size
+		if end > count {
+			end = count
+		}
+		if start >= end {
+			break
+		}
+		copies := make(map[Obj]Obj)
+		vm := v.NewThreadVM(copies)
+		closure := ThreadCopy(fn, copies).(*ObjClosure)
+
+		wg.Add(1)
+		go func(w int, start int, end int) {
+			defer wg.Done()
+			i := start
+			defer func() {
+				if r := recover(); r != nil {
+					errs[w] = vm.ToRuntimeError(r)
+					failedAt[w] = i
+					for {
+						at := atomic.LoadInt64(&lowest)
+						if int64(i) >= at || atomic.CompareAndSwapInt64(&lowest, at, int64(i)) {
+							break
+						}
+					}
+				}
+			}()
+			for ; i < end && int64(i) < atomic.LoadInt64(&lowest); i++ {
+				elemArgs := args(i)
+				for j := range elemArgs {
+					elemArgs[j] = ThreadCopy(elemArgs[j], copies)
+				}
+				results[i] = vm.CallClosure(closure, elemArgs...)
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	var first *RuntimeError
+	firstAt := count
+	for w, err := range errs {
+		if err != nil && failedAt[w] < firstAt {
+			first, firstAt = err, failedAt[w]
+		}
+	}
+	if first != nil {
+		panic(first)
+	}
+	return results
+}
+
+// Pops the number of workers if it was given, and the function
+func (v *VM) popParallel(args int, given int) (*ObjClosure, int) {
+	workers := DefaultWorkers()
+	if args > given {
+		workers = int(v.Pop().(ObjInteger))
+	}
+	fn, ok := v.Pop().(*ObjClosure)
+	if !ok {
+		v.Error("The work has to be done by a function")
+	}
+	return fn, workers
+}
+
+// pmap(array, fn, <workers>) gives back an array of what fn returns for
+// each element, in the order of the elements
+var ParallelMap NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn, workers := vm.popParallel(args, 2)
+	array, ok := vm.Pop().(*ObjArray)
+	if !ok {
+		vm.Error("pmap works on an array")
+	}
+
+	results := vm.Parallel(fn, array.ElementCount, workers, func(i int) []Obj {
+		return []Obj{array.Elements[i]}
+	})
+
+	// The results all of the same type make an array of that type
+	elemType := VAL_NIL
+	for i, val := range results {
+		if i == 0 {
+			elemType = val.Type()
+		} else if val.Type() != elemType {
+			elemType = VAL_NIL
+		}
+	}
+	return &ObjArray{
+		ElementCount: len(results),
+		ElementTypes: elemType,
+		Elements:     results,
+		DimCount:     1,
+		Dimensions:   []int{len(results)},
+	}
+}
+
+// Runs the body of a pfor loop, a function of the loop variable, once for
+// each value from one number to the other
+func (v *VM) ParallelFor() {
+	fn := v.Pop().(*ObjClosure)
+	to := int(v.Pop().(ObjInteger))
+	from := int(v.Pop().(ObjInteger))
+	count := to - from + 1
+	if count < 0 {
+		count = 0
+	}
+	v.Parallel(fn, count, DefaultWorkers(), func(i int) []Obj {
+		return []Obj{ObjInteger(from + i)}
+	})
+}
+
+// pmutate(table, name, fn, <workers>) is mutate with the rows split among
+// the workers
+var DfParallelMutate NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn, workers := vm.popParallel(args, 3)
+	name := string(vm.Pop().(ObjString))
+	df := vm.Pop().(*ObjDataFrame)
+
+	results := vm.Parallel(fn, df.RowCount, workers, func(row int) []Obj {
+		return []Obj{df.Row(int64(row))}
+	})
+	col := NewDataColumn(name, VAL_NIL)
+	for _, val := range results {
+		col.Append(val)
+	}
+	return df.WithColumn(col)
+}
+
+// pfilter(table, fn, <workers>) is filter with the rows split among the
+// workers
+var DfParallelFilter NativeFn = func(vm *VM, args int, argpos int) Obj {
+	fn, workers := vm.popParallel(args, 2)
+	df := vm.Pop().(*ObjDataFrame)
+
+	results := vm.Parallel(fn, df.RowCount, workers, func(row int) []Obj {
+		return []Obj{df.Row(int64(row))}
+	})
+	var rows []int
+	for row, val := range results {
+		keep, ok := val.(*ObjBool)
+		if !ok {
+			vm.Error("The function given to pfilter must return a bool")
+		}
+		if keep.Value {
+			rows = append(rows, row)
+		}
+	}
+	return df.Take(rows)
+}
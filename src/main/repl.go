@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* ---------------------------------------------------------------------------
+The REPL keeps one VM and one module for the whole session. Each input gets
+compiled into the same module, so the globals it declares stay visible to the
+inputs after it, and then runs in the same VM, so their values, the open
+databases and the modules already imported stay around too.
+
+An input keeps going until its brackets balance, so blocks can be typed over
+several lines. Whatever values the input's expressions leave behind get
+printed. Lines starting with ':' are commands to the REPL itself.
+------------------------------------------------------------------------------*/
+
+const replHistoryFile = ".coyote_history"
+
+type Repl struct {
+	vm          *VM
+	module      *ObjModule
+	modules     []*ObjModule // The modules imported in this session
+	history     []string
+	historyFile string
+	done        bool
+}
+
+var replCommands = []struct {
+	Name string
+	Help string
+}{
+	{":load <file>", "run a source file in this session"},
+	{":type <expr>", "show the type of an expression without running it"},
+	{":dis <code>", "show the instructions the code compiles to without running it"},
+	{":tables", "list the tables in the current database"},
+	{":history", "list the inputs of this and earlier sessions"},
+	{":help", "show this list"},
+	{":quit", "leave the REPL"},
+}
+
+func NewRepl() *Repl {
+	RegisterFunctions()
+	r := &Repl{
+		vm:     NewVM(nil, false),
+		module: NewModule("main", ""),
+	}
+	r.vm.Interactive = true
+	if home, err := os.UserHomeDir(); err == nil {
+		r.historyFile = filepath.Join(home, replHistoryFile)
+		r.LoadHistory()
+	}
+	return r
+}
+
+// Reads inputs until the end of the input or :quit
+func (r *Repl) Loop(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	var input strings.Builder
+	defer r.vm.CloseFiles()
+
+	for !r.done {
+		if input.Len() == 0 {
+			fmt.Print("> ")
+		} else {
+			fmt.Print(". ")
+		}
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		line := scanner.Text()
+
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			r.AddHistory(strings.TrimSpace(line))
+			r.Command(strings.TrimSpace(line))
+			continue
+		}
+
+		input.WriteString(line)
+		input.WriteString("\n")
+		if !InputComplete(input.String()) {
+			continue
+		}
+
+		source := strings.TrimSpace(input.String())
+		input.Reset()
+		if source == "" {
+			continue
+		}
+		r.AddHistory(source)
+		r.Eval(source)
+	}
+}
+
+// Compiles and runs an input, then prints the values it left on the stack
+func (r *Repl) Eval(source string) {
+	fn := r.Compile(source, false)
+	if fn == nil {
+		return
+	}
+	if r.vm.Run(fn) != INTERPRET_OK {
+		return
+	}
+	for i := fn.LocalSlots; i < r.vm.sp; i++ {
+		if val := r.vm.Stack[i]; val != nil && val.Type() != VAL_NIL {
+			fmt.Println(val.ShowValue())
+		}
+	}
+}
+
+// Compiles the source into the session's module. Code that doesn't compile
+// gives back the names it declared so they can be declared again
+func (r *Repl) Compile(source string, dbgMode bool) *ObjFunction {
+	globals := GlobalCount
+	source += "\n"
+	// The session's imports are the only ones the input can share, and the
+	// ones it adds are only kept if it compiles
+	ModuleTable = append([]*ObjModule(nil), r.modules...)
+	if !CompileInto(r.module, &source, dbgMode) {
+		r.Forget(globals)
+		return nil
+	}
+	r.modules = ModuleTable
+
+	// Any modules it imported have to be added to the ones the VM knows
+	r.vm.Modules = append([]*ObjModule(nil), r.modules...)
+	for len(r.vm.ModuleLoaded) < len(r.vm.Modules) {
+		r.vm.ModuleLoaded = append(r.vm.ModuleLoaded, false)
+	}
+	return r.module.MainFunction
+}
+
+// Drops the globals declared since there were the given number of them
+func (r *Repl) Forget(globals int16) {
+	for i := globals; i < GlobalCount; i++ {
+		GlobalVars[i] = Global{}
+	}
+	GlobalCount = globals
+}
+
+func (r *Repl) Command(line string) {
+	name := line
+	arg := ""
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		name = line[:i]
+		arg = strings.TrimSpace(line[i:])
+	}
+
+	switch name {
+	case ":load", ":l":
+		r.Load(arg)
+	case ":type", ":t":
+		r.Type(arg)
+	case ":dis", ":d":
+		// Compiled for the listing only, so nothing it declares sticks
+		globals := GlobalCount
+		r.Compile(arg, true)
+		r.Forget(globals)
+	case ":tables":
+		r.Tables()
+	case ":history", ":h":
+		for i, entry := range r.history {
+			fmt.Printf("%4d  %s\n", i+1, strings.Replace(entry, "\n", "\n      ", -1))
+		}
+	case ":help", ":?":
+		for _, cmd := range replCommands {
+			fmt.Printf("  %-14s %s\n", cmd.Name, cmd.Help)
+		}
+	case ":quit", ":q", ":exit":
+		r.done = true
+	default:
+		fmt.Printf("Unknown command %s. Type :help for the list of commands\n", name)
+	}
+}
+
+// Runs a file in the session. Its imports are found relative to the file
+func (r *Repl) Load(path string) {
+	if path == "" {
+		fmt.Println("Usage: :load <file>")
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Unable to load %s: %s\n", path, err)
+		return
+	}
+	r.module.Path = path
+	defer func() {
+		r.module.Path = ""
+	}()
+	r.Eval(string(data))
+}
+
+func (r *Repl) Type(source string) {
+	if source == "" {
+		fmt.Println("Usage: :type <expr>")
+		return
+	}
+	globals := GlobalCount
+	defer r.Forget(globals)
+
+	data, ok := CompileExpression(r.module, source)
+	if ok {
+		fmt.Println(TypeName(data))
+	}
+}
+
+func (r *Repl) Tables() {
+	rows, err := r.vm.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name")
+	if err != nil {
+		fmt.Printf("Unable to list tables: %s\n", err)
+		return
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			fmt.Println(name)
+			count++
+		}
+	}
+	if count == 0 {
+		fmt.Println("No tables")
+	}
+}
+
+/* ---------------------------------------------------------------------------
+History is kept in ~/.coyote_history, one quoted input per line so that
+inputs spanning several lines stay in one piece
+------------------------------------------------------------------------------*/
+
+func (r *Repl) LoadHistory() {
+	data, err := ioutil.ReadFile(r.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if entry, err := strconv.Unquote(line); err == nil {
+			r.history = append(r.history, entry)
+		}
+	}
+}
+
+func (r *Repl) AddHistory(entry string) {
+	r.history = append(r.history, entry)
+	if r.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(r.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, strconv.Quote(entry))
+}
+
+// Compiles a single expression without running it and returns its type
+func CompileExpression(module *ObjModule, source string) (ExpressionData, bool) {
+	source += "\n"
+	parser := NewParser(&source)
+	compiler := NewCompiler(&parser)
+	compiler.SourceFile = module.Path
+	compiler.Current.file = module.Path
+	compiler.CurrentModule = module
+	RegisterFunctions()
+
+	mark := ExpressionValueId
+	defer func() {
+		ExpressionValueId = mark
+	}()
+
+	compiler.Advance()
+	compiler.Expression()
+	data := PopExpressionValue()
+
+	compiler.ClearCR()
+	if !compiler.Check(TOKEN_EOF) {
+		compiler.ErrorAtCurrent("Expect end of expression")
+	}
+	return data, !compiler.Parser.HadError
+}
+
+// Checks if the brackets and braces of the input so far are balanced and
+// none of its strings or comments are still open
+func InputComplete(input string) bool {
+	depth := 0
+	for i := 0; i < len(input); i++ {
+		switch ch := input[i]; ch {
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+		case '"', '\'':
+			end := strings.IndexByte(input[i+1:], ch)
+			if end == -1 {
+				return false
+			}
+			i += end + 1
+		case '/':
+			if strings.HasPrefix(input[i:], "//") {
+				end := strings.IndexByte(input[i:], '\n')
+				if end == -1 {
+					return true
+				}
+				i += end
+			} else if strings.HasPrefix(input[i:], "/*") {
+				end := strings.Index(input[i+2:], "*/")
+				if end == -1 {
+					return false
+				}
+				i += end + 3
+			}
+		}
+	}
+	return depth <= 0
+}
@@ -64,7 +64,7 @@ func (c *Compiler) LoadRules() {
 		{c.Literal, nil, nil, PREC_NONE},  // TOKEN_NIL
 		{nil, c.or_, nil, PREC_OR},        // TOKEN_OR
 		{nil, nil, nil, PREC_NONE},        // TOKEN_RETURN
-		{nil, nil, nil, PREC_NONE},        // TOKEN_SUPER
+		{c.Super, nil, nil, PREC_NONE},    // TOKEN_SUPER
 		// 50
 		{c.Enum, nil, nil, PREC_NONE},    // TOKEN_ENUM
 		{c.Boolean, nil, nil, PREC_NONE}, // TOKEN_TRUE
@@ -81,8 +81,8 @@ func (c *Compiler) LoadRules() {
 		{c._array, nil, nil, PREC_NONE},    // TOKEN_TYPE_ARRAY
 		{c.SqlSelect, nil, nil, PREC_NONE}, // TOKEN_SELECT
 		{nil, nil, nil, PREC_NONE},         // TOKEN_INSERT
-		{nil, nil, nil, PREC_NONE},         // TOKEN_UPDATE
-		{nil, nil, nil, PREC_NONE},         // TOKEN_DELETE
+		{c.SqlUpdate, nil, nil, PREC_NONE}, // TOKEN_UPDATE
+		{c.SqlDelete, nil, nil, PREC_NONE}, // TOKEN_DELETE
 		{nil, nil, nil, PREC_NONE},         // TOKEN_FROM
 		{nil, nil, nil, PREC_NONE},         // TOKEN_JOIN
 		{nil, nil, nil, PREC_NONE},         // TOKEN_LEFT
@@ -292,7 +292,21 @@ func (c *Compiler) LoadRules() {
 		{nil, nil, nil, PREC_NONE}, //TOKEN_SQL_WINDOW
 		{nil, nil, nil, PREC_NONE}, //TOKEN_SQL_WITH
 		{nil, nil, nil, PREC_NONE}, //TOKEN_SQL_WITHOUT
+		{nil, nil, nil, PREC_NONE}, //TOKEN_MODULE
+		{nil, nil, nil, PREC_NONE}, //TOKEN_IMPORT
 		{nil, nil, nil, PREC_NONE}, //TOKEN_DOUBLE_COLON
+		{nil, nil, nil, PREC_NONE}, //TOKEN_TRY
+		{nil, nil, nil, PREC_NONE}, //TOKEN_CATCH
+		{nil, nil, nil, PREC_NONE}, //TOKEN_FINALLY
+		{nil, nil, nil, PREC_NONE}, //TOKEN_THROW
+		{nil, nil, nil, PREC_NONE}, //TOKEN_LOAD
+		{nil, nil, nil, PREC_NONE}, //TOKEN_FILE
+		{c.Spawn, nil, nil, PREC_NONE}, //TOKEN_SPAWN
+		{nil, nil, nil, PREC_NONE}, //TOKEN_CHAN
+		{nil, nil, nil, PREC_NONE}, //TOKEN_THREAD
+		{nil, nil, nil, PREC_NONE}, //TOKEN_PFOR
+		{nil, nil, nil, PREC_NONE}, //TOKEN_CONNECTION
+		{nil, nil, nil, PREC_NONE}, //TOKEN_LISTENER
 
 
 	}
@@ -164,7 +164,10 @@ func (s *Scanner) PushCRMode(CRMode bool) {
 }
 
 func (s *Scanner) PopCRMode() {
-	s.SkipCRDepth--
+	// An unbalanced closing bracket is a syntax error the compiler reports
+	if s.SkipCRDepth > 0 {
+		s.SkipCRDepth--
+	}
 }
 
 func (s *Scanner) CurrentCRMode() bool {
@@ -259,7 +262,8 @@ func (s *Scanner) isAtEnd() bool {
 func (s *Scanner) MakeToken(t_type TokenType) Token {
 	var token = Token{}
 	token.Type = t_type
-	token.Length = s.Current
+	token.Start = s.Start
+	token.Length = s.Current - s.Start
 	token.Line = s.Line
 	token.Value = s.Code[s.Start:s.Current]
 
@@ -270,7 +274,8 @@ func (s *Scanner) ErrorToken(message string) Token {
 	var token = Token{}
 	token.Type = TOKEN_ERROR
 	token.Value = []byte(message)
-	token.Length = len(message)
+	token.Start = s.Start
+	token.Length = s.Current - s.Start
 	token.Line = s.Line
 
 	return token
@@ -347,47 +352,32 @@ func (s *Scanner) SkipWhitespace() {
 		case '/':
 			// If the next character is a *
 			if s.PeekNext() == '*' {
-				// We are in the beginning of comment mode
+				// Block comments can be nested. The lines they span still
+				// count so that the lines after them are right
 				commentHeaderDepth := 0
-				s.PushCRMode(true)
 
-				// Move to the *
+				// Move past the /*
 				s.Advance()
-				// Keep reading characters
-				for {
-					// Move to the next character
-					s.Advance()
-					// If the current character is / and the next is *
+				s.Advance()
+				for !s.isAtEnd() {
 					if s.Peek() == '/' && s.PeekNext() == '*' {
 						// Opens a new comment block
 						commentHeaderDepth++
-						// Move to the *
 						s.Advance()
-						// Move to the next character
 						s.Advance()
-					}
-
-					// If the current character is * followed by /
-					if s.Peek() == '*' && s.PeekNext() == '/' {
-
+					} else if s.Peek() == '*' && s.PeekNext() == '/' {
 						// This closes the comment block
-						// Move to the /
 						s.Advance()
 						s.Advance()
-						// If there's a newline ..
-						if s.Peek() == '\n' {
-							// Move to the newline
-							s.Advance()
-						}
 						if commentHeaderDepth == 0 {
-							s.Advance()
-							s.PopCRMode()
 							break
 						}
 						commentHeaderDepth--
+					} else if s.Advance() == '\n' {
+						s.Line++
 					}
-
 				}
+				continue
 			}
 
 			if s.PeekNext() == '/' {
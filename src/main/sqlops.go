@@ -12,6 +12,53 @@ func (v *VM) ExecSQL(sql string) {
 func OpenDb(dbPath string) *sql.DB {
 
 	db, _ := sql.Open("sqlite3", dbPath)
+	// Every connection to an in-memory database gets a database of its own,
+	// so threads have to take turns with the one connection
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
 	return db
 }
 
+// Pops the values of a statement's $variables, in the order they came in,
+// as the driver values they bind to
+func (v *VM) PopSqlParameters() []interface{} {
+	vars := int(v.Pop().(ObjInteger))
+	vals := make([]interface{}, vars)
+	for i := vars - 1; i >= 0; i-- {
+		vals[i] = SqlValue(v.Pop())
+	}
+	return vals
+}
+
+func SqlValue(obj Obj) interface{} {
+	switch val := obj.(type) {
+	case ObjInteger:
+		return int64(val)
+	case ObjFloat:
+		return float64(val)
+	case ObjString:
+		return string(val)
+	case *ObjBool:
+		return val.Value
+	case ObjByte:
+		return int64(val.Value)
+	case NULL, *NULL, nil:
+		return nil
+	}
+	RaiseRuntimeError("A %s can't be used as a SQL parameter", ValueTypeLabel[obj.Type()])
+	return nil
+}
+
+// Runs a statement that changes rows and returns how many it changed
+func (v *VM) ExecCount(sql string, vals []interface{}) int64 {
+	result, err := v.db.Exec(sql, vals...)
+	if err != nil {
+		v.Error("Query error: %s", err.Error())
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		v.Error("Query error: %s", err.Error())
+	}
+	return count
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"sync"
+)
+
+/* ---------------------------------------------------------------------------
+Threads and channels. 'spawn' runs a function on a VM of its own, in a
+goroutine of its own, with a stack and frames that nothing else touches.
+
+A thread starts with copies of its arguments and of the globals as they were
+when it was spawned, so changing them in one thread is never seen by another.
+Arrays, lists, objects, ranges and the variables a function captured are
+copied. Everything else is shared: numbers, strings, bools, tables, enums and
+classes because they can't change, and channels, threads, files and
+connections because they're made to be shared. Threads talk to each other through channels,
+and what's sent on one is copied the same way.
+------------------------------------------------------------------------------*/
+
+type ObjThread struct {
+	done   chan struct{}
+	result Obj
+	err    *RuntimeError
+}
+
+// Interface functions
+func (o *ObjThread) ShowValue() string    { return "<thread>" }
+func (o *ObjThread) Type() ValueType      { return VAL_THREAD }
+func (o *ObjThread) ToBytes() []byte      { return nil }
+func (o *ObjThread) ToValue() interface{} { return o }
+func (o *ObjThread) Print() string {
+	return "<thread>"
+}
+
+// Blocks until the thread has finished and gives back what its function
+// returned, or the error that stopped it
+func (o *ObjThread) Wait() (Obj, *RuntimeError) {
+	<-o.done
+	return o.result, o.err
+}
+
+func (o *ObjThread) Done() bool {
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type ObjChannel struct {
+	ElementType ValueType
+	ch          chan Obj
+	lock        sync.Mutex
+	closed      bool
+}
+
+// Interface functions
+func (o *ObjChannel) ShowValue() string    { return "<chan " + ValueTypeLabel[o.ElementType] + ">" }
+func (o *ObjChannel) Type() ValueType      { return VAL_CHANNEL }
+func (o *ObjChannel) ToBytes() []byte      { return nil }
+func (o *ObjChannel) ToValue() interface{} { return o }
+func (o *ObjChannel) Print() string {
+	return o.ShowValue()
+}
+
+// An unbuffered channel makes every send wait for a receive
+func NewChannel(elemType ValueType, buffer int) *ObjChannel {
+	return &ObjChannel{ElementType: elemType, ch: make(chan Obj, buffer)}
+}
+
+// Sends a copy of a value, waiting for room in the buffer if there isn't
+// any, so the thread that sent it can go on changing its own. Sending on a
+// closed channel is an error
+func (o *ObjChannel) Send(val Obj) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	o.ch <- ThreadCopy(val, make(map[Obj]Obj))
+	return true
+}
+
+// Waits for a value. Once the channel is closed and empty it gives back nil
+// and false
+func (o *ObjChannel) Receive() (Obj, bool) {
+	val, ok := <-o.ch
+	if !ok {
+		return NULL{}, false
+	}
+	return val, true
+}
+
+// Closing a channel more than once does nothing
+func (o *ObjChannel) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.ch)
+	}
+}
+
+// Types of the properties and methods of channels and threads for the
+// compiler. What goes through a channel and what a thread gives back depend
+// on how they were made
+func ChannelMethods(elemType ValueType) map[string]BuiltinMethod {
+	return map[string]BuiltinMethod{
+		"send":    {1, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+		"receive": {0, ElementData(elemType)},
+		"close":   {0, ExpressionData{Value: VAL_NIL, ObjType: VAR_SCALAR}},
+	}
+}
+
+var ChannelProperties = map[string]ExpressionData{
+	"size": {Value: VAL_INTEGER, ObjType: VAR_SCALAR},
+}
+
+func ThreadMethods(resultType ValueType) map[string]BuiltinMethod {
+	return map[string]BuiltinMethod{
+		"wait": {0, ExpressionData{Value: resultType, ObjType: VAR_SCALAR}},
+	}
+}
+
+var ThreadProperties = map[string]ExpressionData{
+	"done": {Value: VAL_BOOL, ObjType: VAR_SCALAR},
+}
+
+// The type of what goes through a channel as the compiler sees it. Arrays go
+// through as values of a type only known when the program runs
+func ElementData(valType ValueType) ExpressionData {
+	switch valType {
+	case VAL_LIST:
+		return ExpressionData{Value: VAL_LIST, ObjType: VAR_HASH}
+	case VAL_TABLE:
+		return ExpressionData{Value: VAL_TABLE, ObjType: VAR_TABLE}
+	case VAL_FUNCTION:
+		return ExpressionData{Value: VAL_FUNCTION, ObjType: VAR_FUNCTION}
+	case VAL_FILE:
+		return ExpressionData{Value: VAL_FILE, ObjType: VAR_FILE}
+	case VAL_CHANNEL:
+		return ExpressionData{Value: VAL_CHANNEL, ObjType: VAR_CHANNEL}
+	case VAL_THREAD:
+		return ExpressionData{Value: VAL_THREAD, ObjType: VAR_THREAD}
+	case VAL_CONNECTION:
+		return ExpressionData{Value: VAL_CONNECTION, ObjType: VAR_CONNECTION}
+	case VAL_LISTENER:
+		return ExpressionData{Value: VAL_LISTENER, ObjType: VAR_LISTENER}
+	case VAL_ARRAY:
+		return ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	}
+	return ExpressionData{Value: valType, ObjType: VAR_SCALAR}
+}
+
+// The other way round: the value type a channel is declared with
+func ElementValue(data ExpressionData) ValueType {
+	switch data.ObjType {
+	case VAR_ARRAY:
+		return VAL_ARRAY
+	case VAR_HASH:
+		return VAL_LIST
+	}
+	return data.Value
+}
+
+/* ---------------------------------------------------------------------------
+Running a thread
+------------------------------------------------------------------------------*/
+
+// A VM for a thread. It has a stack, frames and registers of its own and
+// copies of the globals, and shares the databases, modules and open files of
+// the VM that spawned it
+func (v *VM) NewThreadVM(copies map[Obj]Obj) *VM {
+	vm := &VM{
+		Stack:     make([]Obj, 1024),
+		Globals:   make([]Obj, len(v.Globals)),
+		Registers: make([]int64, 256),
+		Frames:    make([]CallFrame, 1024),
+
+		DFRegister: make(map[string]*ObjDataFrame),
+		DbList:     make(map[string]*sql.DB),
+		db:         v.db,
+
+		Modules:      v.Modules,
+		ModuleLoaded: append([]bool(nil), v.ModuleLoaded...),
+		Files:        v.Files,
+		Interactive:  true,
+	}
+	for name, db := range v.DbList {
+		vm.DbList[name] = db
+	}
+	for i, val := range v.Globals {
+		vm.Globals[i] = ThreadCopy(val, copies)
+	}
+
+	// The bottom frame stands in for the code that started the thread, so a
+	// stack trace ends where the thread came from. The thread never returns
+	// to it
+	vm.Frame = &vm.Frames[0]
+	vm.Frame.Closure = v.Frame.Closure
+	vm.Frame.ip = v.Frame.ip
+	vm.Frame.slots = vm.Stack[:]
+	vm.fp = 1
+	return vm
+}
+
+// Starts the closure on a thread of its own
+func (v *VM) Spawn(closure *ObjClosure, args []Obj) *ObjThread {
+	thread := &ObjThread{done: make(chan struct{})}
+	copies := make(map[Obj]Obj)
+	vm := v.NewThreadVM(copies)
+	closure = ThreadCopy(closure, copies).(*ObjClosure)
+	for i := range args {
+		args[i] = ThreadCopy(args[i], copies)
+	}
+
+	go func() {
+		defer close(thread.done)
+		defer func() {
+			if r := recover(); r != nil {
+				thread.err = vm.ToRuntimeError(r)
+			}
+		}()
+		thread.result = vm.CallClosure(closure, args...)
+	}()
+	return thread
+}
+
+// Copies what a thread mustn't share with the thread that spawned it. A value
+// that's reached more than once is copied once, so the copies hold on to
+// each other the way the originals do
+func ThreadCopy(val Obj, copies map[Obj]Obj) Obj {
+	switch val.(type) {
+	case *ObjArray, *ObjList, *ObjInstance, *ObjRange, *ObjClosure:
+		if c, ok := copies[val]; ok {
+			return c
+		}
+	default:
+		return val
+	}
+
+	switch o := val.(type) {
+	case *ObjArray:
+		c := *o
+		copies[val] = &c
+		c.Dimensions = append([]int(nil), o.Dimensions...)
+		c.Elements = make([]Obj, len(o.Elements))
+		for i, elem := range o.Elements {
+			c.Elements[i] = ThreadCopy(elem, copies)
+		}
+		return &c
+	case *ObjList:
+		c := *o
+		copies[val] = &c
+		c.List = make(map[HashKey]Obj, len(o.List))
+		for key, elem := range o.List {
+			c.List[key] = ThreadCopy(elem, copies)
+		}
+		c.Keys = append([]Obj(nil), o.Keys...)
+		return &c
+	case *ObjInstance:
+		c := &ObjInstance{Class: o.Class, Fields: make(map[string]Obj, len(o.Fields))}
+		copies[val] = c
+		for name, field := range o.Fields {
+			c.Fields[name] = ThreadCopy(field, copies)
+		}
+		return c
+	case *ObjRange:
+		c := *o
+		copies[val] = &c
+		return &c
+	case *ObjClosure:
+		c := *o
+		copies[val] = &c
+		c.Upvalues = make([]*ObjUpvalue, len(o.Upvalues))
+		for i, upvalue := range o.Upvalues {
+			if upvalue == nil {
+				continue
+			}
+			// The copy is closed over a copy of the value, wherever the
+			// original lives
+			closed := &ObjUpvalue{Location: upvalue.Location}
+			closed.Closed = ThreadCopy(*upvalue.Reference, copies)
+			closed.Reference = &closed.Closed
+			c.Upvalues[i] = closed
+		}
+		return &c
+	}
+	return val
+}
+
+/* ---------------------------------------------------------------------------
+Methods and properties
+------------------------------------------------------------------------------*/
+
+// Calls a method of a channel. The channel is on the stack under its arguments
+func (v *VM) ChannelMethodCall(c *ObjChannel, name string, argCount int) {
+	args := make([]Obj, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.Pop()
+	}
+	v.Pop()
+
+	switch name {
+	case "send":
+		if !c.Send(args[0]) {
+			v.Error("Can't send on a closed channel")
+		}
+		v.Push(NULL{})
+	case "receive":
+		val, _ := c.Receive()
+		v.Push(val)
+	case "close":
+		c.Close()
+		v.Push(NULL{})
+	default:
+		v.Error("Channel has no method named '%s'", name)
+	}
+}
+
+func (v *VM) ChannelProperty(c *ObjChannel, name string) Obj {
+	switch name {
+	case "size":
+		return ObjInteger(len(c.ch))
+	}
+	v.Error("Channel has no property named '%s'", name)
+	return nil
+}
+
+// Calls a method of a thread. The thread is on the stack under its arguments
+func (v *VM) ThreadMethodCall(t *ObjThread, name string, argCount int) {
+	for i := 0; i <= argCount; i++ {
+		v.Pop()
+	}
+
+	switch name {
+	case "wait":
+		result, err := t.Wait()
+		if err != nil {
+			panic(err)
+		}
+		v.Push(result)
+	default:
+		v.Error("Thread has no method named '%s'", name)
+	}
+}
+
+func (v *VM) ThreadProperty(t *ObjThread, name string) Obj {
+	switch name {
+	case "done":
+		return &ObjBool{Value: t.Done()}
+	}
+	v.Error("Thread has no property named '%s'", name)
+	return nil
+}
+
+/* ---------------------------------------------------------------------------
+Select
+------------------------------------------------------------------------------*/
+
+// How each case of a select statement is used
+const (
+	SELECT_RECEIVE int16 = iota
+	SELECT_SEND
+	SELECT_DEFAULT
+)
+
+// Waits for the first of the cases that can go ahead and gives back which
+// one it was. A receive case gets the value pushed on the stack for its
+// block. The channels, and the values to send, are on the stack in the order
+// of the cases
+func (v *VM) Select(kinds []int16) int {
+	cases := make([]reflect.SelectCase, len(kinds))
+	channels := make([]*ObjChannel, len(kinds))
+	for i := len(kinds) - 1; i >= 0; i-- {
+		switch kinds[i] {
+		case SELECT_DEFAULT:
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectDefault}
+		case SELECT_RECEIVE:
+			channels[i] = v.Pop().(*ObjChannel)
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channels[i].ch)}
+		case SELECT_SEND:
+			channels[i] = v.Pop().(*ObjChannel)
+			val := ThreadCopy(v.Pop(), make(map[Obj]Obj))
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(channels[i].ch), Send: reflect.ValueOf(&val).Elem()}
+		}
+	}
+
+	chosen, received := v.selectCase(cases)
+	if kinds[chosen] == SELECT_RECEIVE {
+		v.Push(received)
+	}
+	return chosen
+}
+
+// A receive from a closed channel gets nil
+func (v *VM) selectCase(cases []reflect.SelectCase) (int, Obj) {
+	defer func() {
+		if recover() != nil {
+			v.Error("Can't send on a closed channel")
+		}
+	}()
+	chosen, val, ok := reflect.Select(cases)
+	if !ok {
+		return chosen, NULL{}
+	}
+	return chosen, val.Interface().(Obj)
+}
@@ -301,6 +301,18 @@ const (
 	TOKEN_MODULE
 	TOKEN_IMPORT
 	TOKEN_DOUBLE_COLON
+	TOKEN_TRY
+	TOKEN_CATCH
+	TOKEN_FINALLY
+	TOKEN_THROW
+	TOKEN_LOAD
+	TOKEN_FILE
+	TOKEN_SPAWN
+	TOKEN_CHAN
+	TOKEN_THREAD
+	TOKEN_PFOR
+	TOKEN_CONNECTION
+	TOKEN_LISTENER
 )
 
 type TokenProperties struct {
@@ -396,8 +408,6 @@ var TokenLabels = map[string]TokenProperties{
 	// DDL statements
 	"create":   {TOKEN_CREATE, true},
 	"table":    {TOKEN_TABLE, true},
-	"column":   {TOKEN_COLUMN, true},
-	"row":      {TOKEN_ROW, true},
 	"view":     {TOKEN_VIEW, true},
 	"having":   {TOKEN_HAVING, true},
 	"distinct": {TOKEN_DISTINCT, true},
@@ -427,6 +437,18 @@ var TokenLabels = map[string]TokenProperties{
 	"module":      {TOKEN_MODULE, true},
 	"import":      {TOKEN_IMPORT, true},
 	"::":		   {TOKEN_DOUBLE_COLON, true},
+	"try":         {TOKEN_TRY, true},
+	"catch":       {TOKEN_CATCH, true},
+	"finally":     {TOKEN_FINALLY, true},
+	"throw":       {TOKEN_THROW, true},
+	"load":        {TOKEN_LOAD, true},
+	"file":        {TOKEN_FILE, true},
+	"spawn":       {TOKEN_SPAWN, true},
+	"chan":        {TOKEN_CHAN, true},
+	"thread":      {TOKEN_THREAD, true},
+	"pfor":        {TOKEN_PFOR, true},
+	"connection":  {TOKEN_CONNECTION, true},
+	"listener":    {TOKEN_LISTENER, true},
 }
 var SqlTokenLabels = map[string]TokenProperties{
 	// SQL Commnads
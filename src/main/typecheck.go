@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* ---------------------------------------------------------------------------
+Compile time type checking. Every expression leaves exactly one ExpressionData
+on the ExpressionValue stack describing the value it leaves on the VM's stack.
+Operators pop the types of their operands, check them and push the type of
+their result. Statements throw away whatever their expressions left behind.
+
+Type errors don't put the parser into panic mode since the parser hasn't lost
+its place, so a single compile reports every type error in the file.
+
+Some types can't be known at compile time, such as the value of a property or
+of a call to a function held in a parameter. Those are nil here and anything
+goes: the VM raises a runtime error if the value turns out to be wrong.
+------------------------------------------------------------------------------*/
+
+// What the checker decided about an operator and its operands
+type OperatorCheck struct {
+	OpCode     byte
+	Result     ExpressionData
+	WidenLeft  bool // The left operand is an int that has to become a float
+	WidenRight bool // Same for the right operand
+}
+
+func IsUnknownType(data ExpressionData) bool {
+	return data.Value == VAL_NIL
+}
+
+// Classes and the objects made from them, whose class the compiler keeps track
+// of through CurrentClass
+func IsClassType(data ExpressionData) bool {
+	return data.ObjType == VAR_CLASS || data.ObjType == VAR_OBJECT
+}
+
+func IsNumericType(data ExpressionData) bool {
+	return IsScalarType(data) && (data.Value == VAL_INTEGER || data.Value == VAL_FLOAT)
+}
+
+func IsScalarType(data ExpressionData) bool {
+	return data.ObjType == VAR_SCALAR || data.ObjType == VAR_UNKNOWN
+}
+
+// Describes a type the way the user wrote it
+func TypeName(data ExpressionData) string {
+	switch {
+	case IsUnknownType(data):
+		return "unknown"
+	case data.ObjType == VAR_ARRAY:
+		return fmt.Sprintf("%s[]", ValueTypeLabel[data.Value])
+	case data.ObjType == VAR_HASH:
+		return "list"
+	case data.ObjType == VAR_CHANNEL:
+		return "chan " + TypeName(ElementData(data.Returns))
+	case IsScalarType(data):
+		return ValueTypeLabel[data.Value]
+	default:
+		return VarTypeLabel[data.ObjType]
+	}
+}
+
+var scalarBool = ExpressionData{Value: VAL_BOOL, ObjType: VAR_SCALAR}
+var scalarInteger = ExpressionData{Value: VAL_INTEGER, ObjType: VAR_SCALAR}
+var scalarFloat = ExpressionData{Value: VAL_FLOAT, ObjType: VAR_SCALAR}
+var scalarString = ExpressionData{Value: VAL_STRING, ObjType: VAR_SCALAR}
+
+// The integer and float versions of the arithmetic operators
+var arithmeticOps = map[TokenType][2]byte{
+	TOKEN_PLUS:  {OP_IADD, OP_FADD},
+	TOKEN_MINUS: {OP_ISUBTRACT, OP_FSUBTRACT},
+	TOKEN_STAR:  {OP_IMULTIPLY, OP_FMULTIPLY},
+	TOKEN_SLASH: {OP_IDIVIDE, OP_FDIVIDE},
+	TOKEN_HAT:   {OP_IEXP, OP_FEXP},
+}
+
+var comparisonOps = map[TokenType]byte{
+	TOKEN_EQUAL_EQUAL:   OP_EQUAL,
+	TOKEN_BANG_EQUAL:    OP_NOT_EQUAL,
+	TOKEN_GREATER:       OP_GREATER,
+	TOKEN_GREATER_EQUAL: OP_GREATER_EQUAL,
+	TOKEN_LESS:          OP_LESS,
+	TOKEN_LESS_EQUAL:    OP_LESS_EQUAL,
+}
+
+func CheckBinary(opToken Token, left ExpressionData, right ExpressionData) (OperatorCheck, error) {
+	var check OperatorCheck
+	operator := opToken.Type
+	opName := opToken.ToString()
+
+	if ops, ok := arithmeticOps[operator]; ok {
+		switch {
+		case operator == TOKEN_PLUS && left.Value == VAL_STRING && right.Value == VAL_STRING:
+			check.OpCode = OP_SADD
+			check.Result = scalarString
+
+		case IsNumericType(left) && IsNumericType(right):
+			if left.Value == VAL_INTEGER && right.Value == VAL_INTEGER {
+				check.OpCode = ops[0]
+				check.Result = scalarInteger
+			} else {
+				check.OpCode = ops[1]
+				check.Result = scalarFloat
+				check.WidenLeft = left.Value == VAL_INTEGER
+				check.WidenRight = right.Value == VAL_INTEGER
+			}
+
+		case IsUnknownType(left) || IsUnknownType(right):
+			// Go by whichever side we know about
+			known := left
+			if IsUnknownType(left) {
+				known = right
+			}
+			check.OpCode = ops[0]
+			check.Result = known
+			switch {
+			case known.Value == VAL_FLOAT:
+				check.OpCode = ops[1]
+			case known.Value == VAL_STRING && operator == TOKEN_PLUS:
+				check.OpCode = OP_SADD
+			case !IsUnknownType(known) && !IsNumericType(known):
+				return check, fmt.Errorf("Operator '%s' can't be applied to %s", opName, TypeName(known))
+			}
+
+		default:
+			return check, fmt.Errorf("Operator '%s' can't be applied to %s and %s", opName, TypeName(left), TypeName(right))
+		}
+		return check, nil
+	}
+
+	if opCode, ok := comparisonOps[operator]; ok {
+		check.OpCode = opCode
+		check.Result = scalarBool
+
+		ordering := operator != TOKEN_EQUAL_EQUAL && operator != TOKEN_BANG_EQUAL
+		switch {
+		case IsUnknownType(left) || IsUnknownType(right):
+			// Nothing to widen: the VM compares an int with a float by value
+		case IsNumericType(left) && IsNumericType(right):
+			// Mixed comparisons are done on floats
+			if left.Value != right.Value {
+				check.WidenLeft = left.Value == VAL_INTEGER
+				check.WidenRight = right.Value == VAL_INTEGER
+			}
+		case ordering && (!IsScalarType(left) || left.Value != VAL_STRING || right.Value != VAL_STRING):
+			return check, fmt.Errorf("Operator '%s' can't compare %s with %s", opName, TypeName(left), TypeName(right))
+		case left.Value != right.Value || left.ObjType != right.ObjType:
+			return check, fmt.Errorf("Can't compare %s with %s", TypeName(left), TypeName(right))
+		}
+		return check, nil
+	}
+
+	return check, fmt.Errorf("Unknown operator '%s'", opName)
+}
+
+// Checks that a value can be stored in a variable of the given type. Ints
+// can go into floats as long as they get converted first
+func CheckAssignment(target ExpressionData, value ExpressionData) (widen bool, ok bool) {
+	if IsUnknownType(target) || IsUnknownType(value) {
+		return false, true
+	}
+	if target.ObjType == VAR_SCALAR && value.ObjType == VAR_SCALAR &&
+		target.Value == VAL_FLOAT && value.Value == VAL_INTEGER {
+		return true, true
+	}
+	// The type of a list doesn't say what it holds, so any list goes with
+	// any other
+	if target.ObjType == VAR_HASH && value.ObjType == VAR_HASH {
+		return false, true
+	}
+	// Channels only go together if what goes through them does
+	if target.ObjType == VAR_CHANNEL && value.ObjType == VAR_CHANNEL &&
+		target.Returns != VAL_NIL && value.Returns != VAL_NIL && target.Returns != value.Returns {
+		return false, false
+	}
+	return false, target.Value == value.Value && target.ObjType == value.ObjType
+}
+
+// Reports a type error. Unlike syntax errors, these don't stop us reporting
+// the errors that come after them
+func (c *Compiler) TypeError(token Token, message string) {
+	fmt.Printf("[line %d] Type error at '%s': %s\n", token.Line+1, token.Value, message)
+	c.Diagnose(&token, message, false)
+	c.Parser.HadError = true
+}
+
+// Whether two types are exactly the same, with no widening
+func SameType(a ExpressionData, b ExpressionData) bool {
+	return a.Value == b.Value && a.ObjType == b.ObjType && a.Dimensions == b.Dimensions &&
+		(a.ObjType != VAR_CHANNEL || a.Returns == b.Returns)
+}
+
+// Whether two methods take the same parameters and give back the same type
+func SameSignature(params1 []ExpressionData, returns1 ValueType, params2 []ExpressionData, returns2 ValueType) bool {
+	if len(params1) != len(params2) || returns1 != returns2 {
+		return false
+	}
+	for i := range params1 {
+		if !SameType(params1[i], params2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Describes the parameters and return type of a method, as in (int, string) float
+func Signature(params []ExpressionData, returns ValueType) string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = TypeName(param)
+	}
+	signature := "(" + strings.Join(names, ", ") + ")"
+	if returns != VAL_NIL {
+		signature += " " + ValueTypeLabel[returns]
+	}
+	return signature
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"hash/fnv"
+	"sync/atomic"
 )
 
 type Obj interface {
@@ -95,17 +96,43 @@ type ObjFunction struct {
 	Upvalues     []ObjUpvalue
 	FuncType     FunctionType
 	Id           int
+	Name         string
+	LocalSlots   int // Slots reserved for locals at the bottom of the frame
+
+	// Source names for the debugger. Only compiled source has them; they
+	// don't get written to bytecode
+	Locals       []LocalInfo
+	UpvalueNames []string
+}
+
+// Where a local lives and the stretch of code it's in scope for. Slots get
+// reused by later scopes so the name alone isn't enough
+type LocalInfo struct {
+	Name  string
+	Slot  int
+	Start int // Offset of the first byte of code the local is in scope for
+	End   int // Offset just past the last one, or -1 for the rest of the function
+
+	Register bool // A FOR loop variable, which lives in a VM register rather than a slot
+}
+
+func (i *LocalInfo) InScope(offset int) bool {
+	return offset >= i.Start && (i.End == -1 || offset < i.End)
 }
 
 type NativeFn func(vm *VM, argCounts int, stackPos int) Obj
 
 type ObjNative struct {
+	Name       string // Name it was registered under
 	Function   *NativeFn
 	hasReturn  bool // Is there an explicit return?
 	ReturnType ExpressionData
+	Params     []ExpressionData // Types of the arguments, if they get checked
+	Variadic   bool             // The last parameter can be repeated
+	Optional   int              // How many of the last parameters can be left out
 }
 
-var ClosureId int
+var ClosureId int64 // Threads make closures at the same time, so it only changes atomically
 
 type ObjClosure struct {
 	Function     *ObjFunction
@@ -114,7 +141,7 @@ type ObjClosure struct {
 	Id           int
 }
 
-var ObjLocation int // Global increment value
+var ObjLocation int64 // Global increment value, changed atomically
 
 type ObjUpvalue struct {
 	Reference *Obj
@@ -128,6 +155,7 @@ type ObjList struct {
 	HValueType   ExpressionData
 	ElementCount int
 	List         map[HashKey]Obj
+	Keys         []Obj // In the order they were added
 }
 
 var ClassId int
@@ -206,28 +234,39 @@ func (l *ObjList) Init(keyType ValueType, elementCount int) {
 }
 
 func (l ObjList) GetValue(obj Obj) Obj {
-	if obj.Type() == VAL_STRING {
-		return l.List[obj.(ObjString).HashValue()]
-	} else {
-		return nil
+	val, ok := l.List[ListKey(obj)]
+	if !ok {
+		RaiseRuntimeError("Key '%s' not found in list", obj.ShowValue())
 	}
+	return val
 }
 
-func (l ObjList) AddNew(key Obj, val Obj) {
-	l.List[key.(ObjString).HashValue()] = val
+func (l *ObjList) AddNew(key Obj, val Obj) {
+	l.SetValue(key, val)
 }
 
-func (l ObjList) SetValue(obj Obj, val Obj) {
-	var hVal HashKey
-	switch l.KeyType {
-	case VAL_INTEGER:
-		hVal = obj.(ObjInteger).HashValue()
-	case VAL_STRING:
-		hVal = obj.(ObjString).HashValue()
+// Keys that are new go to the end of the list's keys so that the list can be
+// walked in the order it was filled
+func (l *ObjList) SetValue(obj Obj, val Obj) {
+	hVal := ListKey(obj)
+	if _, ok := l.List[hVal]; !ok {
+		l.Keys = append(l.Keys, obj)
 	}
 	l.List[hVal] = val
 }
 
+// The hash a key gets stored under
+func ListKey(obj Obj) HashKey {
+	switch obj.Type() {
+	case VAL_STRING:
+		return obj.(ObjString).HashValue()
+	case VAL_INTEGER:
+		return obj.(ObjInteger).HashValue()
+	}
+	RaiseRuntimeError("A list key can't be of type %s", ValueTypeLabel[obj.Type()])
+	return HashKey{}
+}
+
 // Upvalue functions
 func (u ObjUpvalue) ShowValue() string {
 	return fmt.Sprintf("%s", "Upvalue")
@@ -244,9 +283,7 @@ func NewUpvalue(slot *Obj) *ObjUpvalue {
 	upvalue.Reference = slot
 	upvalue.Closed = new(NULL)
 	upvalue.Next = nil
-	upvalue.Location = ObjLocation
-
-	ObjLocation++
+	upvalue.Location = int(atomic.AddInt64(&ObjLocation, 1) - 1)
 
 	return upvalue
 }
@@ -263,7 +300,7 @@ func NewClosure(function *ObjFunction) *ObjClosure {
 	// upvalues in the enclosed function
 	upvalues := make([]*ObjUpvalue, function.UpvalueCount)
 	// Increment the ID
-	ClosureId++
+	id := atomic.AddInt64(&ClosureId, 1) - 1
 
 	// Return the closure with a pointer to the function,
 	// the array of upvalues and the count
@@ -271,7 +308,7 @@ func NewClosure(function *ObjFunction) *ObjClosure {
 		Function:     function,
 		Upvalues:     upvalues,
 		UpvalueCount: int16(function.UpvalueCount),
-		Id:           ClosureId - 1,
+		Id:           int(id),
 	}
 }
 
@@ -280,6 +317,20 @@ func (f ObjFunction) ShowValue() string {
 	return fmt.Sprintf("%s", "<fn>")
 }
 func (f ObjFunction) Type() ValueType      { return VAL_FUNCTION }
+
+// The name we show for this function in stack traces
+func (f ObjFunction) DisplayName() string {
+	switch {
+	case f.FuncType == TYPE_SCRIPT && f.Name != "":
+		return "module " + f.Name
+	case f.FuncType == TYPE_SCRIPT:
+		return "script"
+	case f.Name == "":
+		return "<anonymous>()"
+	default:
+		return f.Name + "()"
+	}
+}
 func (f ObjFunction) ToBytes() []byte      { return nil }
 func (f ObjFunction) ToValue() interface{} { return f.ShowValue() }
 func (f ObjFunction) Print() string {
@@ -472,33 +523,40 @@ func (a ObjArray) Position() int {
 }
 
 func (a ObjArray) GetElement(indexes ...int64) Obj {
-	if len(indexes) == 1 {
-		return a.Elements[indexes[0]]
-	} else {
-		pos := int64(0)
-
-		// Starting at the second dimenstion
-		for i:=1;i<a.DimCount;i++ {
-			pos += int64(a.Dimensions[i])*int64(indexes[i-1])
-		}
-		pos += indexes[a.DimCount-1]
-		return a.Elements[pos]
-	}
+	return a.Elements[a.ElementPosition(indexes...)]
 }
 
 func (a ObjArray) SetElement(val Obj, indexes ...int64) {
+	a.Elements[a.ElementPosition(indexes...)] = val
+}
+
+// Translates the indexes into a position in the element store and raises a
+// runtime error if any of them falls outside of the array
+func (a ObjArray) ElementPosition(indexes ...int64) int64 {
 	if len(indexes) == 1 {
-		a.Elements[indexes[0]] = val
-	} else {
-		pos := int64(0)
+		if indexes[0] < 0 || indexes[0] >= int64(len(a.Elements)) {
+			RaiseRuntimeError("Array index %d out of range for an array of %d elements", indexes[0], len(a.Elements))
+		}
+		return indexes[0]
+	}
 
-		// Starting at the second dimenstion
-		for i:=1;i<a.DimCount;i++ {
-			pos += int64(a.Dimensions[i])*int64(indexes[i-1])
+	if len(indexes) != a.DimCount {
+		RaiseRuntimeError("Array has %d dimensions but %d indexes were given", a.DimCount, len(indexes))
+	}
+	for i := range indexes {
+		if indexes[i] < 0 || indexes[i] >= int64(a.Dimensions[i]) {
+			RaiseRuntimeError("Array index %d out of range for dimension %d of size %d", indexes[i], i+1, a.Dimensions[i])
 		}
-		pos += indexes[a.DimCount-1]
-		a.Elements[pos] = val
 	}
+
+	pos := int64(0)
+
+	// Starting at the second dimenstion
+	for i:=1;i<a.DimCount;i++ {
+		pos += int64(a.Dimensions[i])*int64(indexes[i-1])
+	}
+	pos += indexes[a.DimCount-1]
+	return pos
 }
 
 type ObjEnum struct {
@@ -561,6 +619,22 @@ type ObjInstance struct  {
 	Fields map[string]Obj
 }
 
+// An object of the class. It shares the methods of the class but gets a copy
+// of each of the defaults of its properties, so that no two objects share a
+// list or an array
+func NewInstance(class *ObjClass) *ObjInstance {
+	inst := &ObjInstance{Class: class, Fields: make(map[string]Obj, len(class.Fields))}
+	copies := make(map[Obj]Obj)
+	for name, field := range class.Fields {
+		if _, ok := field.(*ObjClosure); ok {
+			inst.Fields[name] = field
+		} else {
+			inst.Fields[name] = ThreadCopy(field, copies)
+		}
+	}
+	return inst
+}
+
 func (o ObjInstance) ShowValue() string {
 	return "<OBJ>"
 }
@@ -11,6 +11,15 @@ type ExpressionData struct {
 	ObjType VarType
 	//DataType string
 	Dimensions int // Relevant only for arrays and matrices
+	Returns    ValueType // Relevant only for functions, channels and threads: the type a call, receive or wait produces
+	Signature  *FunctionSignature // Relevant only for functions whose declaration the compiler has seen
+}
+
+// The parameters and the return type of a function, so that calls to it can
+// be checked
+type FunctionSignature struct {
+	Params  []ExpressionData
+	Returns ExpressionData
 }
 
 var ExpressionValue = make([]ExpressionData, 255)
@@ -23,6 +32,11 @@ func PushExpressionValue(data ExpressionData) {
 }
 
 func PopExpressionValue() ExpressionData {
+	// Code that didn't compile properly can leave the stack short. The
+	// error has been reported by then so just carry on with an unknown type
+	if ExpressionValueId == 0 {
+		return ExpressionData{Value: VAL_NIL, ObjType: VAR_UNKNOWN}
+	}
 	ExpressionValueId--
 	return ExpressionValue[ExpressionValueId]
 }
@@ -43,6 +57,8 @@ type PropertyVar struct {
 	Index          int16
 	ExprData       ExpressionData
 	HasValue       bool
+	IsMethod       bool
+	Params         []ExpressionData // The parameters of a method
 }
 func (v *PropertyVar) GetScopeType() VariableScope {
 	return CLASS_PROPERTY
@@ -55,6 +71,8 @@ type Global struct {
 	IsInitialized bool
 	Class         *ClassVar
 	ExprData      ExpressionData
+	Access        AccessorType // Private globals can't be used from other modules
+	Symbol        *Symbol      // Only set while the language server analyzes source
 }
 func (v *Global) GetScopeType() VariableScope {
 	return GLOBAL
@@ -73,6 +91,8 @@ type Local struct {
 	Class         *ClassVar
 	Function	  *FunctionVar
 	ExprData  ExpressionData
+	Symbol    *Symbol
+	infoIndex int // Its entry in the function's LocalInfo
 
 }
 func (v *Local) GetScopeType() VariableScope {
@@ -80,10 +100,12 @@ func (v *Local) GetScopeType() VariableScope {
 }
 
 type Upvalue struct {
+	name     string
 	Index    int16
 	IsLocal  bool
 	ExprData  ExpressionData
 	Class    *ClassVar
+	Symbol   *Symbol
 }
 func (v *Upvalue) GetScopeType() VariableScope {
 	return UPVALUE
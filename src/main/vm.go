@@ -30,6 +30,8 @@ type CallFrame struct {
 	ip      int
 	slots   []Obj
 	slotptr int
+
+	Handlers []ExceptionHandler // try blocks currently open in this frame
 }
 
 type VM struct {
@@ -53,15 +55,43 @@ type VM struct {
 	ObjRegister      []Obj
 
 	DFRegister		 map[string]*ObjDataFrame
+	Files            *OpenFiles // Closed when the program ends
+
+	Modules      []*ObjModule // Every module the program can import
+	ModuleLoaded []bool       // Whether the module's top level code has run yet
 
 	OpenUpvalues     *ObjUpvalue
 	DebugMode        bool
+	Interactive      bool // Under the REPL, which doesn't announce the end of every input
+	Debugger         *Debugger
+
+	loopDepth int // How many FOR/SCAN loops deep we're dispatching
 }
 
 func (v *VM) GetByteCode() *[]byte {
 	return &v.Frame.Closure.Function.Code.Code
 }
 
+// The source line of the instruction the current frame is executing
+func (v *VM) CurrentLine() int {
+	return v.LineOf(v.Frame)
+}
+
+// The source file of the function the current frame is executing
+func (v *VM) CurrentFile() string {
+	if v.Frame == nil || v.Frame.Closure == nil {
+		return ""
+	}
+	return v.Frame.Closure.Function.Code.File
+}
+
+func (v *VM) LineOf(frame *CallFrame) int {
+	if frame == nil || frame.Closure == nil {
+		return 0
+	}
+	return frame.Closure.Function.Code.GetLine(frame.ip)
+}
+
 func (v *VM) PushFrame() {
 	v.Frame = &v.Frames[v.fp]
 	v.Frame.ip = -1
@@ -127,32 +157,6 @@ func (v *VM) NewUpvalue(slot int) ObjUpvalue {
 	}
 }
 
-func (v *VM) CaptureUpvalue(local *Obj, localIndex int) *ObjUpvalue {
-	var prevUpvalue *ObjUpvalue
-	upvalue := v.OpenUpvalues
-
-	// If there is an upvalue and it's local
-	for upvalue != nil && upvalue.Location > localIndex {
-		fmt.Printf("(1)\n")
-		prevUpvalue = upvalue
-		upvalue = upvalue.Next
-	}
-
-	if upvalue != nil && upvalue.Location == localIndex {
-		fmt.Printf("(2)\n")
-		return upvalue
-	}
-
-	createdUpvalue := NewUpvalue(local)
-	createdUpvalue.Next = upvalue
-	if prevUpvalue == nil {
-		v.OpenUpvalues = createdUpvalue
-	} else {
-		prevUpvalue.Next = createdUpvalue
-	}
-	return createdUpvalue
-}
-
 func (v *VM) CloseUpvalues(last *Obj, objIndex int) {
 	for v.OpenUpvalues != nil && v.OpenUpvalues.Location >= objIndex {
 		upvalue := v.OpenUpvalues
@@ -177,6 +181,26 @@ func (v *VM) MethodCall() {
 
 	idx := string(v.GetOperand().(ObjString))
 	argCount := int(v.GetOperandValue())
+	switch obj := v.Peek(argCount).(type) {
+	case *ObjDataFrame:
+		v.TableMethodCall(obj, idx, argCount)
+		return
+	case *ObjFile:
+		v.FileMethodCall(obj, idx, argCount)
+		return
+	case *ObjChannel:
+		v.ChannelMethodCall(obj, idx, argCount)
+		return
+	case *ObjThread:
+		v.ThreadMethodCall(obj, idx, argCount)
+		return
+	case *ObjConnection:
+		v.ConnectionMethodCall(obj, idx, argCount)
+		return
+	case *ObjListener:
+		v.ListenerMethodCall(obj, idx, argCount)
+		return
+	}
 	classInst := v.Peek(argCount).(*ObjInstance)
 
 	fld := classInst.Fields[idx]
@@ -186,24 +210,65 @@ func (v *VM) MethodCall() {
 		v.sp += int(argCount)
 		v.Push(result)
 	} else {
-		closure := classInst.Fields[idx].(*ObjClosure)
+		v.InvokeMethod(classInst.Fields[idx].(*ObjClosure), argCount)
+	}
 
-		// Push the code into this new frame
-		v.Frame = &v.Frames[v.fp]
-		v.Frame.ip = -1
-		v.fp++
+}
 
-		v.Frame.Closure = closure
-		// Reference to the code block
-		v.Code = v.Frame.Closure.Function.Code.Code[:]
-		// This frame's slots line up with the stacks at the point where
-		// the function and the parameters begin on the stack
-		start := v.sp - int(argCount) - 1
+// Starts a method on the object that's on the stack under its arguments. The
+// object becomes this
+func (v *VM) InvokeMethod(closure *ObjClosure, argCount int) {
 
-		v.Frame.slots = v.Stack[start:]
-		v.Frame.slotptr = start //+ 1
+	// Push the code into this new frame
+	v.Frame = &v.Frames[v.fp]
+	v.Frame.ip = -1
+	v.fp++
+
+	v.Frame.Closure = closure
+	// Reference to the code block
+	v.Code = v.Frame.Closure.Function.Code.Code[:]
+	// This frame's slots line up with the stacks at the point where
+	// the function and the parameters begin on the stack
+	start := v.sp - int(argCount) - 1
+
+	v.Frame.slots = v.Stack[start:]
+	v.Frame.slotptr = start //+ 1
+	v.Frame.Handlers = v.Frame.Handlers[:0]
+	v.ReserveLocals(start, closure.Function.LocalSlots)
+}
+
+// Runs the init method of a new object with the arguments on top of it. The
+// object goes on the stack again under the arguments to be this, so the
+// object itself is left under what init returns
+func (v *VM) InitInstance(argCount int) {
+	inst := v.Peek(argCount).(*ObjInstance)
+	method, ok := inst.Fields["init"].(*ObjClosure)
+	if !ok {
+		if argCount > 0 {
+			v.Error("The class has no init method to take the %d arguments", argCount)
+		}
+		v.Push(NULL{})
+		return
+	}
+	v.Push(nil)
+	for i := v.sp - 1; i > v.sp-1-argCount; i-- {
+		v.Stack[i] = v.Stack[i-1]
 	}
+	v.Stack[v.sp-1-argCount] = inst
+	v.InvokeMethod(method, argCount)
+}
 
+// Calls the method a parent class has on this, even when the class of this
+// has replaced it. The parent is on top of the arguments
+func (v *VM) SuperInvoke() {
+	name := string(v.GetOperand().(ObjString))
+	argCount := int(v.GetOperandValue())
+	parent := v.Pop().(*ObjClass)
+	method, ok := parent.Fields[name].(*ObjClosure)
+	if !ok {
+		v.Error("The parent class has no method named '%s'", name)
+	}
+	v.InvokeMethod(method, argCount)
 }
 
 func (v *VM) FunctionCall(argCount int16) {
@@ -212,6 +277,27 @@ func (v *VM) FunctionCall(argCount int16) {
 	v.ExecCall(closure, argCount+1)
 }
 
+// Calls a closure from Go, such as from a native that takes a function, and
+// runs it to completion. The call counts as a loop level so that a try block
+// in the closure catches its own errors while the rest go up to the caller
+func (v *VM) CallClosure(closure *ObjClosure, args ...Obj) Obj {
+	depth := v.fp
+	v.Push(closure)
+	for _, arg := range args {
+		v.Push(arg)
+	}
+	v.ExecCall(closure, int16(len(args)+1))
+
+	v.loopDepth++
+	for v.fp > depth {
+		v.Frame.ip++
+		v.SafeDispatch(v.Code[v.Frame.ip])
+	}
+	v.loopDepth--
+
+	return v.Pop()
+}
+
 func (v *VM) ExecCall(closure *ObjClosure, argCount int16) {
 	// Push the code into this new frame
 	v.Frame = &v.Frames[v.fp]
@@ -227,14 +313,50 @@ func (v *VM) ExecCall(closure *ObjClosure, argCount int16) {
 	//fmt.Printf("Start: %d STackValue: %v\n",start,v.Stack[start].ShowValue())
 	v.Frame.slots = v.Stack[start:]
 	v.Frame.slotptr = start
+	v.Frame.Handlers = v.Frame.Handlers[:0]
+	v.ReserveLocals(start, closure.Function.LocalSlots)
+}
+
+// Locals are kept in slots at the bottom of the frame, so the value
+// stack for the frame has to start above them
+func (v *VM) ReserveLocals(start int, slots int) {
+	if v.sp < start+slots {
+		v.sp = start + slots
+	}
 }
 
 /* --------------------------------------
 First call into the VM
  ---------------------------------------*/
-func Exec(source *string, dbgMode bool) {
+func Exec(source *string, path string, dbgMode bool) InterpretResult {
+	mod := Compile(source, path, dbgMode)
+	if mod == nil || mod.MainFunction == nil {
+		fmt.Println("Compile error")
+		return INTERPRET_COMPILE_ERROR
+	}
+	return ExecModule(mod, dbgMode)
+}
+
+// Runs a module that has already been compiled, either just now from source
+// or loaded from a bytecode file
+func ExecModule(mod *ObjModule, dbgMode bool) InterpretResult {
 	debug.SetGCPercent(-1)
-	vm := VM{
+	vm := NewVM(mod.LoadedModules, dbgMode)
+	result := vm.Run(mod.MainFunction)
+	vm.CloseFiles()
+	return result
+}
+
+// Closes the files the program left open so that whatever was written to
+// them isn't lost
+func (v *VM) CloseFiles() {
+	for f, err := range v.Files.CloseAll() {
+		fmt.Printf("Can't close '%s': %s\n", f.Path, err.Error())
+	}
+}
+
+func NewVM(modules []*ObjModule, dbgMode bool) *VM {
+	vm := &VM{
 		fp:        0,
 		Stack:     make([]Obj, 1024),
 		Globals:   make([]Obj, 1024),
@@ -243,94 +365,144 @@ func Exec(source *string, dbgMode bool) {
 
 		DFRegister: make(map[string]*ObjDataFrame),
 		DbList: make(map[string]*sql.DB),
+		Files:  &OpenFiles{},
 
 		DebugMode: dbgMode,
+
+		Modules:      modules,
+		ModuleLoaded: make([]bool, len(modules)),
 	}
 	// Assigns the main - in memory db to the vm
 	vm.db = OpenDb(":memory:")
 	vm.DbList["main"] = vm.db
+	return vm
+}
 
-	//fn := Compile(source, dbgMode)
-	mod := Compile(source, dbgMode)
-	fn := mod.MainFunction
-	if fn == nil {
-		fmt.Println("Syntax error")
-		return
-	}
+// Runs a module's top level code from a clean stack. Globals, databases and
+// modules that already ran are left as they are, which is what lets the REPL
+// run one input after another in the same VM
+func (v *VM) Run(fn *ObjFunction) InterpretResult {
+	v.fp = 0
+	v.sp = 0
+	v.OpenUpvalues = nil
+	v.loopDepth = 0
 
-	vm.Frame = &vm.Frames[vm.fp]
-	vm.Frame.Closure = &ObjClosure{
+	v.Frame = &v.Frames[v.fp]
+	v.Frame.Closure = &ObjClosure{
 		Function:     fn,
 		Upvalues:     nil,
 		UpvalueCount: 0,
 		Id:           0,
 	}
 
-	vm.Frame.slots = vm.Stack[:]
-	vm.Code = fn.Code.Code[:]
-	vm.Frame.ip = -1
-
-	vm.fp++
+	v.Frame.slots = v.Stack[:]
+	v.Frame.Handlers = v.Frame.Handlers[:0]
+	v.Code = fn.Code.Code[:]
+	v.Frame.ip = -1
+	v.ReserveLocals(0, fn.LocalSlots)
 
-	vm.Interpret()
+	v.fp++
 
+	return v.Interpret()
 }
 
-func (v *VM) Interpret() {
+func (v *VM) Interpret() (result InterpretResult) {
+	// Anything that goes wrong while running the code ends up here so
+	// that we can report it against the Coyote source rather than Go's
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(debugQuit); ok {
+				panic(r)
+			}
+			v.ToRuntimeError(r).Print()
+			result = INTERPRET_RUNTIME_ERROR
+		}
+	}()
+
 	if v.DebugMode {
 		fmt.Println("=== VM Run ===")
 	}
-	codeLen := len(v.Code)
 	var opCode byte
 	for {
 		v.Frame.ip++
-		if codeLen == v.Frame.ip {
-			fmt.Println("Completed")
+		// The code changes with every call and return, so its length can't
+		// be taken once up front
+		if len(v.Code) == v.Frame.ip {
+			v.Completed()
 			break
 		}
 
 		opCode = v.Code[v.Frame.ip]
 		if opCode == OP_HALT {
-			fmt.Println("Completed")
+			v.Completed()
 			break
 		}
-		v.Dispatch(opCode)
+		v.SafeDispatch(opCode)
+	}
+	return INTERPRET_OK
+}
+
+func (v *VM) Completed() {
+	if !v.Interactive {
+		fmt.Println("Completed")
 	}
 }
 
 func (v *VM) Scan() {
-	// Get the object we're scanning from the stack
-	//obj := v.Peek(0)
+	bytes := int(v.GetOperandValue())
 
-	//switch obj.Type() {
-	//case VAL_ARRAY:
-	v.ScanArray()
-	//}
+	counterReg := int64(v.Pop().(ObjInteger))
+	localIndex := int64(v.Pop().(ObjInteger))
 
+	// Get the object we're scanning from the stack. Tables are scanned a
+	// row at a time, files and connections a line at a time and channels a
+	// value at a time until they're closed
+	switch obj := v.Pop().(type) {
+	case *ObjDataFrame:
+		v.ScanElements(Elements(obj.RowCount, func(i int) Obj { return obj.Row(int64(i)) }), localIndex, counterReg, bytes)
+	case *ObjFile:
+		v.ScanElements(func() (Obj, bool) { return v.FileLine(obj) }, localIndex, counterReg, bytes)
+	case *ObjChannel:
+		v.ScanElements(obj.Receive, localIndex, counterReg, bytes)
+	case *ObjConnection:
+		v.ScanElements(func() (Obj, bool) { return v.ConnectionLine(obj) }, localIndex, counterReg, bytes)
+	default:
+		array := obj.(*ObjArray)
+		v.ScanElements(Elements(array.ElementCount, func(i int) Obj { return array.GetElement(int64(i)) }), localIndex, counterReg, bytes)
+	}
 }
 
-// Handles the scan
-func (v *VM) ScanArray() {
-
-	bytes := int(v.GetOperandValue())
+// Goes through the elements of a collection of a known size one at a time
+func Elements(count int, element func(int) Obj) func() (Obj, bool) {
+	i := 0
+	return func() (Obj, bool) {
+		if i == count {
+			return nil, false
+		}
+		i++
+		return element(i - 1), true
+	}
+}
 
-	localIndex := int64(v.Pop().(ObjInteger))
-	counterReg := int64(v.Pop().(ObjInteger))
+// Runs the body of the scan once for each element, with the element in the
+// target variable. next gives the elements until there are no more, so a
+// collection doesn't need to be held in memory to be scanned
+func (v *VM) ScanElements(next func() (Obj, bool), localIndex int64, counterReg int64, bytes int) {
 
 	// Initialize the register
 	v.Registers[counterReg] = 0
 
-	// Get the object with an iterator
-	obj := v.Pop().(*ObjArray)
-	elements := obj.ElementCount
-
 	startIp := v.Frame.ip
 	stackPtr := v.sp
+	v.loopDepth++
 
 mainLoop:
-	for i := 0; i < elements; i++ {
-
-		v.Frame.slots[localIndex] = obj.GetElement(int64(i))
+	for {
+		element, ok := next()
+		if !ok {
+			break
+		}
+		v.Frame.slots[localIndex] = element
 		v.Registers[counterReg]++
 
 		for {
@@ -342,11 +514,12 @@ mainLoop:
 				v.Frame.ip = startIp
 				continue mainLoop
 			}
-			v.Dispatch(v.Code[v.Frame.ip])
+			v.SafeDispatch(v.Code[v.Frame.ip])
 		}
 		// Get back to where we were
 		v.Frame.ip = startIp
 	}
+	v.loopDepth--
 	v.Frame.ip = startIp + bytes
 	v.sp = stackPtr
 }
@@ -363,6 +536,7 @@ func (v *VM) ForLoop() {
 	// We're positioned at the current instruction
 	startIp := v.Frame.ip
 	stackPtr := v.sp
+	v.loopDepth++
 
 mainLoop:
 	for i := fromVal; i <= to; i += step {
@@ -379,11 +553,12 @@ mainLoop:
 				continue mainLoop
 			}
 			// Execute the instruction
-			v.Dispatch(v.Code[v.Frame.ip])
+			v.SafeDispatch(v.Code[v.Frame.ip])
 		}
 		// Get back to where we were
 		v.Frame.ip = startIp
 	}
+	v.loopDepth--
 	v.Frame.ip = startIp + bytes
 	v.sp = stackPtr
 }
@@ -466,10 +641,14 @@ func (v *VM) Dispatch(opCode byte) {
 		class.Fields[propertyName] = v.Pop()
 
 	case OP_OBJ_INSTANCE:
-		class := v.Pop().(*ObjClass)
-		iObj := &ObjInstance{Class:class}
-		iObj.Fields = class.Fields
-		v.Push(iObj)
+		class, ok := v.Pop().(*ObjClass)
+		if !ok {
+			v.Error("Objects can only be made from a class")
+		}
+		v.Push(NewInstance(class))
+
+	case OP_INIT:
+		v.InitInstance(int(v.GetOperandValue()))
 
 	case OP_CLASS:
 		class := &ObjClass{
@@ -477,6 +656,22 @@ func (v *VM) Dispatch(opCode byte) {
 		}
 		v.Push(class)
 
+	case OP_SUBCLASS:
+		// The class under the parent starts with everything the parent has.
+		// The parent stays on the stack for the class's methods to capture
+		parent, ok := v.Peek(0).(*ObjClass)
+		if !ok {
+			v.Error("A class can only inherit from another class, not a %s", ValueTypeLabel[v.Peek(0).Type()])
+		}
+		class := v.Peek(1).(*ObjClass)
+		class.Class = parent
+		for name, field := range parent.Fields {
+			class.Fields[name] = field
+		}
+
+	case OP_SUPER_INVOKE:
+		v.SuperInvoke()
+
 	case OP_CLOSURE:
 		{
 			function := v.GetOperand().(*ObjFunction)
@@ -487,14 +682,20 @@ func (v *VM) Dispatch(opCode byte) {
 				isLocal := v.GetByte()
 				index := BytesToInt16(v.GetBytes(2))
 				if isLocal == 1 {
+					// Each closure gets a copy of the local of its own, so
+					// there's no upvalue to share with closures made before
 					localVal := v.Stack[v.Frame.slotptr+int(index)]
-					closure.Upvalues[i] = v.CaptureUpvalue(&localVal, int(index))
+					closure.Upvalues[i] = NewUpvalue(&localVal)
 				} else {
 					closure.Upvalues[i] = v.Frame.Closure.Upvalues[index]
 				}
 			}
 		}
 
+	case OP_CLOSE_UPVALUE:
+		// Closures capture a copy of the local when they're created,
+		// so there is nothing left to move off the stack here
+
 	case OP_SET_UPVALUE:
 		slot := v.GetOperandValue()
 		*v.Frame.Closure.Upvalues[slot].Reference = v.Peek(0).(*ObjUpvalue)
@@ -524,9 +725,23 @@ func (v *VM) Dispatch(opCode byte) {
 		v.sp--
 
 	case OP_GET_PROPERTY:
-		classInst := v.Pop().(*ObjInstance)
 		idx := string(v.GetOperand().(ObjString))
-		v.Push(classInst.Fields[idx])
+		switch obj := v.Pop().(type) {
+		case *ObjDataFrame:
+			v.Push(obj.GetProperty(idx))
+		case *ObjFile:
+			v.Push(v.FileProperty(obj, idx))
+		case *ObjChannel:
+			v.Push(v.ChannelProperty(obj, idx))
+		case *ObjThread:
+			v.Push(v.ThreadProperty(obj, idx))
+		case *ObjConnection:
+			v.Push(v.ConnectionProperty(obj, idx))
+		case *ObjListener:
+			v.Push(v.ListenerProperty(obj, idx))
+		default:
+			v.Push(obj.(*ObjInstance).Fields[idx])
+		}
 
 	case OP_CALL_NATIVE:
 		v.CallNative()
@@ -544,16 +759,23 @@ func (v *VM) Dispatch(opCode byte) {
 		v.Push(ObjInteger(1))
 
 	case OP_IADD:
-
-		rval := v.Pop().(ObjInteger)
-		lval := v.Pop().(ObjInteger)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjInteger)
+		lval, lok := left.(ObjInteger)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_IADD, left, right)
+			break
+		}
 		v.Push(rval + lval)
 
 	case OP_FADD:
-		rval := v.Pop().(ObjFloat)
-		lval := v.Pop().(ObjFloat)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjFloat)
+		lval, lok := left.(ObjFloat)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_FADD, left, right)
+			break
+		}
 		v.Push(rval + lval)
 	case OP_SADD:
 		rval := string(v.Pop().(ObjString))
@@ -561,34 +783,58 @@ func (v *VM) Dispatch(opCode byte) {
 
 		v.Push(ObjString(lval + rval))
 	case OP_ISUBTRACT:
-		rval := v.Pop().(ObjInteger)
-		lval := v.Pop().(ObjInteger)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjInteger)
+		lval, lok := left.(ObjInteger)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_ISUBTRACT, left, right)
+			break
+		}
 		v.Push(lval - rval)
 	case OP_FSUBTRACT:
-		rval := v.Pop().(ObjFloat)
-		lval := v.Pop().(ObjFloat)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjFloat)
+		lval, lok := left.(ObjFloat)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_FSUBTRACT, left, right)
+			break
+		}
 		v.Push(lval - rval)
 	case OP_IMULTIPLY:
-		rval := int64(v.Pop().(ObjInteger))
-		lval := int64(v.Pop().(ObjInteger))
-
-		v.Push(ObjInteger(rval * lval))
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjInteger)
+		lval, lok := left.(ObjInteger)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_IMULTIPLY, left, right)
+			break
+		}
+		v.Push(rval * lval)
 	case OP_FMULTIPLY:
-		rval := v.Pop().(ObjFloat)
-		lval := v.Pop().(ObjFloat)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjFloat)
+		lval, lok := left.(ObjFloat)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_FMULTIPLY, left, right)
+			break
+		}
 		v.Push(rval * lval)
 	case OP_IDIVIDE:
-		rval := int64(v.Pop().(ObjInteger))
-		lval := int64(v.Pop().(ObjInteger))
-
-		v.Push(ObjInteger(lval / rval))
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjInteger)
+		lval, lok := left.(ObjInteger)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_IDIVIDE, left, right)
+			break
+		}
+		v.Push(lval / rval)
 	case OP_FDIVIDE:
-		rval := v.Pop().(ObjFloat)
-		lval := v.Pop().(ObjFloat)
-
+		right, left := v.Pop(), v.Pop()
+		rval, rok := right.(ObjFloat)
+		lval, lok := left.(ObjFloat)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_FDIVIDE, left, right)
+			break
+		}
 		v.Push(lval / rval)
 	case OP_NIL:
 		v.Push(&NULL{})
@@ -601,13 +847,20 @@ func (v *VM) Dispatch(opCode byte) {
 		//v.Push(val)
 
 	case OP_INEGATE:
-		val := -int64(v.Pop().(ObjInteger))
+		val := int64(v.Pop().(ObjInteger))
 		v.Push(ObjInteger(-val))
 
 	case OP_FNEGATE:
-		val := -v.Pop().(ObjFloat)
+		val := v.Pop().(ObjFloat)
 		v.Push(-val)
 
+	// Widening for operators with an int on one side and a float on the other
+	case OP_INT_TO_FLOAT:
+		v.Stack[v.sp-1] = ObjFloat(v.Stack[v.sp-1].(ObjInteger))
+
+	case OP_INT_TO_FLOAT_LEFT:
+		v.Stack[v.sp-2] = ObjFloat(v.Stack[v.sp-2].(ObjInteger))
+
 	case OP_SET_HLOCAL:
 		val := v.Pop()
 		index := v.ReadConstant(int16(v.Pop().(ObjInteger)))
@@ -615,9 +868,9 @@ func (v *VM) Dispatch(opCode byte) {
 		oList.SetValue(index, val)
 
 	case OP_GET_HLOCAL:
-		elem := v.Pop()
-		slot := v.GetOperandValue()
-		v.Push(v.Frame.slots[slot].(ObjList).GetValue(elem))
+		index := v.ReadConstant(int16(v.Pop().(ObjInteger)))
+		list := v.Frame.slots[v.GetOperandValue()].(*ObjList)
+		v.Push(list.GetValue(index))
 
 	case OP_GET_HGLOBAL:
 		index := v.ReadConstant(int16(v.Pop().(ObjInteger)))
@@ -684,7 +937,7 @@ func (v *VM) Dispatch(opCode byte) {
 	case OP_GET_ALOCAL:
 		elem := int64(*v.Pop().(*ObjInteger))
 		slot := v.GetOperandValue()
-		v.Push(v.Frame.slots[slot].(*ObjArray).Elements[elem])
+		v.Push(v.Frame.slots[slot].(*ObjArray).GetElement(elem))
 
 	case OP_SET_ALOCAL:
 		slot := v.GetOperandValue()
@@ -702,7 +955,7 @@ func (v *VM) Dispatch(opCode byte) {
 		elem := int64(v.Pop().(ObjInteger))
 		idx := v.GetOperandValue()
 		pval := v.Globals[idx]
-		v.Push(pval.(*ObjArray).Elements[elem])
+		v.Push(pval.(*ObjArray).GetElement(elem))
 
 	case OP_SET_AGLOBAL:
 		idx := v.GetOperandValue()
@@ -736,46 +989,48 @@ func (v *VM) Dispatch(opCode byte) {
 		v.ForLoop()
 
 	case OP_LESS:
-		rval := v.Pop().ToBytes()
-		lval := v.Pop().ToBytes()
-
-		v.Push(&ObjBool{Value: bytes.Compare(lval, rval) < 0})
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) < 0})
 
 	case OP_LESS_EQUAL:
-		rval := v.Pop().ToBytes()
-		lval := v.Pop().ToBytes()
-
-		v.Push(&ObjBool{Value: bytes.Compare(lval, rval) <= 0})
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) <= 0})
 
 	case OP_GREATER:
-		rval := v.Pop().ToBytes()
-		lval := v.Pop().ToBytes()
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) > 0})
 
-		v.Push(&ObjBool{Value: bytes.Compare(lval, rval) > 0})
+	case OP_GREATER_EQUAL:
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) >= 0})
 
 	case OP_NOT_EQUAL:
-		rval := v.Pop().ToBytes()
-		lval := v.Pop().ToBytes()
-
-		v.Push(&ObjBool{Value: !bytes.Equal(rval, lval)})
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) != 0})
 
 	case OP_EQUAL:
-		rval := v.Pop().ToBytes()
-		lval := v.Pop().ToBytes()
-
-		v.Push(&ObjBool{Value: bytes.Equal(rval, lval)})
+		right, left := v.Pop(), v.Pop()
+		v.Push(&ObjBool{Value: CompareValues(left, right) == 0})
 
 	case OP_IEXP:
-		pwr := int64(*v.Pop().(*ObjInteger))
-		lval := int64(*v.Pop().(*ObjInteger))
-
+		right, left := v.Pop(), v.Pop()
+		pwr, rok := right.(ObjInteger)
+		lval, lok := left.(ObjInteger)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_IEXP, left, right)
+			break
+		}
 		v.Push(ObjInteger(int64(math.Pow(float64(lval), float64(pwr)))))
 
 	case OP_FEXP:
-		pwr := float64(v.Pop().(ObjFloat))
-		lval := float64(v.Pop().(ObjFloat))
-
-		v.Push(ObjFloat(math.Pow(lval, pwr)))
+		right, left := v.Pop(), v.Pop()
+		pwr, rok := right.(ObjFloat)
+		lval, lok := left.(ObjFloat)
+		if !rok || !lok {
+			v.UntypedArithmetic(OP_FEXP, left, right)
+			break
+		}
+		v.Push(ObjFloat(math.Pow(float64(lval), float64(pwr))))
 
 	case OP_TRUE:
 		v.Push(&ObjBool{Value: true})
@@ -793,7 +1048,7 @@ func (v *VM) Dispatch(opCode byte) {
 
 		lObj := new(ObjList)
 		lObj.ElementCount = 0
-		lObj.HValueType = ExpressionData{valType, objType, 1}
+		lObj.HValueType = ExpressionData{Value: valType, ObjType: objType, Dimensions: 1}
 		lObj.KeyType = keyType
 		lObj.List = make(map[HashKey]Obj)
 
@@ -805,11 +1060,12 @@ func (v *VM) Dispatch(opCode byte) {
 		keyType := v.GetByte()
 		lObj := new(ObjList)
 		lObj.Init(ValueType(keyType), int(keyCount))
-		for i := int64(0); i < keyCount; i++ {
-			val := v.Pop()
-			key := v.Pop()
-			lObj.AddNew(key, val) // Key, Value
+		// The pairs are on the stack in the order they were written
+		start := v.sp - int(keyCount)*2
+		for i := start; i < v.sp; i += 2 {
+			lObj.AddNew(v.Stack[i], v.Stack[i+1]) // Key, Value
 		}
+		v.sp = start
 		v.Push(lObj)
 
 	case OP_ARRAY:
@@ -852,9 +1108,12 @@ func (v *VM) Dispatch(opCode byte) {
 			indexes[i] = int64(v.Pop().(ObjInteger))
 		}
 
-		array := v.Pop().(*ObjArray)
-
-		v.Push(array.GetElement(indexes...))
+		switch obj := v.Pop().(type) {
+		case *ObjDataFrame:
+			v.Push(obj.Row(indexes[0]))
+		default:
+			v.Push(obj.(*ObjArray).GetElement(indexes...))
+		}
 
 	case OP_MAKE_ARRAY:
 		valType := ValueType(v.Pop().(ObjInteger))
@@ -909,65 +1168,170 @@ func (v *VM) Dispatch(opCode byte) {
 		//db.DropTable(tableName)
 
 	case OP_SQL_SELECT:
-
-		vars := int(v.Pop().(ObjInteger))
-		vals := make([]interface{},vars)
-
-		for i:=vars-1;i>=0;i-- {
-			vObj := v.Pop()
-			val := vObj.ToValue()
-			if vObj.Type() == VAL_STRING {
-				val = fmt.Sprintf("'%s'",val)
-			}
-			vals[i] = val
-		}
-
+		vals := v.PopSqlParameters()
 		sqlCmd := string(v.GetOperand().(ObjString))
-		if vars > 0 {
-			sqlCmd = fmt.Sprintf(sqlCmd, vals...)
+		rows,err := v.db.Query(sqlCmd, vals...)
+		if err != nil {
+			v.Error("Query error: %s", err.Error())
 		}
-		rows,err := v.db.Query(sqlCmd)
+		df, err := NewDataFrame("df", rows)
 		if err != nil {
-			fmt.Println("Query error: " + err.Error())
-		} else {
-
-			df := new(ObjDataFrame)
-			df.Name = "df"
-
-			// Grab the column types
-			df.Rows = rows
-			df.Columns, _ = rows.ColumnTypes()
-			df.ColNames, _ = rows.Columns()
-			df.ColumnCount = int16(len(df.Columns))
-
-			v.Push(df)
+			v.Error("Query error: %s", err.Error())
 		}
-	case OP_INSERT:
+		v.Push(df)
 
-		vars := int(v.Pop().(ObjInteger))
-		vals := make([]interface{},vars)
-
-		for i:=vars-1;i>=0;i-- {
-			vals[i] = v.Pop().ToValue()
+	case OP_INSERT:
+		vals := v.PopSqlParameters()
+		sql := string(v.GetOperand().(ObjString))
+		if _, err := v.db.Exec(sql, vals...); err != nil {
+			v.Error("Insert error: %s", err.Error())
 		}
 
+	case OP_UPDATE, OP_DELETE:
+		vals := v.PopSqlParameters()
 		sql := string(v.GetOperand().(ObjString))
-		if vars > 0 {
-			sql = fmt.Sprintf(sql, vals...)
+		v.Push(ObjInteger(v.ExecCount(sql, vals)))
+
+	case OP_LOAD_CSV:
+		table := string(v.GetOperand().(ObjString))
+		path := string(v.Pop().(ObjString))
+		if _, err := LoadCsv(v.db, path, table, DefaultCsvOptions); err != nil {
+			v.Error("Can't load '%s' into table '%s': %s", path, table, err.Error())
 		}
-		//fmt.Printf(sql)
-		v.db.Exec(sql)
 
 	case OP_DISPLAY_TABLE:
 		df := v.Pop().(*ObjDataFrame)
 		df.PrintData(0)
 
+	case OP_SPAWN:
+		argCount := int(v.GetOperandValue())
+		args := make([]Obj, argCount)
+		for i := argCount - 1; i >= 0; i-- {
+			args[i] = v.Pop()
+		}
+		closure, ok := v.Pop().(*ObjClosure)
+		if !ok {
+			v.Error("Only functions can be spawned")
+		}
+		v.Push(v.Spawn(closure, args))
+
+	case OP_MAKE_CHANNEL:
+		elemType := ValueType(v.GetOperandValue())
+		buffer := int(v.Pop().(ObjInteger))
+		if buffer < 0 {
+			v.Error("The buffer of a channel can't hold %d values", buffer)
+		}
+		v.Push(NewChannel(elemType, buffer))
+
+	case OP_SELECT:
+		count := int(v.GetOperandValue())
+		kinds := make([]int16, count)
+		offsets := make([]int16, count)
+		for i := 0; i < count; i++ {
+			kinds[i] = v.GetOperandValue()
+			offsets[i] = v.GetOperandValue()
+		}
+		v.Frame.ip += int(offsets[v.Select(kinds)])
+
+	case OP_PFOR:
+		v.ParallelFor()
+
 	case OP_IMPORT:
-		idx := v.GetOperandValue()
+		v.ImportModule(int(v.GetOperandValue()))
+
+	case OP_TRY:
+		offset := int(v.GetOperandValue())
+		v.PushHandler(v.Frame.ip + offset)
+
+	case OP_END_TRY:
+		v.PopHandler()
+
+	case OP_THROW:
+		panic(v.ThrownError(v.Pop()))
+
+	case OP_END_FINALLY:
+		// If we got to the finally block because of an error, then
+		// now that it has run the error carries on to the next handler
+		pending := v.Pop()
+		if pending.Type() != VAL_NIL {
+			panic(v.ThrownError(pending))
+		}
 
 
 	default:
-		fmt.Printf("Unhandled command: %s\n", OpLabel[(*v.GetByteCode())[v.Frame.ip]])
-		return
+		v.Error("Unhandled command: %s", OpLabel[(*v.GetByteCode())[v.Frame.ip]])
+	}
+}
+
+// The compiler uses the int operators when it doesn't know the type of either
+// side, such as for a value from a list, and the float ones when it only
+// knows that one side is a float. When a side turns out to be something else
+// the operator is worked out from the values instead: strings are added
+// together and any other numbers are worked out as floats
+func (v *VM) UntypedArithmetic(opCode byte, left Obj, right Obj) {
+	if opCode == OP_IADD {
+		if l, ok := left.(ObjString); ok {
+			if r, ok := right.(ObjString); ok {
+				v.Push(l + r)
+				return
+			}
+		}
+	}
+	l, lok := untypedFloat(left)
+	r, rok := untypedFloat(right)
+	if !lok || !rok {
+		v.Error("Operator %s can't be applied to %s and %s", OpLabel[opCode],
+			ValueTypeLabel[left.Type()], ValueTypeLabel[right.Type()])
+	}
+	switch opCode {
+	case OP_IADD, OP_FADD:
+		v.Push(ObjFloat(l + r))
+	case OP_ISUBTRACT, OP_FSUBTRACT:
+		v.Push(ObjFloat(l - r))
+	case OP_IMULTIPLY, OP_FMULTIPLY:
+		v.Push(ObjFloat(l * r))
+	case OP_IDIVIDE, OP_FDIVIDE:
+		v.Push(ObjFloat(l / r))
+	case OP_IEXP, OP_FEXP:
+		v.Push(ObjFloat(math.Pow(l, r)))
+	}
+}
+
+// Numbers are compared by value, so an int from a list that the compiler
+// couldn't widen still compares properly with a float. Everything else is
+// compared by its bytes
+func CompareValues(left Obj, right Obj) int {
+	l, lok := untypedFloat(left)
+	r, rok := untypedFloat(right)
+	if !lok || !rok {
+		return bytes.Compare(left.ToBytes(), right.ToBytes())
+	}
+	if li, ok := left.(ObjInteger); ok {
+		if ri, ok := right.(ObjInteger); ok {
+			switch {
+			case li < ri:
+				return -1
+			case li > ri:
+				return 1
+			}
+			return 0
+		}
+	}
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func untypedFloat(val Obj) (float64, bool) {
+	switch num := val.(type) {
+	case ObjInteger:
+		return float64(num), true
+	case ObjFloat:
+		return float64(num), true
 	}
+	return 0, false
 }
@@ -1,6 +1,303 @@
 package main
 
-func (vm *VM) Error() {
-	
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+type InterpretResult byte
+
+const (
+	INTERPRET_OK InterpretResult = iota
+	INTERPRET_COMPILE_ERROR
+	INTERPRET_RUNTIME_ERROR
+)
+
+// A runtime error raised by the VM, by one of the native functions or by a
+// 'throw' in the script. Only the message needs to be filled in by whoever
+// raises it; the line and the call stack get filled in by the VM when it
+// catches the error
+type RuntimeError struct {
+	Message string
+	Line    int
+	Stack   []string // Innermost frame first
+	Value   Obj      // The value given to 'throw', if there was one
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
+
+func (e *RuntimeError) Print() {
+	fmt.Fprintf(os.Stderr, "Runtime error: %s\n", e.Message)
+	for _, entry := range e.Stack {
+		fmt.Fprintf(os.Stderr, "  %s\n", entry)
+	}
+}
+
+// Raises a runtime error from anywhere inside the VM, including natives and
+// object methods that don't have a reference to the VM
+func RaiseRuntimeError(format string, args ...interface{}) {
+	panic(&RuntimeError{Message: fmt.Sprintf(format, args...)})
 }
 
+func (v *VM) Error(format string, args ...interface{}) {
+	RaiseRuntimeError(format, args...)
+}
+
+// Turns whatever was recovered from a panic into a runtime error. Go runtime
+// panics (bad type assertions, index out of range ..) come from operands that
+// didn't have the type the compiler expected
+func (v *VM) ToRuntimeError(recovered interface{}) *RuntimeError {
+	var rtErr *RuntimeError
+
+	switch err := recovered.(type) {
+	case *RuntimeError:
+		rtErr = err
+	case *runtime.TypeAssertionError:
+		rtErr = &RuntimeError{Message: "Type mismatch: " + coyoteTypeNames(err.Error())}
+	case runtime.Error:
+		rtErr = &RuntimeError{Message: strings.TrimPrefix(err.Error(), "runtime error: ")}
+	case error:
+		rtErr = &RuntimeError{Message: err.Error()}
+	default:
+		rtErr = &RuntimeError{Message: fmt.Sprint(err)}
+	}
+
+	// Errors that were already caught once (or rethrown) keep the
+	// location where they first happened
+	if rtErr.Stack == nil {
+		rtErr.Line = v.CurrentLine()
+		rtErr.Stack = v.StackTrace()
+	}
+	return rtErr
+}
+
+// Builds the Coyote call stack with the innermost frame first
+func (v *VM) StackTrace() []string {
+	stack := make([]string, 0, v.fp)
+	for i := v.fp - 1; i >= 0; i-- {
+		frame := &v.Frames[i]
+		if frame.Closure == nil {
+			continue
+		}
+		location := fmt.Sprintf("line %d", v.LineOf(frame))
+		if file := frame.Closure.Function.Code.File; file != "" {
+			location = fmt.Sprintf("%s:%d", file, v.LineOf(frame))
+		}
+		stack = append(stack, fmt.Sprintf("[%s] in %s", location, frame.Closure.Function.DisplayName()))
+	}
+	return stack
+}
+
+var goTypeName = regexp.MustCompile(`\*?main\.Obj[A-Za-z]*|\*?main\.NULL`)
+
+var coyoteTypeLabel = map[string]string{
+	"ObjInteger":   "int",
+	"ObjFloat":     "float",
+	"ObjString":    "string",
+	"ObjBool":      "bool",
+	"ObjByte":      "byte",
+	"NULL":         "nil",
+	"ObjArray":     "array",
+	"ObjList":      "list",
+	"ObjClosure":   "function",
+	"ObjNative":    "native function",
+	"ObjClass":     "class",
+	"ObjInstance":  "object",
+	"ObjEnum":      "enum",
+	"ObjMatrix":    "matrix",
+	"ObjDataFrame": "table",
+	"ObjRange":     "range",
+	"ObjFile":      "file",
+	"ObjChannel":   "channel",
+	"ObjThread":    "thread",
+	"ObjConnection": "connection",
+	"ObjListener":  "listener",
+	"Obj":          "value",
+}
+
+// Rewrites the Go type names in a runtime error into their Coyote names. A
+// value held where a pointer to it was expected, or the other way round,
+// would read as "array, not array", so those keep their Go names
+func coyoteTypeNames(msg string) string {
+	msg = strings.TrimPrefix(msg, "interface conversion: ")
+	labels := make(map[string]string)
+	goNames := false
+	for _, name := range goTypeName.FindAllString(msg, -1) {
+		label, ok := coyoteTypeLabel[strings.TrimPrefix(strings.TrimPrefix(name, "*"), "main.")]
+		if !ok {
+			label = strings.TrimPrefix(strings.TrimPrefix(name, "*"), "main.")
+		}
+		for other, otherLabel := range labels {
+			goNames = goNames || (other != name && otherLabel == label)
+		}
+		labels[name] = label
+	}
+	return goTypeName.ReplaceAllStringFunc(msg, func(name string) string {
+		if goNames && name != "main.Obj" {
+			return strings.Replace(name, "main.", "", 1)
+		}
+		return labels[name]
+	})
+}
+
+/* ---------------------------------------------------------------------------
+Exception handling. Every 'try' pushes a handler on to the frame it runs in and
+the handler comes off again when the try block completes. When an error gets
+raised we look for the nearest handler, throw away every frame above the one it
+belongs to and continue at the start of the catch block with the error on the
+stack.
+------------------------------------------------------------------------------*/
+type ExceptionHandler struct {
+	CatchIp   int // Where to continue when an error is caught
+	Sp        int // The stack pointer at the time we entered the try block
+	LoopDepth int // How many loops deep the VM was when we entered the try block
+}
+
+// The class of the objects handed to a catch block
+var ErrorClass = &ObjClass{
+	Fields: make(map[string]Obj),
+}
+
+// Builds the object a catch block receives. It exposes the message, the line
+// where the error happened and the call stack at that point as properties
+func NewErrorInstance(err *RuntimeError) *ObjInstance {
+	stack := make([]Obj, len(err.Stack))
+	for i := range err.Stack {
+		stack[i] = ObjString(err.Stack[i])
+	}
+
+	var value Obj = &NULL{}
+	if err.Value != nil {
+		value = err.Value
+	}
+
+	return &ObjInstance{
+		Class: ErrorClass,
+		Fields: map[string]Obj{
+			"message": ObjString(err.Message),
+			"line":    ObjInteger(err.Line),
+			"stack": &ObjArray{
+				ElementCount: len(stack),
+				ElementTypes: VAL_STRING,
+				DimCount:     1,
+				Dimensions:   []int{len(stack)},
+				Elements:     stack,
+			},
+			"value": value,
+		},
+	}
+}
+
+// Turns a thrown value into a runtime error. An error object that was caught
+// earlier keeps the location it was originally raised at
+func (v *VM) ThrownError(val Obj) *RuntimeError {
+	if inst, ok := val.(*ObjInstance); ok && inst.Class == ErrorClass {
+		stackArray := inst.Fields["stack"].(*ObjArray)
+		stack := make([]string, stackArray.ElementCount)
+		for i := range stack {
+			stack[i] = string(stackArray.Elements[i].(ObjString))
+		}
+		return &RuntimeError{
+			Message: string(inst.Fields["message"].(ObjString)),
+			Line:    int(inst.Fields["line"].(ObjInteger)),
+			Stack:   stack,
+			Value:   inst.Fields["value"],
+		}
+	}
+	return &RuntimeError{
+		Message: val.ShowValue(),
+		Value:   val,
+	}
+}
+
+func (v *VM) PushHandler(catchIp int) {
+	v.Frame.Handlers = append(v.Frame.Handlers, ExceptionHandler{
+		CatchIp:   catchIp,
+		Sp:        v.sp,
+		LoopDepth: v.loopDepth,
+	})
+}
+
+func (v *VM) PopHandler() {
+	v.Frame.Handlers = v.Frame.Handlers[:len(v.Frame.Handlers)-1]
+}
+
+// Runs a single instruction. Errors are caught here at every level of loop
+// nesting so that a handler set up inside a loop body resumes in that loop
+func (v *VM) SafeDispatch(opCode byte) {
+	depth := v.loopDepth
+	defer func() {
+		if r := recover(); r != nil {
+			// Quitting the debugger isn't an error a program can catch
+			if _, ok := r.(debugQuit); ok {
+				panic(r)
+			}
+			rtErr := v.ToRuntimeError(r)
+			if !v.CatchError(rtErr, depth) {
+				if v.Debugger != nil && !v.HasHandler() {
+					v.Debugger.Uncaught(rtErr)
+				}
+				panic(rtErr)
+			}
+		}
+	}()
+	if v.Debugger != nil {
+		v.Debugger.Trace()
+	}
+	v.Dispatch(opCode)
+}
+
+// Checks if any frame has a try block open that could catch an error
+func (v *VM) HasHandler() bool {
+	for i := v.fp - 1; i >= 0; i-- {
+		if len(v.Frames[i].Handlers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwinds to the nearest handler if it belongs to the given loop depth. If it
+// doesn't, the error needs to keep travelling up to the level that owns it
+func (v *VM) CatchError(err *RuntimeError, depth int) bool {
+	// A handler from a loop that has already finished can't catch anything,
+	// so it's thrown away on the way to the nearest one that can
+	frame := v.fp - 1
+	for ; frame >= 0; frame-- {
+		handlers := v.Frames[frame].Handlers
+		for len(handlers) > 0 && handlers[len(handlers)-1].LoopDepth > depth {
+			handlers = handlers[:len(handlers)-1]
+		}
+		v.Frames[frame].Handlers = handlers
+		if len(handlers) > 0 {
+			break
+		}
+	}
+	if frame < 0 {
+		return false
+	}
+
+	handlers := v.Frames[frame].Handlers
+	handler := handlers[len(handlers)-1]
+	if handler.LoopDepth != depth {
+		return false
+	}
+
+	// Throw away every frame above the one that owns the handler
+	v.fp = frame + 1
+	v.Frame = &v.Frames[frame]
+	v.Code = v.Frame.Closure.Function.Code.Code[:]
+	v.Frame.Handlers = handlers[:len(handlers)-1]
+
+	v.sp = handler.Sp
+	v.loopDepth = depth
+	v.Frame.ip = handler.CatchIp
+	v.Push(NewErrorInstance(err))
+
+	return true
+}